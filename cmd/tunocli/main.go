@@ -4,11 +4,16 @@ import (
 	"fmt"
 	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
 	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/logger"
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/tunnel"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"os"
+	"os/exec"
 	"os/signal"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -24,6 +29,8 @@ var (
 	certFile   string
 	keyFile    string
 	caCertFile string
+
+	importDisabled bool
 )
 
 var rootCmd = &cobra.Command{
@@ -58,7 +65,7 @@ var serverCmd = &cobra.Command{
 
 		// Apply command-line overrides
 		if listenAddr != "" {
-			cfg.ListenAddr = listenAddr
+			cfg.Transport, cfg.ListenAddr = config.SplitTransportAddr(cfg.Transport, listenAddr)
 		}
 		if tunDevice != "" {
 			cfg.TunDevice = tunDevice
@@ -98,7 +105,7 @@ var clientCmd = &cobra.Command{
 
 		// Apply command-line overrides
 		if serverAddr != "" {
-			cfg.ServerAddr = serverAddr
+			cfg.Transport, cfg.ServerAddr = config.SplitTransportAddr(cfg.Transport, serverAddr)
 		}
 		if tunDevice != "" {
 			cfg.TunDevice = tunDevice
@@ -123,6 +130,246 @@ var clientCmd = &cobra.Command{
 	},
 }
 
+var execCmd = &cobra.Command{
+	Use:   "exec -- command [args...]",
+	Short: "Run a command with per-application routing",
+	Long: `Run a command in the cgroup used for per-application routing. With
+app_mode set to include, only its traffic goes through the tunnel; with
+exclude, its traffic bypasses the tunnel. The client must be running.
+Under sudo, the command runs as the user who invoked sudo.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.LoadClientConfig(cfgFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			os.Exit(1)
+		}
+		if cfg.AppMode != "include" && cfg.AppMode != "exclude" {
+			fmt.Fprintln(os.Stderr, "Per-application routing is disabled, set app_mode to include or exclude")
+			os.Exit(1)
+		}
+
+		path, err := exec.LookPath(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		// Join the cgroup, the command inherits it
+		if err := tunnel.JoinAppCgroup(cfg.AppCgroup, os.Getpid()); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		// Joining the cgroup needs root, the command should run as the user who ran sudo
+		if err := dropSudoPrivileges(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to drop privileges: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := syscall.Exec(path, args, os.Environ()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run %s: %v\n", args[0], err)
+			os.Exit(1)
+		}
+	},
+}
+
+// dropSudoPrivileges switches to the user that invoked sudo, if any
+func dropSudoPrivileges() error {
+	if os.Geteuid() != 0 || os.Getenv("SUDO_UID") == "" {
+		return nil
+	}
+
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil {
+		return fmt.Errorf("invalid SUDO_UID: %v", err)
+	}
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		return fmt.Errorf("invalid SUDO_GID: %v", err)
+	}
+
+	// Keep the user's supplementary groups rather than root's
+	groups := []int{gid}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if g, err := strconv.Atoi(id); err == nil && g != gid {
+					groups = append(groups, g)
+				}
+			}
+		}
+	}
+
+	// Groups must change while still root
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	return nil
+}
+
+var routeCmd = &cobra.Command{
+	Use:   "route",
+	Short: "Change the routes of a running client",
+}
+
+var routeAddCmd = &cobra.Command{
+	Use:   "add <network> [tun|internet|drop]",
+	Short: "Add or update a route",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		routeType := "tun"
+		if len(args) > 1 {
+			routeType = args[1]
+		}
+		sendRouteCommand(&tunnel.ControlRequest{Command: tunnel.ControlRouteAdd, Network: args[0], Type: routeType})
+	},
+}
+
+var routeDelCmd = &cobra.Command{
+	Use:   "del <network>",
+	Short: "Remove a route",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sendRouteCommand(&tunnel.ControlRequest{Command: tunnel.ControlRouteDel, Network: args[0]})
+	},
+}
+
+var routeListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List routes and route sets",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		resp := sendRouteCommand(&tunnel.ControlRequest{Command: tunnel.ControlRouteList})
+		for _, route := range resp.Routes {
+			fmt.Printf("%-43s %s\n", route.Network, route.Type)
+		}
+		for _, set := range resp.Sets {
+			state := "disabled"
+			if set.Enabled {
+				state = "enabled"
+			}
+			fmt.Printf("set %-39s %s, %d networks, %s (%s)\n", set.Name, set.Type, set.Count, state, set.File)
+		}
+	},
+}
+
+var routeImportCmd = &cobra.Command{
+	Use:   "import <set> <file> [tun|internet|drop]",
+	Short: "Import a network list as a named route set, replacing it if it exists",
+	Args:  cobra.RangeArgs(2, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		// The client reads the file, possibly from another working directory
+		file, err := filepath.Abs(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid file: %v\n", err)
+			os.Exit(1)
+		}
+		routeType := "tun"
+		if len(args) > 2 {
+			routeType = args[2]
+		}
+		resp := sendRouteCommand(&tunnel.ControlRequest{
+			Command:  tunnel.ControlSetImport,
+			Name:     args[0],
+			File:     file,
+			Type:     routeType,
+			Disabled: importDisabled,
+		})
+		for _, set := range resp.Sets {
+			fmt.Printf("Imported %d networks into %s\n", set.Count, set.Name)
+		}
+	},
+}
+
+var routeEnableCmd = &cobra.Command{
+	Use:   "enable <set>",
+	Short: "Enable a route set, reading its file again",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sendRouteCommand(&tunnel.ControlRequest{Command: tunnel.ControlSetEnable, Name: args[0]})
+	},
+}
+
+var routeDisableCmd = &cobra.Command{
+	Use:   "disable <set>",
+	Short: "Disable a route set",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sendRouteCommand(&tunnel.ControlRequest{Command: tunnel.ControlSetDisable, Name: args[0]})
+	},
+}
+
+var routeRemoveCmd = &cobra.Command{
+	Use:   "remove <set>",
+	Short: "Remove a route set",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sendRouteCommand(&tunnel.ControlRequest{Command: tunnel.ControlSetRemove, Name: args[0]})
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the connection state and the settings pushed by the server",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		resp := sendRouteCommand(&tunnel.ControlRequest{Command: tunnel.ControlStatus})
+		if resp.Connected {
+			fmt.Println("Connected")
+		} else {
+			fmt.Println("Not connected")
+		}
+		settings := resp.Settings
+		if settings == nil {
+			fmt.Println("No settings pushed by the server yet")
+			return
+		}
+		fmt.Printf("Address:   %s\n", settings.Address)
+		if settings.Address6 != "" {
+			fmt.Printf("Address6:  %s\n", settings.Address6)
+		}
+		if settings.DelegatedPrefix != "" {
+			fmt.Printf("Prefix:    %s\n", settings.DelegatedPrefix)
+		}
+		fmt.Printf("MTU:       %d\n", settings.MTU)
+		if len(settings.Routes) > 0 {
+			fmt.Printf("Routes:    %s\n", strings.Join(settings.Routes, ", "))
+		}
+		if len(settings.DNS) > 0 {
+			fmt.Printf("DNS:       %s\n", strings.Join(settings.DNS, ", "))
+		}
+		if len(settings.Domains) > 0 {
+			fmt.Printf("Domains:   %s\n", strings.Join(settings.Domains, ", "))
+		}
+		if settings.Keepalive > 0 {
+			fmt.Printf("Keepalive: every %ds, timeout %ds\n", settings.Keepalive, settings.KeepaliveTimeout)
+		}
+	},
+}
+
+// sendRouteCommand sends a command to the running client, exiting on failure
+func sendRouteCommand(req *tunnel.ControlRequest) *tunnel.ControlResponse {
+	cfg, err := config.LoadClientConfig(cfgFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	resp, err := tunnel.SendControl(tunnel.ControlSocketPath(cfg.StateDir), req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return resp
+}
+
 func setupLogging() *logrus.Logger {
 	log := logger.New()
 
@@ -157,22 +404,29 @@ func init() {
 	rootCmd.PersistentFlags().IntVarP(&verbosity, "verbose", "v", 0, "verbosity level (0-2)")
 
 	// Server command flags
-	serverCmd.Flags().StringVar(&listenAddr, "listen", "", "address to listen on (e.g., 0.0.0.0:8080)")
+	serverCmd.Flags().StringVar(&listenAddr, "listen", "", "address to listen on (e.g., 0.0.0.0:8080 or udp://0.0.0.0:8080)")
 	serverCmd.Flags().StringVar(&tunDevice, "tun", "", "TUN device name (e.g., tun0)")
 	serverCmd.Flags().StringVar(&tunIP, "tun-ip", "", "TUN interface IP (e.g., 10.0.0.1/24)")
 	serverCmd.Flags().StringVar(&certFile, "cert", "", "TLS certificate file")
 	serverCmd.Flags().StringVar(&keyFile, "key", "", "TLS key file")
 
 	// Client command flags
-	clientCmd.Flags().StringVar(&serverAddr, "server", "", "server address (e.g., example.com:8080)")
+	clientCmd.Flags().StringVar(&serverAddr, "server", "", "server address (e.g., example.com:8080 or udp://example.com:8080)")
 	clientCmd.Flags().StringVar(&tunDevice, "tun", "", "TUN device name (e.g., tun0)")
 	clientCmd.Flags().StringVar(&tunIP, "tun-ip", "", "TUN interface IP (e.g., 10.0.0.2/24)")
 	clientCmd.Flags().StringVar(&caCertFile, "ca-cert", "", "CA certificate file for server verification")
 
+	// Route command flags
+	routeImportCmd.Flags().BoolVar(&importDisabled, "disabled", false, "import the set without enabling it")
+	routeCmd.AddCommand(routeAddCmd, routeDelCmd, routeListCmd, routeImportCmd, routeEnableCmd, routeDisableCmd, routeRemoveCmd)
+
 	// Add subcommands
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(serverCmd)
 	rootCmd.AddCommand(clientCmd)
+	rootCmd.AddCommand(execCmd)
+	rootCmd.AddCommand(routeCmd)
+	rootCmd.AddCommand(statusCmd)
 }
 
 func main() {
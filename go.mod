@@ -9,6 +9,7 @@ require (
 	github.com/vishvananda/netlink v1.3.0
 	golang.org/x/net v0.30.0
 	golang.org/x/sys v0.32.0
+	golang.org/x/time v0.7.0
 	gvisor.dev/gvisor v0.0.0-20250428223947-8d061298ccd2
 )
 
@@ -27,6 +28,5 @@ require (
 	github.com/vishvananda/netns v0.0.4 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
-	golang.org/x/time v0.7.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -221,3 +221,8 @@ func (t *TLSConn) RemoteAddr() net.Addr {
 func (t *TLSConn) State() tls.ConnectionState {
 	return t.conn.ConnectionState()
 }
+
+// NetConn returns the underlying network connection
+func (t *TLSConn) NetConn() net.Conn {
+	return t.conn.NetConn()
+}
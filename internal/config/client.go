@@ -4,13 +4,43 @@ import (
 	"fmt"
 )
 
+// RouteConfig describes a split tunnelling route
+type RouteConfig struct {
+	Network string `mapstructure:"network"` // Destination network in CIDR notation
+	Type    string `mapstructure:"type"`    // How to route it (tun, internet, drop)
+}
+
+// RuleConfig describes a routing rule matching protocol and destination ports
+type RuleConfig struct {
+	Network  string   `mapstructure:"network"`  // Destination network in CIDR notation (empty = any)
+	Protocol string   `mapstructure:"protocol"` // Protocol to match (tcp, udp, icmp, empty = any)
+	Ports    []string `mapstructure:"ports"`    // Destination ports or ranges (e.g. 22, 8000-8100)
+	Type     string   `mapstructure:"type"`     // How to route it (tun, internet, drop)
+	Priority int      `mapstructure:"priority"` // Rules with lower priority are evaluated first
+}
+
+// DNSConfig describes how the client configures name resolution while connected
+type DNSConfig struct {
+	Servers      []string `mapstructure:"servers"`       // DNS servers reached through the tunnel
+	Search       []string `mapstructure:"search"`        // Search domains
+	SplitDomains []string `mapstructure:"split_domains"` // Only resolve these domains through the tunnel (empty = all)
+	Mode         string   `mapstructure:"mode"`          // How to apply settings (auto, resolved, resolv.conf)
+	BlockOutside bool     `mapstructure:"block_outside"` // Block DNS traffic that does not go through the tunnel
+}
+
 // ClientConfig holds all the configuration for the Tuno VPN client
 type ClientConfig struct {
 	// Network settings
-	ServerAddr string `mapstructure:"server_addr"` // Server address (host:port)
+	ServerAddr string `mapstructure:"server_addr"` // Server address (host:port, or transport://host:port)
+	Transport  string `mapstructure:"transport"`   // How to reach the server (tls, udp), overridden by a server_addr scheme
 	TunDevice  string `mapstructure:"tun_device"`  // TUN device name (e.g., tun0)
 	TunIP      string `mapstructure:"tun_ip"`      // TUN device IP with CIDR (e.g., 10.0.0.2/24)
+	TunIPv6    string `mapstructure:"tun_ipv6"`    // TUN device IPv6 address with prefix length, used with enable_ipv6
 	MTU        int    `mapstructure:"mtu"`         // Maximum Transmission Unit
+	AutoMTU    bool   `mapstructure:"auto_mtu"`    // Probe the path to the server and lower the MTU to fit
+	Fragment   bool   `mapstructure:"fragment"`    // Keep the configured MTU and fragment packets the path cannot carry
+	ClampMSS   bool   `mapstructure:"clamp_mss"`   // Clamp the MSS of tunnelled TCP SYN packets
+	MSS        int    `mapstructure:"mss"`         // MSS to clamp to (0 = derive from MTU)
 
 	// TLS settings
 	CACertFile string `mapstructure:"ca_cert_file"` // Path to CA certificate file for server verification
@@ -23,30 +53,65 @@ type ClientConfig struct {
 	Username string `mapstructure:"username"`  // Username for password authentication
 	Password string `mapstructure:"password"`  // Password for password authentication
 
+	// Identity settings
+	DeviceName string `mapstructure:"device_name"` // Name this device is registered under (default: hostname)
+
 	// Advanced settings
 	Reconnect      bool `mapstructure:"reconnect"`       // Automatically reconnect if connection is lost
 	ReconnectDelay int  `mapstructure:"reconnect_delay"` // Delay between reconnection attempts (seconds)
 	MaxRetries     int  `mapstructure:"max_retries"`     // Maximum number of reconnection attempts (0 = infinite)
+	ICMPRateLimit  int  `mapstructure:"icmp_rate_limit"` // Maximum ICMP error messages generated per second (0 = disabled)
+	EnableIPv6     bool `mapstructure:"enable_ipv6"`     // Carry IPv6 through the tunnel
+
+	// Split tunnelling settings
+	Routes          []RouteConfig `mapstructure:"routes"`           // Networks routed through the tunnel, directly or dropped
+	Rules           []RuleConfig  `mapstructure:"rules"`            // Protocol and port rules, evaluated before routes
+	TunnelDomains   []string      `mapstructure:"tunnel_domains"`   // Domains (or *.domain) whose addresses are routed through the tunnel
+	RedirectGateway bool          `mapstructure:"redirect_gateway"` // Send all traffic through the tunnel
+	AllowLAN        bool          `mapstructure:"allow_lan"`        // Keep local subnets reachable outside the tunnel
+	KillSwitch      bool          `mapstructure:"kill_switch"`      // Block all traffic outside the tunnel until the client is stopped
+	AppMode         string        `mapstructure:"app_mode"`         // Per-application routing (off, include, exclude)
+	AppCgroup       string        `mapstructure:"app_cgroup"`       // cgroup v2 group used by "tuno exec", relative to /sys/fs/cgroup
+	SiteNetworks    []string      `mapstructure:"site_networks"`    // Networks behind this client to route for the server (site-to-site)
+	LANInterface    string        `mapstructure:"lan_interface"`    // Interface an IPv6 prefix delegated by the server is assigned to
+
+	// DNS settings
+	DNS DNSConfig `mapstructure:"dns"` // Name resolution while connected
 
 	// Logging settings
 	LogLevel string `mapstructure:"log_level"` // Log level (debug, info, warn, error)
 	LogFile  string `mapstructure:"log_file"`  // Path to log file
+	StateDir string `mapstructure:"state_dir"` // Directory for state needed to recover from a crash
 }
 
 // LoadClientConfig loads the client configuration from a file
 func LoadClientConfig(cfgFile string) (*ClientConfig, error) {
 	// Default configuration
 	defaults := map[string]interface{}{
-		"server_addr":     "localhost:8080",
-		"tun_device":      "tun0",
-		"tun_ip":          "10.0.0.2/24",
-		"mtu":             1400,
-		"auth_mode":       "none",
-		"reconnect":       true,
-		"reconnect_delay": 5,
-		"max_retries":     0,
-		"log_level":       "info",
-		"skip_verify":     false,
+		"server_addr":      "localhost:8080",
+		"transport":        "tls",
+		"tun_device":       "tun0",
+		"tun_ip":           "10.0.0.2/24",
+		"mtu":              1400,
+		"auto_mtu":         true,
+		"fragment":         false,
+		"clamp_mss":        true,
+		"mss":              0,
+		"auth_mode":        "none",
+		"reconnect":        true,
+		"reconnect_delay":  5,
+		"max_retries":      0,
+		"icmp_rate_limit":  100,
+		"enable_ipv6":      false,
+		"redirect_gateway": false,
+		"allow_lan":        true,
+		"kill_switch":      false,
+		"app_mode":         "off",
+		"app_cgroup":       "tuno",
+		"dns.mode":         "auto",
+		"log_level":        "info",
+		"state_dir":        "~/.tuno",
+		"skip_verify":      false,
 	}
 
 	// Load configuration from file
@@ -61,6 +126,9 @@ func LoadClientConfig(cfgFile string) (*ClientConfig, error) {
 		return nil, fmt.Errorf("error parsing config: %v", err)
 	}
 
+	// A URL-style server address selects the transport
+	config.Transport, config.ServerAddr = SplitTransportAddr(config.Transport, config.ServerAddr)
+
 	// Expand file paths
 	if config.CACertFile, err = expandPath(config.CACertFile); err != nil {
 		return nil, fmt.Errorf("invalid CA cert file path: %v", err)
@@ -74,6 +142,9 @@ func LoadClientConfig(cfgFile string) (*ClientConfig, error) {
 	if config.LogFile, err = expandPath(config.LogFile); err != nil {
 		return nil, fmt.Errorf("invalid log file path: %v", err)
 	}
+	if config.StateDir, err = expandPath(config.StateDir); err != nil {
+		return nil, fmt.Errorf("invalid state directory path: %v", err)
+	}
 
 	// Validate configuration
 	if err := validateConfig(&config); err != nil {
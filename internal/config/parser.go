@@ -2,8 +2,11 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/spf13/viper"
 )
@@ -59,25 +62,196 @@ func validateConfig(config interface{}) error {
 		if cfg.ListenAddr == "" {
 			return errors.New("listen address cannot be empty")
 		}
+		if err := validateTransport(cfg.Transport); err != nil {
+			return err
+		}
 		if cfg.TunDevice == "" {
 			return errors.New("TUN device name cannot be empty")
 		}
 		if cfg.TunIP == "" {
 			return errors.New("TUN IP address cannot be empty")
 		}
+		if cfg.EnableIPv6 {
+			if err := validateIPv6Address(cfg.TunIPv6); err != nil {
+				return err
+			}
+		}
 		if cfg.CertFile == "" || cfg.KeyFile == "" {
 			return errors.New("TLS certificate and key files are required")
 		}
+		for _, record := range cfg.DNS.Records {
+			if record.Name == "" {
+				return errors.New("DNS record name cannot be empty")
+			}
+			switch strings.ToUpper(record.Type) {
+			case "A", "AAAA":
+				if net.ParseIP(record.Value) == nil {
+					return fmt.Errorf("invalid address %q for DNS record %s", record.Value, record.Name)
+				}
+			case "CNAME":
+				if record.Value == "" {
+					return fmt.Errorf("missing target for DNS record %s", record.Name)
+				}
+			default:
+				return fmt.Errorf("unsupported DNS record type %q for %s", record.Type, record.Name)
+			}
+		}
+		for _, upstream := range cfg.DNS.Upstreams {
+			if _, _, err := net.SplitHostPort(upstream); err != nil {
+				return fmt.Errorf("invalid DNS upstream %q: %v", upstream, err)
+			}
+		}
+		switch cfg.DNS.BlockResponse {
+		case "", "nxdomain", "zero":
+		default:
+			return fmt.Errorf("invalid DNS block response %q", cfg.DNS.BlockResponse)
+		}
+		switch cfg.ClientToClient {
+		case "", "allow", "deny", "group":
+		default:
+			return fmt.Errorf("invalid client_to_client policy %q", cfg.ClientToClient)
+		}
+		for _, group := range cfg.ClientGroups {
+			if group.Name == "" {
+				return errors.New("client group name cannot be empty")
+			}
+		}
+		for _, site := range cfg.Sites {
+			if site.Client == "" {
+				return errors.New("site client cannot be empty")
+			}
+			for _, network := range site.Networks {
+				if _, _, err := net.ParseCIDR(network); err != nil {
+					return fmt.Errorf("invalid network %q for site %s: %v", network, site.Client, err)
+				}
+			}
+		}
+		if pd := cfg.PrefixDelegation; pd.Pool != "" {
+			if !cfg.EnableIPv6 {
+				return errors.New("prefix delegation needs enable_ipv6")
+			}
+			ip, network, err := net.ParseCIDR(pd.Pool)
+			if err != nil || ip.To4() != nil {
+				return fmt.Errorf("invalid prefix delegation pool %q", pd.Pool)
+			}
+			if ones, _ := network.Mask.Size(); pd.PrefixLength <= ones || pd.PrefixLength > 128 {
+				return fmt.Errorf("delegated prefix length %d must be longer than the pool's /%d", pd.PrefixLength, ones)
+			}
+		}
+		for _, site := range cfg.Sites {
+			if site.DelegatePrefix && cfg.PrefixDelegation.Pool == "" {
+				return fmt.Errorf("site %s delegates a prefix, but prefix_delegation.pool is not set", site.Client)
+			}
+		}
+		for _, route := range cfg.Push.Routes {
+			if _, _, err := net.ParseCIDR(route); err != nil {
+				return fmt.Errorf("invalid pushed route %q: %v", route, err)
+			}
+		}
+		for _, server := range cfg.Push.DNS {
+			if net.ParseIP(server) == nil {
+				return fmt.Errorf("invalid pushed DNS server %q", server)
+			}
+		}
+		if cfg.Push.MTU != 0 && (cfg.Push.MTU < 576 || cfg.Push.MTU > cfg.MTU) {
+			return fmt.Errorf("pushed MTU %d must be between 576 and the server MTU", cfg.Push.MTU)
+		}
+		if cfg.NAT64.Enabled {
+			if !cfg.EnableIPv6 {
+				return errors.New("NAT64 needs enable_ipv6")
+			}
+			ip, network, err := net.ParseCIDR(cfg.NAT64.Prefix)
+			if err != nil || ip.To4() != nil {
+				return fmt.Errorf("invalid NAT64 prefix %q", cfg.NAT64.Prefix)
+			}
+			if ones, _ := network.Mask.Size(); ones != 96 {
+				return fmt.Errorf("NAT64 prefix %q must be a /96", cfg.NAT64.Prefix)
+			}
+			if cfg.NAT64.Address != "" {
+				if ip := net.ParseIP(cfg.NAT64.Address); ip == nil || ip.To4() == nil {
+					return fmt.Errorf("invalid NAT64 address %q", cfg.NAT64.Address)
+				}
+			}
+		}
+		if cfg.DNS.DNS64 && !cfg.NAT64.Enabled {
+			return errors.New("DNS64 needs NAT64 to be enabled")
+		}
+		if cfg.Push.Keepalive < 0 || cfg.Push.KeepaliveTimeout < 0 {
+			return errors.New("keepalive settings cannot be negative")
+		}
+		if cfg.Push.Keepalive > 0 && cfg.Push.KeepaliveTimeout <= cfg.Push.Keepalive {
+			return errors.New("keepalive timeout must be longer than the keepalive interval")
+		}
 	case *ClientConfig:
 		if cfg.ServerAddr == "" {
 			return errors.New("server address cannot be empty")
 		}
+		if err := validateTransport(cfg.Transport); err != nil {
+			return err
+		}
 		if cfg.TunDevice == "" {
 			return errors.New("TUN device name cannot be empty")
 		}
 		if cfg.TunIP == "" {
 			return errors.New("TUN IP address cannot be empty")
 		}
+		if cfg.TunIPv6 != "" {
+			if err := validateIPv6Address(cfg.TunIPv6); err != nil {
+				return err
+			}
+		}
+		for _, route := range cfg.Routes {
+			if _, _, err := net.ParseCIDR(route.Network); err != nil {
+				return fmt.Errorf("invalid route network %q: %v", route.Network, err)
+			}
+			switch route.Type {
+			case "tun", "vpn", "internet", "direct", "drop", "block":
+			default:
+				return fmt.Errorf("invalid route type %q for %s", route.Type, route.Network)
+			}
+		}
+		for _, network := range cfg.SiteNetworks {
+			if _, _, err := net.ParseCIDR(network); err != nil {
+				return fmt.Errorf("invalid site network %q: %v", network, err)
+			}
+		}
+		for i, rule := range cfg.Rules {
+			if rule.Network != "" {
+				if _, _, err := net.ParseCIDR(rule.Network); err != nil {
+					return fmt.Errorf("invalid network %q in rule %d: %v", rule.Network, i+1, err)
+				}
+			}
+			switch strings.ToLower(rule.Protocol) {
+			case "", "any", "tcp", "udp", "icmp":
+			default:
+				return fmt.Errorf("invalid protocol %q in rule %d", rule.Protocol, i+1)
+			}
+			switch rule.Type {
+			case "tun", "vpn", "internet", "direct", "drop", "block":
+			default:
+				return fmt.Errorf("invalid type %q in rule %d", rule.Type, i+1)
+			}
+		}
+		for _, server := range cfg.DNS.Servers {
+			if net.ParseIP(server) == nil {
+				return fmt.Errorf("invalid DNS server %q", server)
+			}
+		}
+		switch cfg.DNS.Mode {
+		case "", "auto", "resolved", "resolv.conf":
+		default:
+			return fmt.Errorf("invalid DNS mode %q", cfg.DNS.Mode)
+		}
+		switch cfg.AppMode {
+		case "", "off", "include", "exclude":
+		default:
+			return fmt.Errorf("invalid app mode %q", cfg.AppMode)
+		}
+		if cfg.AppMode == "include" || cfg.AppMode == "exclude" {
+			if strings.Trim(cfg.AppCgroup, "/") == "" || strings.Contains(cfg.AppCgroup, "..") {
+				return fmt.Errorf("invalid app cgroup %q", cfg.AppCgroup)
+			}
+		}
 	default:
 		return errors.New("unknown config type")
 	}
@@ -107,3 +281,35 @@ func expandPath(path string) (string, error) {
 
 	return absPath, nil
 }
+
+// SplitTransportAddr separates the transport from a URL-style address such as tls://host:port
+// Addresses without a scheme keep the configured transport.
+func SplitTransportAddr(transport, addr string) (string, string) {
+	scheme, hostport, ok := strings.Cut(addr, "://")
+	if !ok {
+		return strings.ToLower(transport), addr
+	}
+	return strings.ToLower(scheme), strings.TrimSuffix(hostport, "/")
+}
+
+// validateTransport checks the name of a transport
+func validateTransport(transport string) error {
+	switch transport {
+	case "", "tls", "udp":
+		return nil
+	default:
+		return fmt.Errorf("unsupported transport %q", transport)
+	}
+}
+
+// validateIPv6Address checks a TUN IPv6 address with prefix length
+func validateIPv6Address(cidr string) error {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid TUN IPv6 address %q: %v", cidr, err)
+	}
+	if ip.To4() != nil {
+		return fmt.Errorf("TUN IPv6 address %q is not an IPv6 address", cidr)
+	}
+	return nil
+}
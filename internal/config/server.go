@@ -4,13 +4,80 @@ import (
 	"fmt"
 )
 
+// DNSRecordConfig is a static record served by the built-in DNS server
+type DNSRecordConfig struct {
+	Name  string `mapstructure:"name"`  // Fully qualified name (e.g., git.corp.example)
+	Type  string `mapstructure:"type"`  // Record type (A, AAAA, CNAME)
+	Value string `mapstructure:"value"` // Address or target name
+	TTL   int    `mapstructure:"ttl"`   // Time to live in seconds (0 = default)
+}
+
+// DNSServerConfig configures the DNS server listening on the tunnel address
+type DNSServerConfig struct {
+	Enabled   bool              `mapstructure:"enabled"`    // Answer DNS queries on the tunnel address
+	Domain    string            `mapstructure:"domain"`     // Domain for client names (<common name>.<domain>, <device>.<domain>)
+	TTL       int               `mapstructure:"ttl"`        // Time to live for client and static records (seconds)
+	Records   []DNSRecordConfig `mapstructure:"records"`    // Static records
+	Upstreams []string          `mapstructure:"upstreams"`  // Resolvers other names are forwarded to (host:port)
+	CacheSize int               `mapstructure:"cache_size"` // Forwarded responses kept in the cache
+
+	// DNS64 settings
+	DNS64 bool `mapstructure:"dns64"` // Synthesise AAAA records in the NAT64 prefix for names with only A records
+
+	// Blocking settings
+	Blocklists    []string `mapstructure:"blocklists"`     // Hosts files or domain lists of blocked names
+	Allowlist     []string `mapstructure:"allowlist"`      // Names never blocked (name or *.domain)
+	BlockResponse string   `mapstructure:"block_response"` // Answer for blocked names (nxdomain, zero)
+}
+
+// SiteConfig authorises a client to route the networks behind it (site-to-site)
+type SiteConfig struct {
+	Client         string   `mapstructure:"client"`          // Certificate common name of the client
+	Networks       []string `mapstructure:"networks"`        // Networks the client may advertise (CIDR)
+	DelegatePrefix bool     `mapstructure:"delegate_prefix"` // Delegate the client an IPv6 prefix from prefix_delegation.pool
+}
+
+// ClientGroupConfig names a group of clients that may reach each other
+type ClientGroupConfig struct {
+	Name    string   `mapstructure:"name"`    // Group name
+	Members []string `mapstructure:"members"` // Certificate common names
+}
+
+// PushConfig holds the settings the server pushes to clients after they connect
+type PushConfig struct {
+	Routes           []string `mapstructure:"routes"`            // Networks clients route through the tunnel (CIDR)
+	DNS              []string `mapstructure:"dns"`               // DNS servers (empty = the built-in DNS server, if enabled)
+	Domains          []string `mapstructure:"domains"`           // DNS search domains (empty = the built-in DNS domain, if enabled)
+	MTU              int      `mapstructure:"mtu"`               // Largest tunnel MTU clients may use (0 = server MTU)
+	Keepalive        int      `mapstructure:"keepalive"`         // Seconds between keepalives on idle connections (0 = disabled)
+	KeepaliveTimeout int      `mapstructure:"keepalive_timeout"` // Seconds without any frame before a connection is dropped
+}
+
+// NAT64Config configures translation between IPv6-only clients and IPv4 destinations
+type NAT64Config struct {
+	Enabled bool   `mapstructure:"enabled"` // Translate packets for the NAT64 prefix into IPv4
+	Prefix  string `mapstructure:"prefix"`  // /96 prefix IPv4 addresses are embedded in
+	Address string `mapstructure:"address"` // IPv4 source address of translated packets (empty = last usable address of tun_ip)
+	Timeout int    `mapstructure:"timeout"` // Seconds an idle UDP or ICMP mapping is kept
+}
+
+// PrefixDelegationConfig configures the IPv6 prefixes delegated to site clients
+type PrefixDelegationConfig struct {
+	Pool         string `mapstructure:"pool"`          // IPv6 prefix delegated prefixes are carved from (e.g. a /56)
+	PrefixLength int    `mapstructure:"prefix_length"` // Length of each delegated prefix
+}
+
 // ServerConfig holds all the configuration for the Tuno VPN server
 type ServerConfig struct {
 	// Network settings
-	ListenAddr string `mapstructure:"listen_addr"` // Address to listen on (host:port)
+	ListenAddr string `mapstructure:"listen_addr"` // Address to listen on (host:port, or transport://host:port)
+	Transport  string `mapstructure:"transport"`   // Transport clients connect with (tls, udp), overridden by a listen_addr scheme
 	TunDevice  string `mapstructure:"tun_device"`  // TUN device name (e.g., tun0)
 	TunIP      string `mapstructure:"tun_ip"`      // TUN device IP with CIDR (e.g., 10.0.0.1/24)
+	TunIPv6    string `mapstructure:"tun_ipv6"`    // TUN device IPv6 address with prefix length, used with enable_ipv6
 	MTU        int    `mapstructure:"mtu"`         // Maximum Transmission Unit
+	ClampMSS   bool   `mapstructure:"clamp_mss"`   // Clamp the MSS of tunnelled TCP SYN packets
+	MSS        int    `mapstructure:"mss"`         // MSS to clamp to (0 = derive from MTU)
 
 	// TLS settings
 	CertFile string `mapstructure:"cert_file"` // Path to TLS certificate file
@@ -23,11 +90,37 @@ type ServerConfig struct {
 	// Logging settings
 	LogLevel string `mapstructure:"log_level"` // Log level (debug, info, warn, error)
 	LogFile  string `mapstructure:"log_file"`  // Path to log file
+	StateDir string `mapstructure:"state_dir"` // Directory for leases kept across restarts
 
 	// Advanced settings
-	EnableIPv6 bool `mapstructure:"enable_ipv6"` // Enable IPv6 support
+	EnableIPv6 bool `mapstructure:"enable_ipv6"` // Carry IPv6 and assign clients IPv6 addresses from tun_ipv6
 	EnableNAT  bool `mapstructure:"enable_nat"`  // Enable NAT for client traffic
 	MaxClients int  `mapstructure:"max_clients"` // Maximum number of clients
+	LeaseTime  int  `mapstructure:"lease_time"`  // Seconds a disconnected client's address stays reserved for it
+
+	// Client send queue settings
+	ClientQueueDepth  int    `mapstructure:"client_queue_depth"`  // Packets buffered per client before dropping
+	ClientQueuePolicy string `mapstructure:"client_queue_policy"` // Drop policy when a client queue is full (tail-drop, drop-oldest)
+
+	// ICMP settings
+	ICMPRateLimit int `mapstructure:"icmp_rate_limit"` // Maximum ICMP error messages generated per second (0 = disabled)
+
+	// DNS settings
+	DNS DNSServerConfig `mapstructure:"dns"` // Built-in DNS server
+
+	// NAT64 settings
+	NAT64 NAT64Config `mapstructure:"nat64"` // Gateway from IPv6-only clients to IPv4
+
+	// Settings pushed to clients
+	Push PushConfig `mapstructure:"push"`
+
+	// Site-to-site settings
+	Sites            []SiteConfig           `mapstructure:"sites"`             // Networks behind clients routed to them
+	PrefixDelegation PrefixDelegationConfig `mapstructure:"prefix_delegation"` // IPv6 prefixes delegated to site clients
+
+	// Client-to-client settings
+	ClientToClient string              `mapstructure:"client_to_client"` // Traffic between clients (allow, deny, group)
+	ClientGroups   []ClientGroupConfig `mapstructure:"client_groups"`    // Groups whose members may reach each other in group mode
 }
 
 // LoadServerConfig loads the server configuration from a file
@@ -35,14 +128,45 @@ func LoadServerConfig(cfgFile string) (*ServerConfig, error) {
 	// Default configuration
 	defaults := map[string]interface{}{
 		"listen_addr": "0.0.0.0:8080",
+		"transport":   "tls",
 		"tun_device":  "tun0",
 		"tun_ip":      "10.0.0.1/24",
+		"tun_ipv6":    "fd00:7475:6e6f::1/64",
 		"mtu":         1400,
+		"clamp_mss":   true,
+		"mss":         0,
 		"log_level":   "info",
 		"enable_ipv6": false,
 		"enable_nat":  true,
 		"max_clients": 10,
 		"auth_mode":   "none",
+		"lease_time":  86400,
+		"state_dir":   "~/.tuno",
+
+		"icmp_rate_limit": 100,
+
+		"client_queue_depth":  256,
+		"client_queue_policy": "tail-drop",
+
+		"client_to_client": "allow",
+
+		"push.keepalive":         25,
+		"push.keepalive_timeout": 120,
+
+		"dns.enabled":    false,
+		"dns.domain":     "vpn",
+		"dns.ttl":        60,
+		"dns.upstreams":  []string{"1.1.1.1:53", "8.8.8.8:53"},
+		"dns.cache_size": 4096,
+
+		"dns.block_response": "nxdomain",
+		"dns.dns64":          false,
+
+		"nat64.enabled": false,
+		"nat64.prefix":  "64:ff9b::/96",
+		"nat64.timeout": 300,
+
+		"prefix_delegation.prefix_length": 64,
 	}
 
 	// Load configuration from file
@@ -57,6 +181,9 @@ func LoadServerConfig(cfgFile string) (*ServerConfig, error) {
 		return nil, fmt.Errorf("error parsing config: %v", err)
 	}
 
+	// A URL-style listen address selects the transport
+	config.Transport, config.ListenAddr = SplitTransportAddr(config.Transport, config.ListenAddr)
+
 	// Expand file paths
 	if config.CertFile, err = expandPath(config.CertFile); err != nil {
 		return nil, fmt.Errorf("invalid cert file path: %v", err)
@@ -70,6 +197,14 @@ func LoadServerConfig(cfgFile string) (*ServerConfig, error) {
 	if config.LogFile, err = expandPath(config.LogFile); err != nil {
 		return nil, fmt.Errorf("invalid log file path: %v", err)
 	}
+	if config.StateDir, err = expandPath(config.StateDir); err != nil {
+		return nil, fmt.Errorf("invalid state directory path: %v", err)
+	}
+	for i, file := range config.DNS.Blocklists {
+		if config.DNS.Blocklists[i], err = expandPath(file); err != nil {
+			return nil, fmt.Errorf("invalid blocklist path: %v", err)
+		}
+	}
 
 	// Validate configuration
 	if err := validateConfig(&config); err != nil {
@@ -0,0 +1,175 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How often blocklist files are checked for changes
+const blocklistReloadInterval = 10 * time.Second
+
+// Names commonly found in hosts files that must never be blocked
+var hostsFileNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+}
+
+// Blocklist decides which names the resolver refuses to resolve
+// Lists are read from hosts files or plain domain lists, one name or *.domain
+// pattern per line, and reloaded when the files change. Allowlisted names are
+// never blocked.
+type Blocklist struct {
+	files    []string
+	allow    *DomainSet
+	blocked  atomic.Pointer[DomainSet]
+	modTimes map[string]time.Time
+	hits     map[string]uint64
+	hitMutex sync.Mutex
+	logger   *logrus.Logger
+}
+
+// NewBlocklist loads the blocklist files
+func NewBlocklist(files, allowlist []string, logger *logrus.Logger) (*Blocklist, error) {
+	allow := NewDomainSet()
+	for _, pattern := range allowlist {
+		allow.Add(pattern)
+	}
+
+	b := &Blocklist{
+		files:    files,
+		allow:    allow,
+		modTimes: make(map[string]time.Time),
+		hits:     make(map[string]uint64),
+		logger:   logger,
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Blocked reports whether a canonical name is blocked
+func (b *Blocklist) Blocked(name string) bool {
+	return b.blocked.Load().Match(name) && !b.allow.Match(name)
+}
+
+// RecordHit counts a blocked query from a client
+func (b *Blocklist) RecordHit(client net.IP) {
+	b.hitMutex.Lock()
+	b.hits[client.String()]++
+	b.hitMutex.Unlock()
+}
+
+// Hits returns the number of blocked queries per client address
+func (b *Blocklist) Hits() map[string]uint64 {
+	b.hitMutex.Lock()
+	defer b.hitMutex.Unlock()
+
+	hits := make(map[string]uint64, len(b.hits))
+	for client, count := range b.hits {
+		hits[client] = count
+	}
+	return hits
+}
+
+// Watch reloads the lists whenever one of the files changes, until stopCh is closed
+func (b *Blocklist) Watch(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(blocklistReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !b.changed() {
+				continue
+			}
+			if err := b.load(); err != nil {
+				// Keep serving the previous lists
+				b.logger.Errorf("Failed to reload blocklists: %v", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// changed reports whether any file was modified since it was loaded
+func (b *Blocklist) changed() bool {
+	for _, file := range b.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(b.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads all files into a new set and swaps it in
+func (b *Blocklist) load() error {
+	blocked := NewDomainSet()
+	for _, file := range b.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read blocklist %s: %v", file, err)
+		}
+		if err := loadDomainFile(file, blocked); err != nil {
+			return err
+		}
+		b.modTimes[file] = info.ModTime()
+	}
+
+	b.blocked.Store(blocked)
+	b.logger.Infof("Loaded %d blocked domains from %d lists", blocked.Len(), len(b.files))
+	return nil
+}
+
+// loadDomainFile adds the names in a hosts file or domain list to set
+func loadDomainFile(path string, set *DomainSet) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open blocklist %s: %v", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Hosts file lines start with an address followed by names
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			if hostsFileNames[CanonicalName(name)] {
+				continue
+			}
+			set.Add(name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read blocklist %s: %v", path, err)
+	}
+	return nil
+}
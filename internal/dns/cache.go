@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Bounds on how long a forwarded response is cached
+const (
+	minCacheTTL = 5 * time.Second
+	maxCacheTTL = time.Hour
+)
+
+// cacheEntry is a cached upstream response
+type cacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// Cache holds upstream responses until their records expire
+type Cache struct {
+	entries map[string]*cacheEntry
+	size    int
+	mutex   sync.Mutex
+}
+
+// NewCache creates a cache holding up to size responses (0 disables caching)
+func NewCache(size int) *Cache {
+	return &Cache{
+		entries: make(map[string]*cacheEntry),
+		size:    size,
+	}
+}
+
+// Get returns a cached response for the question with the given message ID
+// Record TTLs are reduced by the time the response spent in the cache.
+func (c *Cache) Get(question dnsmessage.Question, id uint16) ([]byte, bool) {
+	if c.size <= 0 {
+		return nil, false
+	}
+
+	key := cacheKey(question)
+	now := time.Now()
+
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	if ok && now.After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	// Work on a copy, the cached message is shared
+	msg := entry.msg
+	msg.Header.ID = id
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	msg.Answers = ageResources(msg.Answers, elapsed)
+	msg.Authorities = ageResources(msg.Authorities, elapsed)
+	msg.Additionals = ageResources(msg.Additionals, elapsed)
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return packed, true
+}
+
+// Put caches an upstream response
+// Only successful and NXDOMAIN responses are cached, for the lowest TTL they carry.
+func (c *Cache) Put(question dnsmessage.Question, response []byte) {
+	if c.size <= 0 {
+		return
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return
+	}
+	if msg.Truncated || (msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+
+	// Responses without records carry no TTL to go by
+	ttl := maxCacheTTL
+	records := 0
+	for _, resources := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for _, r := range resources {
+			if d := time.Duration(r.Header.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+			records++
+		}
+	}
+	if records == 0 || ttl < minCacheTTL {
+		return
+	}
+
+	now := time.Now()
+	key := cacheKey(question)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = &cacheEntry{msg: msg, stored: now, expires: now.Add(ttl)}
+}
+
+// Len returns the number of cached responses
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// evict removes expired entries, or the entry closest to expiry if none have expired
+func (c *Cache) evict(now time.Time) {
+	var oldestKey string
+	var oldest *cacheEntry
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == nil || entry.expires.Before(oldest.expires) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if len(c.entries) >= c.size && oldest != nil {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// ageResources returns a copy of resources with their TTLs reduced by elapsed seconds
+func ageResources(resources []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(resources) == 0 {
+		return resources
+	}
+	aged := make([]dnsmessage.Resource, len(resources))
+	copy(aged, resources)
+	for i := range aged {
+		// The OPT pseudo-record uses the TTL field for flags
+		if aged[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if aged[i].Header.TTL > elapsed {
+			aged[i].Header.TTL -= elapsed
+		} else {
+			aged[i].Header.TTL = 0
+		}
+	}
+	return aged
+}
+
+// cacheKey identifies a question in the cache
+func cacheKey(question dnsmessage.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(question.Name.String()), question.Type, question.Class)
+}
@@ -0,0 +1,122 @@
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// SetDNS64 enables synthesis of AAAA records in prefix for names that only have A records
+// prefix must be a /96, the IPv4 address fills its last 32 bits (RFC 6052).
+func (s *Server) SetDNS64(prefix netip.Prefix) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dns64 = prefix
+}
+
+// dns64Prefix returns the DNS64 prefix, which is invalid if synthesis is disabled
+func (s *Server) dns64Prefix() netip.Prefix {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dns64
+}
+
+// synthesize answers an AAAA query from the A records of the name if the
+// upstream response has no AAAA records (RFC 6147)
+// Returns the upstream response unchanged if there is nothing to synthesise.
+func (s *Server) synthesize(response []byte, header dnsmessage.Header, question dnsmessage.Question) []byte {
+	prefix := s.dns64Prefix()
+	if !prefix.IsValid() || question.Type != dnsmessage.TypeAAAA || !needsSynthesis(response) {
+		return response
+	}
+
+	// Ask for the IPv4 addresses of the same name
+	query, err := buildQuery(header, question.Name, dnsmessage.TypeA)
+	if err != nil {
+		return response
+	}
+	aQuestion := question
+	aQuestion.Type = dnsmessage.TypeA
+	aResponse, err := s.forwarder.Forward(query, header, aQuestion)
+	if err != nil {
+		return response
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(aResponse); err != nil || msg.RCode != dnsmessage.RCodeSuccess {
+		return response
+	}
+
+	// Keep the CNAME chain and map every A record into the prefix
+	var answers []dnsmessage.Resource
+	synthesized := 0
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.CNAMEResource:
+			answers = append(answers, answer)
+		case *dnsmessage.AResource:
+			addr := prefix.Addr().As16()
+			copy(addr[12:], body.A[:])
+			answer.Header.Type = dnsmessage.TypeAAAA
+			answer.Header.Length = 0
+			answer.Body = &dnsmessage.AAAAResource{AAAA: addr}
+			answers = append(answers, answer)
+			synthesized++
+		}
+	}
+	if synthesized == 0 {
+		return response
+	}
+
+	msg.Header.ID = header.ID
+	msg.Questions = []dnsmessage.Question{question}
+	msg.Answers = answers
+	msg.Authorities = nil
+	msg.Additionals = nil
+	packed, err := msg.Pack()
+	if err != nil {
+		s.logger.Debugf("Failed to build DNS64 answer for %s: %v", question.Name, err)
+		return response
+	}
+	return packed
+}
+
+// needsSynthesis reports whether a successful AAAA response carries no AAAA records
+func needsSynthesis(response []byte) bool {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil || header.RCode != dnsmessage.RCodeSuccess {
+		return false
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return false
+	}
+	for {
+		rh, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		if rh.Type == dnsmessage.TypeAAAA {
+			return false
+		}
+		if err := parser.SkipAnswer(); err != nil {
+			return false
+		}
+	}
+}
+
+// buildQuery builds a recursive query for name with the ID of header
+func buildQuery(header dnsmessage.Header, name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, fmt.Errorf("failed to build query: %v", err)
+	}
+	return b.Finish()
+}
@@ -0,0 +1,48 @@
+package dns
+
+import (
+	"strings"
+)
+
+// DomainSet matches names exactly or, for *.domain patterns, any subdomain
+type DomainSet struct {
+	exact    map[string]struct{}
+	wildcard map[string]struct{}
+}
+
+// NewDomainSet creates an empty domain set
+func NewDomainSet() *DomainSet {
+	return &DomainSet{
+		exact:    make(map[string]struct{}),
+		wildcard: make(map[string]struct{}),
+	}
+}
+
+// Add adds a name or *.domain pattern
+func (d *DomainSet) Add(pattern string) {
+	if strings.HasPrefix(pattern, "*.") {
+		d.wildcard[CanonicalName(pattern[2:])] = struct{}{}
+		return
+	}
+	d.exact[CanonicalName(pattern)] = struct{}{}
+}
+
+// Match reports whether a canonical name is in the set
+func (d *DomainSet) Match(name string) bool {
+	if _, ok := d.exact[name]; ok {
+		return true
+	}
+	// Walk up the parent domains looking for a wildcard
+	for i := strings.IndexByte(name, '.'); i >= 0 && i < len(name)-1; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if _, ok := d.wildcard[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of patterns in the set
+func (d *DomainSet) Len() int {
+	return len(d.exact) + len(d.wildcard)
+}
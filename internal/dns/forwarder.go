@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// How long to wait for an upstream resolver
+	upstreamTimeout = 2 * time.Second
+	// Largest response accepted over UDP
+	maxUDPResponse = 4096
+)
+
+// Forwarder sends queries to upstream resolvers and caches their responses
+type Forwarder struct {
+	upstreams []string
+	cache     *Cache
+}
+
+// NewForwarder creates a forwarder for the given upstream resolvers
+func NewForwarder(upstreams []string, cacheSize int) *Forwarder {
+	return &Forwarder{
+		upstreams: upstreams,
+		cache:     NewCache(cacheSize),
+	}
+}
+
+// Forward answers a query from the cache or the first upstream that responds
+func (f *Forwarder) Forward(query []byte, header dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	if response, ok := f.cache.Get(question, header.ID); ok {
+		return response, nil
+	}
+
+	if len(f.upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream resolvers configured")
+	}
+
+	var lastErr error
+	for _, upstream := range f.upstreams {
+		response, err := exchange(upstream, query, header.ID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		f.cache.Put(question, response)
+		return response, nil
+	}
+	return nil, lastErr
+}
+
+// exchange sends a query to one resolver over UDP, retrying over TCP if the response was truncated
+func exchange(upstream string, query []byte, id uint16) ([]byte, error) {
+	response, err := exchangeUDP(upstream, query, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %v", upstream, err)
+	}
+	if header.Truncated {
+		return exchangeTCP(upstream, query, id)
+	}
+	return response, nil
+}
+
+// exchangeUDP sends a query over a fresh UDP socket
+func exchangeUDP(upstream string, query []byte, id uint16) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, upstreamTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %v", upstream, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("failed to send query to %s: %v", upstream, err)
+	}
+
+	// Ignore stray datagrams that do not answer this query
+	buffer := make([]byte, maxUDPResponse)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("no response from %s: %v", upstream, err)
+		}
+		if n >= 2 && binary.BigEndian.Uint16(buffer[:2]) == id {
+			return append([]byte(nil), buffer[:n]...), nil
+		}
+	}
+}
+
+// exchangeTCP sends a query over TCP
+func exchangeTCP(upstream string, query []byte, id uint16) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", upstream, upstreamTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %v", upstream, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, fmt.Errorf("failed to send query to %s: %v", upstream, err)
+	}
+	response, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("no response from %s: %v", upstream, err)
+	}
+	if len(response) < 2 || binary.BigEndian.Uint16(response[:2]) != id {
+		return nil, fmt.Errorf("mismatched response from %s", upstream)
+	}
+	return response, nil
+}
+
+// readTCPMessage reads a length-prefixed DNS message
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes a length-prefixed DNS message in a single write
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
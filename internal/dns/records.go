@@ -0,0 +1,181 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// record is a single locally served resource record
+type record struct {
+	Type   dnsmessage.Type
+	IP     net.IP
+	Target string
+	TTL    uint32
+}
+
+// Records holds the static records served by the DNS server
+type Records struct {
+	names map[string][]record
+}
+
+// NewRecords builds the static record set from the configuration
+func NewRecords(cfg []config.DNSRecordConfig, defaultTTL int) (*Records, error) {
+	r := &Records{names: make(map[string][]record)}
+
+	for _, rc := range cfg {
+		ttl := rc.TTL
+		if ttl <= 0 {
+			ttl = defaultTTL
+		}
+
+		rec := record{TTL: uint32(ttl)}
+		switch strings.ToUpper(rc.Type) {
+		case "A":
+			rec.Type = dnsmessage.TypeA
+			rec.IP = net.ParseIP(rc.Value).To4()
+			if rec.IP == nil {
+				return nil, fmt.Errorf("record %s: %q is not an IPv4 address", rc.Name, rc.Value)
+			}
+		case "AAAA":
+			rec.Type = dnsmessage.TypeAAAA
+			rec.IP = net.ParseIP(rc.Value)
+			if rec.IP == nil || rec.IP.To4() != nil {
+				return nil, fmt.Errorf("record %s: %q is not an IPv6 address", rc.Name, rc.Value)
+			}
+		case "CNAME":
+			rec.Type = dnsmessage.TypeCNAME
+			rec.Target = CanonicalName(rc.Value)
+		default:
+			return nil, fmt.Errorf("record %s: unsupported type %q", rc.Name, rc.Type)
+		}
+
+		name := CanonicalName(rc.Name)
+		r.names[name] = append(r.names[name], rec)
+	}
+
+	return r, nil
+}
+
+// Lookup returns the records for a canonical name
+func (r *Records) Lookup(name string) []record {
+	return r.names[name]
+}
+
+// CanonicalName lowercases a name and makes it fully qualified
+func CanonicalName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// addressRecords turns addresses into records with the given TTL
+func addressRecords(ips []net.IP, ttl uint32) []record {
+	records := make([]record, 0, len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, record{Type: dnsmessage.TypeA, IP: ip4, TTL: ttl})
+		} else {
+			records = append(records, record{Type: dnsmessage.TypeAAAA, IP: ip, TTL: ttl})
+		}
+	}
+	return records
+}
+
+// buildAnswer builds an authoritative response from local records
+// Records that do not match the question type are left out, which yields an
+// empty answer for names that exist with other types. A CNAME answers any type.
+func buildAnswer(header dnsmessage.Header, question dnsmessage.Question, records []record, rcode dnsmessage.RCode) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	for _, rec := range records {
+		if rec.Type != question.Type && rec.Type != dnsmessage.TypeCNAME && question.Type != dnsmessage.TypeALL {
+			continue
+		}
+
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: rec.TTL}
+		var err error
+		switch rec.Type {
+		case dnsmessage.TypeA:
+			var a dnsmessage.AResource
+			copy(a.A[:], rec.IP.To4())
+			err = b.AResource(rh, a)
+		case dnsmessage.TypeAAAA:
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], rec.IP.To16())
+			err = b.AAAAResource(rh, aaaa)
+		case dnsmessage.TypeCNAME:
+			target, perr := dnsmessage.NewName(rec.Target)
+			if perr != nil {
+				return nil, perr
+			}
+			err = b.CNAMEResource(rh, dnsmessage.CNAMEResource{CNAME: target})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+// buildError builds an empty response with the given response code
+func buildError(header dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	if question != nil {
+		b.StartQuestions()
+		b.Question(*question)
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+// Label turns a user or device name into a valid DNS label
+// Letters are lowercased and characters other than letters, digits and
+// hyphens become hyphens.
+func Label(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+
+	label := strings.Trim(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	return label
+}
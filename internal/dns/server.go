@@ -0,0 +1,349 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Largest UDP response to a query without EDNS
+	defaultUDPSize = 512
+	// Largest DNS message
+	maxMessageSize = 65535
+)
+
+// Registry resolves the names of connected clients
+type Registry interface {
+	// LookupName returns the tunnel addresses of the clients registered under a name
+	LookupName(name string) []net.IP
+}
+
+// Server answers DNS queries for VPN clients
+// Names under the configured domain resolve to connected clients, static
+// records come from the configuration and everything else is forwarded.
+type Server struct {
+	domain      string
+	ttl         uint32
+	registry    Registry
+	records     *Records
+	forwarder   *Forwarder
+	blocklist   *Blocklist
+	blockZero   bool
+	dns64       netip.Prefix
+	stopCh      chan struct{}
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	isRunning   bool
+	mutex       sync.Mutex
+	logger      *logrus.Logger
+}
+
+// NewServer creates a DNS server resolving client names through registry
+func NewServer(cfg config.DNSServerConfig, registry Registry, logger *logrus.Logger) (*Server, error) {
+	records, err := NewRecords(cfg.Records, cfg.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		domain:    CanonicalName(cfg.Domain),
+		ttl:       uint32(cfg.TTL),
+		registry:  registry,
+		records:   records,
+		forwarder: NewForwarder(cfg.Upstreams, cfg.CacheSize),
+		blockZero: cfg.BlockResponse == "zero",
+		logger:    logger,
+	}
+
+	if len(cfg.Blocklists) > 0 {
+		if s.blocklist, err = NewBlocklist(cfg.Blocklists, cfg.Allowlist, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Start listens for queries over UDP and TCP on addr
+func (s *Server) Start(addr string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.isRunning {
+		return fmt.Errorf("DNS server is already running")
+	}
+
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %v", addr, err)
+	}
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %v", addr, err)
+	}
+
+	s.udpConn = udpConn
+	s.tcpListener = tcpListener
+	s.stopCh = make(chan struct{})
+	s.isRunning = true
+
+	go s.serveUDP()
+	go s.serveTCP()
+	if s.blocklist != nil {
+		go s.blocklist.Watch(s.stopCh)
+	}
+
+	s.logger.Infof("DNS server listening on %s for *.%s", addr, strings.TrimSuffix(s.domain, "."))
+	return nil
+}
+
+// Stop closes the listeners
+func (s *Server) Stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.isRunning {
+		return nil
+	}
+
+	s.isRunning = false
+	close(s.stopCh)
+	s.udpConn.Close()
+	s.tcpListener.Close()
+
+	s.logger.Info("DNS server stopped")
+	return nil
+}
+
+// serveUDP answers queries received over UDP
+func (s *Server) serveUDP() {
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buffer)
+		if err != nil {
+			if s.running() {
+				s.logger.Errorf("DNS read error: %v", err)
+				continue
+			}
+			return
+		}
+
+		query := append([]byte(nil), buffer[:n]...)
+		go func() {
+			response := s.handle(query, addrIP(addr))
+			if response == nil {
+				return
+			}
+			if limit := udpLimit(query); len(response) > limit {
+				response = truncate(response)
+			}
+			if _, err := s.udpConn.WriteTo(response, addr); err != nil {
+				s.logger.Debugf("Failed to send DNS response to %s: %v", addr, err)
+			}
+		}()
+	}
+}
+
+// serveTCP accepts DNS connections
+func (s *Server) serveTCP() {
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			if s.running() {
+				s.logger.Errorf("DNS accept error: %v", err)
+				continue
+			}
+			return
+		}
+		go s.handleTCPConn(conn)
+	}
+}
+
+// handleTCPConn answers queries on a TCP connection until it is closed
+func (s *Server) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	source := addrIP(conn.RemoteAddr())
+	for {
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		response := s.handle(query, source)
+		if response == nil {
+			return
+		}
+		if err := writeTCPMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a single query
+// Returns nil if the message should be ignored.
+func (s *Server) handle(query []byte, source net.IP) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+
+	question, err := parser.Question()
+	if err != nil {
+		return buildError(header, nil, dnsmessage.RCodeFormatError)
+	}
+	if header.OpCode != 0 {
+		return buildError(header, &question, dnsmessage.RCodeNotImplemented)
+	}
+
+	// Names we are authoritative for
+	name := CanonicalName(question.Name.String())
+	if records, rcode, ok := s.lookupLocal(name); ok {
+		response, err := buildAnswer(header, question, records, rcode)
+		if err != nil {
+			s.logger.Debugf("Failed to build DNS answer for %s: %v", name, err)
+			return buildError(header, &question, dnsmessage.RCodeServerFailure)
+		}
+		return response
+	}
+
+	// Refuse blocked names
+	if s.blocklist != nil && s.blocklist.Blocked(name) {
+		s.blocklist.RecordHit(source)
+		s.logger.Debugf("Blocked DNS query for %s from %s", name, source)
+		return s.blockedAnswer(header, question)
+	}
+
+	// Everything else goes upstream
+	response, err := s.forwarder.Forward(query, header, question)
+	if err != nil {
+		s.logger.Debugf("Failed to forward DNS query for %s from %s: %v", name, source, err)
+		return buildError(header, &question, dnsmessage.RCodeServerFailure)
+	}
+	return s.synthesize(response, header, question)
+}
+
+// lookupLocal resolves static records and client names
+// Returns false if the name should be forwarded.
+func (s *Server) lookupLocal(name string) ([]record, dnsmessage.RCode, bool) {
+	if records := s.records.Lookup(name); len(records) > 0 {
+		return records, dnsmessage.RCodeSuccess, true
+	}
+
+	// The domain itself exists, but has no addresses
+	if name == s.domain {
+		return nil, dnsmessage.RCodeSuccess, true
+	}
+	if !strings.HasSuffix(name, "."+s.domain) {
+		return nil, 0, false
+	}
+
+	label := strings.TrimSuffix(name, "."+s.domain)
+	if strings.Contains(label, ".") || s.registry == nil {
+		return nil, dnsmessage.RCodeNameError, true
+	}
+
+	ips := s.registry.LookupName(label)
+	if len(ips) == 0 {
+		return nil, dnsmessage.RCodeNameError, true
+	}
+	return addressRecords(ips, s.ttl), dnsmessage.RCodeSuccess, true
+}
+
+// blockedAnswer answers a query for a blocked name with NXDOMAIN or the unspecified address
+func (s *Server) blockedAnswer(header dnsmessage.Header, question dnsmessage.Question) []byte {
+	var response []byte
+	var err error
+	if s.blockZero {
+		records := addressRecords([]net.IP{net.IPv4zero, net.IPv6zero}, s.ttl)
+		response, err = buildAnswer(header, question, records, dnsmessage.RCodeSuccess)
+	} else {
+		response, err = buildAnswer(header, question, nil, dnsmessage.RCodeNameError)
+	}
+	if err != nil {
+		return buildError(header, &question, dnsmessage.RCodeServerFailure)
+	}
+	return response
+}
+
+// BlockHits returns the number of blocked queries per client address
+func (s *Server) BlockHits() map[string]uint64 {
+	if s.blocklist == nil {
+		return nil
+	}
+	return s.blocklist.Hits()
+}
+
+// running reports whether the server has not been stopped
+func (s *Server) running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.isRunning
+}
+
+// udpLimit returns the largest UDP response the sender of query accepts
+func udpLimit(query []byte) int {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return defaultUDPSize
+	}
+	if parser.SkipAllQuestions() != nil || parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return defaultUDPSize
+	}
+
+	for {
+		rh, err := parser.AdditionalHeader()
+		if err != nil {
+			return defaultUDPSize
+		}
+		if rh.Type == dnsmessage.TypeOPT {
+			// The OPT record carries the UDP payload size in its class field
+			if size := int(rh.Class); size > defaultUDPSize {
+				return size
+			}
+			return defaultUDPSize
+		}
+		if err := parser.SkipAdditional(); err != nil {
+			return defaultUDPSize
+		}
+	}
+}
+
+// truncate reduces a response to its header and question with the TC bit set,
+// telling the client to retry over TCP
+func truncate(response []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil
+	}
+	header.Truncated = true
+
+	b := dnsmessage.NewBuilder(nil, header)
+	if question, err := parser.Question(); err == nil {
+		b.StartQuestions()
+		b.Question(question)
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+// addrIP returns the IP of a UDP or TCP address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
@@ -1,21 +1,43 @@
 package tunnel
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/cipher"
 	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
 	"github.com/sirupsen/logrus"
 )
 
+// How long the TUN reader waits for a packet before checking whether its connection is gone
+const tunReadTimeout = 500 * time.Millisecond
+
 // Client represents a Tuno VPN client
 type Client struct {
 	config     *config.ClientConfig
-	conn       *cipher.TLSConn
+	transport  Transport
+	conn       TransportConn
+	frames     *FrameConn
 	tunDevice  *TUNDevice
+	router     *Router
+	routes     *KernelRoutes
+	manager    *RouteManager
+	control    *ControlServer
+	domains    *DomainRouter
+	killSwitch *KillSwitch
+	dns        *DNSManager
+	dnsConfig  config.DNSConfig
+	serverIPs  []net.IP
+	mssClamper *MSSClamper
+	icmp       *ICMPGenerator
+	settings   *ClientSettings
+	keepalive  *FrameConn
 	isRunning  bool
 	stopCh     chan struct{}
 	reconnect  bool
@@ -29,15 +51,61 @@ type Client struct {
 
 // NewClient creates a new Tuno VPN client
 func NewClient(cfg *config.ClientConfig, logger *logrus.Logger) (*Client, error) {
-	return &Client{
+	// Build the split tunnelling table and mirror it into the kernel
+	router, err := NewRouterFromConfig(cfg.Routes, cfg.Rules, logger)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routes: %v", err)
+	}
+	routes := NewKernelRoutes(cfg.TunDevice, logger)
+	router.SetChangeHandler(routes.HandleChange)
+
+	// Domain routes are learned from DNS responses, which therefore have to come through the tunnel
+	// The configuration belongs to the caller, so the client extends its own copy
+	dnsConfig := cfg.DNS
+	if len(cfg.TunnelDomains) > 0 {
+		for _, server := range cfg.DNS.Servers {
+			if err := router.AddRoute(hostIPNet(net.ParseIP(server)).String(), RouteTypeTUN); err != nil {
+				return nil, fmt.Errorf("invalid DNS server: %v", err)
+			}
+		}
+		if len(cfg.DNS.SplitDomains) > 0 {
+			splitDomains := append([]string{}, cfg.DNS.SplitDomains...)
+			dnsConfig.SplitDomains = append(splitDomains, tunnelDNSDomains(cfg.TunnelDomains)...)
+		}
+	}
+
+	// Routes changed at runtime survive restarts
+	manager := NewRouteManager(router, cfg.StateDir, logger)
+	if err := manager.Load(); err != nil {
+		return nil, err
+	}
+
+	transport, err := NewClientTransport(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
 		config:     cfg,
+		transport:  transport,
+		router:     router,
+		routes:     routes,
+		manager:    manager,
+		domains:    NewDomainRouter(cfg.TunnelDomains, router, logger),
+		killSwitch: NewKillSwitch(cfg.KillSwitch, cfg.TunDevice, cfg.AllowLAN, logger),
+		dns:        NewDNSManager(dnsConfig, cfg.TunDevice, cfg.StateDir, logger),
+		dnsConfig:  dnsConfig,
 		stopCh:     make(chan struct{}),
 		logger:     logger,
+		mssClamper: NewMSSClamper(cfg.ClampMSS, cfg.MSS),
+		icmp:       NewICMPGenerator(cfg.ICMPRateLimit),
 		isRunning:  false,
 		reconnect:  cfg.Reconnect,
 		retries:    0,
 		lastActive: time.Now(),
-	}, nil
+	}
+	c.control = NewControlServer(ControlSocketPath(cfg.StateDir), c.handleControl, logger)
+	return c, nil
 }
 
 // Connect connects to the VPN server
@@ -52,27 +120,95 @@ func (c *Client) Connect() error {
 
 	var err error
 
+	// Clean up after a previous client that did not shut down cleanly
+	flushStaleRoutes(c.config.TunDevice, []int{tunnelRouteTable, bypassRouteTable}, true, c.logger)
+	teardownPolicyRouting(c.config.StateDir, c.logger)
+	restoreForwarding(c.config.StateDir, c.logger)
+	RecoverDNS(c.config.StateDir, c.logger)
+
+	// Block traffic outside the tunnel before anything can leak
+	if c.killSwitch != nil {
+		if err := c.enableKillSwitch(); err != nil {
+			c.abortConnect()
+			return err
+		}
+	}
+
 	// Create TUN device
 	c.tunDevice, err = NewTUNDevice(c.config, c.logger)
 	if err != nil {
-		c.isRunning = false
+		c.abortConnect()
 		return fmt.Errorf("failed to create TUN device: %v", err)
 	}
 
 	// Start the TUN device
 	if err := c.tunDevice.Start(); err != nil {
-		c.isRunning = false
+		c.abortConnect()
 		return fmt.Errorf("failed to start TUN device: %v", err)
 	}
 
+	// Forward traffic between the tunnel and the networks behind this client
+	if len(c.config.SiteNetworks) > 0 {
+		if err := setForwarding(c.config.StateDir, siteHasIPv6(c.config.SiteNetworks)); err != nil {
+			c.abortConnect()
+			return err
+		}
+	}
+
+	// Install split tunnelling routes for the TUN device
+	if err := c.routes.Install(c.router.GetRoutes()); err != nil {
+		c.abortConnect()
+		return fmt.Errorf("failed to install routes: %v", err)
+	}
+
+	// Send everything else through the tunnel too, keeping the server reachable
+	if c.config.RedirectGateway {
+		ips, err := c.resolveServer()
+		if err == nil {
+			err = c.pinServer(ips)
+		}
+		if err == nil {
+			err = c.routes.RedirectGateway(c.config.AllowLAN, c.config.EnableIPv6)
+		}
+		if err != nil {
+			c.abortConnect()
+			return fmt.Errorf("failed to redirect gateway: %v", err)
+		}
+	}
+
+	// Enforce protocol and port rules and per-application routing in the kernel
+	if c.appRouting() || len(c.router.GetRules()) > 0 {
+		if err := c.configurePolicyRouting(); err != nil {
+			c.abortConnect()
+			return fmt.Errorf("failed to configure policy routing: %v", err)
+		}
+	}
+
+	// Resolve names through the tunnel
+	if err := c.dns.Apply(); err != nil {
+		c.abortConnect()
+		return fmt.Errorf("failed to apply DNS settings: %v", err)
+	}
+	c.domains.Start()
+
+	// Accept route changes from "tuno route"
+	if err := c.control.Start(); err != nil {
+		c.logger.Warnf("Runtime route management is unavailable: %v", err)
+	}
+
 	// Connect to server and run the main client loop
 	go c.runMainLoop()
 
-	// Wait for stop signal or reconnect
+	// Wait until the client is stopped or gives up reconnecting
 	<-c.stopCh
 	return nil
 }
 
+// Start connects to the VPN server, so the client can be run as a Tunneler
+func (c *Client) Start() error {
+	return c.Connect()
+}
+
 // Stop stops the VPN client
 func (c *Client) Stop() error {
 	c.mutex.Lock()
@@ -82,6 +218,15 @@ func (c *Client) Stop() error {
 		return nil
 	}
 
+	c.shutdown()
+
+	c.logger.Info("Tuno VPN client stopped")
+	return nil
+}
+
+// shutdown stops the client and undoes its system changes, the caller holds c.mutex
+// It runs on Stop and when the main loop gives up on the server.
+func (c *Client) shutdown() {
 	c.isRunning = false
 	close(c.stopCh)
 
@@ -89,17 +234,105 @@ func (c *Client) Stop() error {
 	if c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
+		c.frames = nil
+	}
+
+	// Restore DNS settings and remove kernel routes
+	c.control.Stop()
+	c.domains.Stop()
+	if err := c.dns.Restore(); err != nil {
+		c.logger.Errorf("Failed to restore DNS settings: %v", err)
+	}
+	c.routes.Flush()
+	teardownPolicyRouting(c.config.StateDir, c.logger)
+	restoreForwarding(c.config.StateDir, c.logger)
+	if c.appRouting() {
+		removeAppCgroup(c.config.AppCgroup)
+	}
+
+	// The delegated prefix is only routed here while connected
+	if c.settings != nil && c.settings.DelegatedPrefix != "" && c.config.LANInterface != "" {
+		if err := removeDelegatedPrefix(c.config.LANInterface, c.settings.DelegatedPrefix); err != nil {
+			c.logger.Warnf("Failed to remove delegated prefix: %v", err)
+		}
+	}
+
+	// Lift the kill switch, this is the only place it is removed
+	if err := c.killSwitch.Disable(); err != nil {
+		c.logger.Errorf("Failed to disable kill switch: %v", err)
 	}
 
 	// Stop TUN device
 	if c.tunDevice != nil {
 		c.tunDevice.Stop()
 	}
+}
 
+// giveUp shuts the client down after the main loop stopped reconnecting
+func (c *Client) giveUp() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Stop may have shut the client down already
+	if !c.isRunning {
+		return
+	}
+	c.shutdown()
 	c.logger.Info("Tuno VPN client stopped")
+}
+
+// abortConnect undoes the system changes made by a failed Connect
+func (c *Client) abortConnect() {
+	if err := c.dns.Restore(); err != nil {
+		c.logger.Errorf("Failed to restore DNS settings: %v", err)
+	}
+	c.routes.Flush()
+	teardownPolicyRouting(c.config.StateDir, c.logger)
+	restoreForwarding(c.config.StateDir, c.logger)
+	if c.tunDevice != nil {
+		c.tunDevice.Stop()
+	}
+	c.killSwitch.Disable()
+	c.isRunning = false
+}
+
+// appRouting reports whether per-application routing is enabled
+func (c *Client) appRouting() bool {
+	return c.config.AppMode == appModeInclude || c.config.AppMode == appModeExclude
+}
+
+// configurePolicyRouting marks traffic by rule and cgroup and routes it accordingly
+func (c *Client) configurePolicyRouting() error {
+	// Rules and excluded applications must not capture the tunnel itself
+	servers, err := c.resolveServer()
+	if err != nil {
+		return err
+	}
+	statements := append(exemptStatements(servers), ruleStatements(c.router.GetRules())...)
+
+	if c.appRouting() {
+		if err := createAppCgroup(c.config.AppCgroup); err != nil {
+			return err
+		}
+		statements = append(statements, appRoutingStatements(c.config.AppMode, c.config.AppCgroup, c.config.AllowLAN)...)
+	}
+
+	if err := configurePolicyRouting(c.config.TunDevice, statements, c.config.StateDir, c.logger); err != nil {
+		return err
+	}
+
+	if c.appRouting() {
+		c.logger.Infof("Per-application routing enabled (%s mode, cgroup %s)", c.config.AppMode, c.config.AppCgroup)
+	}
 	return nil
 }
 
+// Router returns the client's split tunnelling router
+// Changes made through it are applied to the kernel routing table immediately.
+func (c *Client) Router() *Router {
+	return c.router
+}
+
 // IsConnected returns whether the client is connected to the server
 func (c *Client) IsConnected() bool {
 	c.mutex.Lock()
@@ -107,16 +340,27 @@ func (c *Client) IsConnected() bool {
 	return c.isRunning && c.conn != nil
 }
 
+// Settings returns the server-pushed settings the client applied, or nil before the first push
+func (c *Client) Settings() *ClientSettings {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.settings == nil {
+		return nil
+	}
+	settings := *c.settings
+	return &settings
+}
+
+// handleControl answers status requests and passes route commands to the route manager
+func (c *Client) handleControl(req *ControlRequest) *ControlResponse {
+	if req.Command == ControlStatus {
+		return &ControlResponse{Connected: c.IsConnected(), Settings: c.Settings()}
+	}
+	return c.manager.HandleControl(req)
+}
+
 // runMainLoop is the main client loop that handles reconnection
 func (c *Client) runMainLoop() {
-	defer func() {
-		// Signal that we're done
-		select {
-		case c.stopCh <- struct{}{}:
-		default:
-		}
-	}()
-
 	for c.isRunning {
 		// Connect to server
 		if err := c.connectToServer(); err != nil {
@@ -125,9 +369,7 @@ func (c *Client) runMainLoop() {
 			// Check if we should retry
 			if !c.reconnect || (c.config.MaxRetries > 0 && c.retries >= c.config.MaxRetries) {
 				c.logger.Error("Maximum retry attempts reached, giving up")
-				c.mutex.Lock()
-				c.isRunning = false
-				c.mutex.Unlock()
+				c.giveUp()
 				return
 			}
 
@@ -148,19 +390,46 @@ func (c *Client) runMainLoop() {
 		// Reset retry counter on successful connection
 		c.retries = 0
 
-		// Start packet handling
+		// Start packet handling; the handlers of this connection stop when it closes
+		c.mutex.Lock()
+		conn, frames := c.conn, c.frames
+		c.mutex.Unlock()
 		errCh := make(chan error, 2)
-		go c.handleTUNPackets(errCh)
-		go c.handleServerPackets(errCh)
+		done := make(chan struct{})
+		var handlers sync.WaitGroup
+		handlers.Add(2)
+		go func() {
+			defer handlers.Done()
+			c.handleTUNPackets(frames, done, errCh)
+		}()
+		go func() {
+			defer handlers.Done()
+			c.handleServerPackets(conn, frames, errCh)
+		}()
+
+		// Identify ourselves so the server can register our names
+		if err := c.sendHello(frames); err != nil {
+			c.logger.Warnf("Failed to send hello: %v", err)
+		}
+
+		// Size the tunnel for the path to this server
+		go c.configureMTU(conn, frames)
 
 		// Wait for an error or stop signal
 		select {
 		case err := <-errCh:
 			c.logger.Errorf("Connection error: %v", err)
-			if c.conn != nil {
-				c.conn.Close()
+			close(done)
+			conn.Close()
+			c.mutex.Lock()
+			if c.conn == conn {
 				c.conn = nil
+				c.frames = nil
 			}
+			c.mutex.Unlock()
+
+			// Only one reader may use the TUN device at a time
+			handlers.Wait()
 
 			// If we're stopping, exit
 			if !c.isRunning {
@@ -178,13 +447,12 @@ func (c *Client) runMainLoop() {
 					return
 				}
 			} else {
-				c.mutex.Lock()
-				c.isRunning = false
-				c.mutex.Unlock()
+				c.giveUp()
 				return
 			}
 
 		case <-c.stopCh:
+			close(done)
 			return
 		}
 	}
@@ -192,19 +460,38 @@ func (c *Client) runMainLoop() {
 
 // connectToServer establishes a connection to the VPN server
 func (c *Client) connectToServer() error {
-	// Connect to server using TCP
-	c.logger.Infof("Connecting to %s...", c.config.ServerAddr)
-	tcpConn, err := net.DialTimeout("tcp", c.config.ServerAddr, 10*time.Second)
+	ips, err := c.resolveServer()
 	if err != nil {
-		return fmt.Errorf("failed to connect to server: %v", err)
+		return err
+	}
+
+	// The server may resolve to a new address; keep that one outside the tunnel as well
+	if c.config.RedirectGateway {
+		if err := c.pinServer(ips); err != nil {
+			c.logger.Warnf("Failed to pin server route: %v", err)
+		}
+	}
+	if err := c.killSwitch.AllowServers(ips); err != nil {
+		c.logger.Warnf("Failed to update kill switch: %v", err)
 	}
 
-	// Wrap connection with TLS
-	c.conn, err = cipher.NewTLSClientConn(tcpConn, c.config, c.logger)
+	// Connect to server over the configured transport, trying each address in turn
+	c.logger.Infof("Connecting to %s over %s...", c.config.ServerAddr, c.transport.Name())
+	_, port, _ := net.SplitHostPort(c.config.ServerAddr)
+	var conn TransportConn
+	for _, ip := range ips {
+		conn, err = c.transport.Dial(net.JoinHostPort(ip.String(), port), 10*time.Second)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
-		tcpConn.Close()
-		return fmt.Errorf("failed to establish TLS connection: %v", err)
+		return fmt.Errorf("failed to connect to server: %v", err)
 	}
+	c.mutex.Lock()
+	c.conn = conn
+	c.frames = NewFrameConn(conn)
+	c.mutex.Unlock()
 
 	c.logger.Infof("Connected to %s", c.config.ServerAddr)
 	c.lastActive = time.Now()
@@ -214,13 +501,112 @@ func (c *Client) connectToServer() error {
 	return nil
 }
 
+// tunnelDNSDomains returns the DNS routing domains covering tunnelled domain patterns
+func tunnelDNSDomains(patterns []string) []string {
+	domains := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		domains = append(domains, strings.TrimPrefix(pattern, "*."))
+	}
+	return domains
+}
+
+// sendHello tells the server who we are
+func (c *Client) sendHello(frames *FrameConn) error {
+	device := c.config.DeviceName
+	if device == "" {
+		device, _ = os.Hostname()
+	}
+	return frames.WriteControl(&ControlMessage{
+		Type:     ControlTypeHello,
+		Username: c.config.Username,
+		Device:   device,
+		Networks: c.config.SiteNetworks,
+	})
+}
+
+// siteHasIPv6 reports whether any of the site networks is an IPv6 network
+func siteHasIPv6(networks []string) bool {
+	for _, cidr := range networks {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveServer resolves the server address
+// When DNS is unreachable, for instance because the kill switch blocks it
+// while the tunnel is down, the last known addresses are used.
+func (c *Client) resolveServer() ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(c.config.ServerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address: %v", err)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		if len(c.serverIPs) > 0 {
+			c.logger.Debugf("Failed to resolve %s, using last known addresses: %v", host, err)
+			return c.serverIPs, nil
+		}
+		return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+
+	c.serverIPs = ips
+	return ips, nil
+}
+
+// enableKillSwitch installs the kill switch for the server endpoint
+func (c *Client) enableKillSwitch() error {
+	ips, err := c.resolveServer()
+	if err != nil {
+		return err
+	}
+
+	_, portStr, _ := net.SplitHostPort(c.config.ServerAddr)
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid server port: %s", portStr)
+	}
+
+	tunIP, _, err := net.ParseCIDR(c.config.TunIP)
+	if err != nil {
+		return fmt.Errorf("invalid TUN IP: %v", err)
+	}
+
+	return c.killSwitch.Enable(ips, port, tunIP.To4() == nil || c.config.EnableIPv6)
+}
+
+// pinServer routes every address of the server outside the tunnel
+func (c *Client) pinServer(ips []net.IP) error {
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			continue
+		}
+		if err := c.routes.PinHost(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // handleTUNPackets handles packets from the TUN interface and sends them to the server
-func (c *Client) handleTUNPackets(errCh chan<- error) {
+// It returns once done is closed, so the next connection can take over the TUN device.
+func (c *Client) handleTUNPackets(frames *FrameConn, done <-chan struct{}, errCh chan<- error) {
 	buffer := make([]byte, MaxPacketSize)
 
 	for c.isRunning {
-		// Read packet from TUN device
-		n, err := c.tunDevice.Read(buffer)
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		// Read packet from TUN device, checking regularly whether the connection is gone
+		n, err := c.tunDevice.ReadTimeout(buffer, tunReadTimeout)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
 		if err != nil {
 			errCh <- fmt.Errorf("failed to read from TUN: %v", err)
 			return
@@ -239,9 +625,24 @@ func (c *Client) handleTUNPackets(errCh chan<- error) {
 			continue
 		}
 
+		// Enforce drop routes
+		if c.router.ShouldRoute(packet) == RouteTypeDrop {
+			c.logger.Debugf("Dropping packet to %s by route", packet.Destination)
+			continue
+		}
+
+		// Keep TCP segments within the tunnel MTU
+		c.mssClamper.Clamp(packet, effectiveMTU(c.tunDevice.MTU(), frames.MaxPayload()))
+
+		// IPv4 packets with DF set must not be fragmented by the tunnel
+		if limit := frames.MaxPayload(); limit > 0 && len(packet.Data) > limit &&
+			packet.Type == PacketTypeIPv4 && packet.DontFragment() {
+			c.sendICMPError(packet, ICMPPacketTooBig, limit)
+			continue
+		}
+
 		// Send packet to server
-		_, err = c.conn.Write(packet.Data)
-		if err != nil {
+		if err := frames.WritePacket(packet.Data); err != nil {
 			errCh <- fmt.Errorf("failed to write to server: %v", err)
 			return
 		}
@@ -249,12 +650,18 @@ func (c *Client) handleTUNPackets(errCh chan<- error) {
 }
 
 // handleServerPackets handles packets from the server and writes them to the TUN interface
-func (c *Client) handleServerPackets(errCh chan<- error) {
-	buffer := make([]byte, MaxPacketSize)
+// It returns once conn is closed.
+func (c *Client) handleServerPackets(conn TransportConn, frames *FrameConn, errCh chan<- error) {
+	buffer := make([]byte, MaxFrameSize)
 
 	for c.isRunning {
-		// Read packet from server
-		n, err := c.conn.Read(buffer)
+		// Give up on a server that has gone silent
+		if timeout := c.keepaliveTimeout(); timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		// Read frame from server
+		frameType, payload, err := frames.ReadFrame(buffer)
 		if err != nil {
 			errCh <- fmt.Errorf("failed to read from server: %v", err)
 			return
@@ -262,17 +669,34 @@ func (c *Client) handleServerPackets(errCh chan<- error) {
 
 		// Update statistics
 		c.mutex.Lock()
-		c.bytesIn += uint64(n)
+		c.bytesIn += uint64(len(payload))
 		c.lastActive = time.Now()
 		c.mutex.Unlock()
 
+		// Handle non-data frames
+		switch frameType {
+		case FrameTypeData:
+		case FrameTypeControl:
+			c.handleControlMessage(frames, payload)
+			continue
+		default:
+			c.logger.Debugf("Ignoring frame of type %d from server", frameType)
+			continue
+		}
+
 		// Parse packet
-		packet, err := ParsePacket(buffer[:n])
+		packet, err := ParsePacket(payload)
 		if err != nil {
 			c.logger.Debugf("Failed to parse packet from server: %v", err)
 			continue
 		}
 
+		// Keep TCP segments within the tunnel MTU
+		c.mssClamper.Clamp(packet, effectiveMTU(c.tunDevice.MTU(), frames.MaxPayload()))
+
+		// Learn routes for tunnelled domains before the answer reaches the application
+		c.domains.Inspect(packet)
+
 		// Write packet to TUN device
 		_, err = c.tunDevice.Write(packet.Data)
 		if err != nil {
@@ -282,6 +706,305 @@ func (c *Client) handleServerPackets(errCh chan<- error) {
 	}
 }
 
+// configureMTU sizes the TUN device to fit the path to the server and tells
+// the server which MTU the client is using
+// With fragmentation enabled the TUN keeps the configured MTU and only the
+// per-frame payload limit follows the path.
+func (c *Client) configureMTU(conn TransportConn, frames *FrameConn) {
+	payload := c.mtuLimit()
+
+	// The kernel tracks the path MTU of the connection to the server
+	if c.config.AutoMTU {
+		if limit, ok := conn.PathMTU(); !ok {
+			c.logger.Warnf("Path MTU of the connection is unknown, keeping MTU %d", payload)
+		} else {
+			if limit < payload {
+				payload = limit
+			}
+			if payload < MinTunnelMTU {
+				payload = MinTunnelMTU
+			}
+			c.logger.Infof("Path MTU allows %d byte tunnel payload", payload)
+		}
+	}
+	// Settings pushed while probing may have lowered the limit
+	if limit := c.mtuLimit(); payload > limit {
+		payload = limit
+	}
+
+	mtu := payload
+	if c.config.Fragment {
+		mtu = c.mtuLimit()
+	}
+	c.applyMTU(frames, mtu, payload)
+}
+
+// applyMTU sizes the TUN device and frame payloads and tells the server which MTU the client is using
+func (c *Client) applyMTU(frames *FrameConn, mtu, payload int) {
+	frames.SetMaxPayload(payload)
+
+	// Apply the MTU to the TUN device
+	if mtu != c.tunDevice.MTU() {
+		if err := c.tunDevice.SetMTU(mtu); err != nil {
+			c.logger.Errorf("Failed to apply tunnel MTU: %v", err)
+			return
+		}
+	}
+
+	// Let the server know how large packets towards us may be
+	msg := &ControlMessage{Type: ControlTypeMTU, MTU: mtu, MaxPayload: payload}
+	if err := frames.WriteControl(msg); err != nil {
+		c.logger.Debugf("Failed to announce MTU to server: %v", err)
+	}
+}
+
+// mtuLimit returns the largest tunnel MTU allowed by the configuration and the server
+func (c *Client) mtuLimit() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.settings != nil && c.settings.MTU >= MinTunnelMTU && c.settings.MTU < c.config.MTU {
+		return c.settings.MTU
+	}
+	return c.config.MTU
+}
+
+// keepaliveTimeout returns how long the server may stay silent (0 = forever)
+func (c *Client) keepaliveTimeout() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.settings == nil || c.settings.Keepalive <= 0 {
+		return 0
+	}
+	return time.Duration(c.settings.KeepaliveTimeout) * time.Second
+}
+
+// handleControlMessage processes a control message received from the server
+func (c *Client) handleControlMessage(frames *FrameConn, payload []byte) {
+	msg, err := ParseControlMessage(payload)
+	if err != nil {
+		c.logger.Debugf("Server sent %v", err)
+		return
+	}
+
+	switch msg.Type {
+	case ControlTypeConfig:
+		if msg.Settings == nil {
+			c.logger.Debug("Server pushed an empty configuration")
+			return
+		}
+		c.applySettings(frames, msg.Settings)
+	case ControlTypeKeepalive:
+	default:
+		c.logger.Debugf("Ignoring control message %q from server", msg.Type)
+	}
+}
+
+// applySettings applies the settings pushed by the server and reports the result
+// Settings unchanged since the previous connection are left alone, so a
+// reconnect to the same server does not disturb routes or DNS.
+func (c *Client) applySettings(frames *FrameConn, settings *ClientSettings) {
+	c.mutex.Lock()
+	previous := c.settings
+	c.mutex.Unlock()
+	if previous == nil {
+		previous = &ClientSettings{}
+	}
+
+	applied := *settings
+	var failures []string
+
+	// Use the address the server assigned to us
+	if settings.Address != "" {
+		if err := c.tunDevice.SetAddress(settings.Address); err != nil {
+			failures = append(failures, fmt.Sprintf("address: %v", err))
+			applied.Address = previous.Address
+		}
+	}
+
+	// Add the IPv6 address if the tunnel carries IPv6, dropping one a previous server assigned
+	if c.config.EnableIPv6 && settings.Address6 != "" {
+		if err := c.tunDevice.SetAddress(settings.Address6); err != nil {
+			failures = append(failures, fmt.Sprintf("address6: %v", err))
+			applied.Address6 = previous.Address6
+		}
+	} else {
+		applied.Address6 = ""
+		if previous.Address6 != "" && previous.Address6 != c.config.TunIPv6 {
+			if err := c.tunDevice.RemoveAddress(previous.Address6); err != nil {
+				c.logger.Warnf("Failed to remove IPv6 address %s: %v", previous.Address6, err)
+			}
+		}
+	}
+
+	// Put a delegated prefix on the LAN so it can be advertised there
+	if settings.DelegatedPrefix != previous.DelegatedPrefix {
+		if err := c.applyDelegatedPrefix(settings.DelegatedPrefix, previous.DelegatedPrefix); err != nil {
+			failures = append(failures, fmt.Sprintf("delegated prefix: %v", err))
+			applied.DelegatedPrefix = previous.DelegatedPrefix
+		}
+	}
+
+	// Route the pushed networks and DNS servers through the tunnel
+	if !slices.Equal(settings.Routes, previous.Routes) || !slices.Equal(settings.DNS, previous.DNS) {
+		networks, err := pushedNetworks(settings)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("routes: %v", err))
+		}
+		c.router.ReplaceSet(pushedRouteSet, networks, RouteTypeTUN)
+	}
+
+	// Resolve names through the pushed DNS servers
+	if !slices.Equal(settings.DNS, previous.DNS) || !slices.Equal(settings.Domains, previous.Domains) {
+		if err := c.applyPushedDNS(settings.DNS, settings.Domains); err != nil {
+			failures = append(failures, fmt.Sprintf("dns: %v", err))
+			applied.DNS, applied.Domains = previous.DNS, previous.Domains
+		}
+	}
+
+	c.mutex.Lock()
+	c.settings = &applied
+	startKeepalive := applied.Keepalive > 0 && c.keepalive != frames
+	if startKeepalive {
+		c.keepalive = frames
+	}
+	c.mutex.Unlock()
+
+	// Never use a larger MTU than the server allows
+	if limit := c.mtuLimit(); c.tunDevice.MTU() > limit {
+		payload := frames.MaxPayload()
+		if payload == 0 || payload > limit {
+			payload = limit
+		}
+		c.applyMTU(frames, limit, payload)
+	}
+
+	if startKeepalive {
+		go c.sendKeepalives(frames, time.Duration(applied.Keepalive)*time.Second)
+	}
+
+	// Tell the server what we ended up with
+	msg := &ControlMessage{Type: ControlTypeApplied, Settings: &applied, Error: strings.Join(failures, "; ")}
+	if len(failures) > 0 {
+		c.logger.Warnf("Failed to apply some pushed settings: %s", msg.Error)
+	} else {
+		c.logger.Infof("Applied settings pushed by the server (address %s)", applied.Address)
+	}
+	if err := frames.WriteControl(msg); err != nil {
+		c.logger.Debugf("Failed to report applied settings: %v", err)
+	}
+}
+
+// applyDelegatedPrefix moves the LAN interface from the previous delegated prefix to the current one
+// Without an IPv6 tunnel or a LAN interface the prefix is only recorded.
+func (c *Client) applyDelegatedPrefix(prefix, previous string) error {
+	iface := c.config.LANInterface
+	if previous != "" && iface != "" {
+		if err := removeDelegatedPrefix(iface, previous); err != nil {
+			c.logger.Warnf("Failed to remove delegated prefix %s: %v", previous, err)
+		}
+	}
+	if prefix == "" {
+		return nil
+	}
+	if !c.config.EnableIPv6 || iface == "" {
+		c.logger.Infof("Server delegated prefix %s, set enable_ipv6 and lan_interface to use it", prefix)
+		return nil
+	}
+
+	// Packets for the prefix arrive through the tunnel and leave on the LAN
+	if err := setForwarding(c.config.StateDir, true); err != nil {
+		return err
+	}
+	if err := assignDelegatedPrefix(iface, prefix); err != nil {
+		return err
+	}
+	c.logger.Infof("Delegated prefix %s assigned to %s", prefix, iface)
+	return nil
+}
+
+// applyPushedDNS replaces the configured DNS servers and search domains with pushed ones
+func (c *Client) applyPushedDNS(servers, domains []string) error {
+	cfg := c.dnsConfig
+	if len(servers) > 0 {
+		cfg.Servers = servers
+	}
+	if len(domains) > 0 {
+		cfg.Search = domains
+	}
+	manager := NewDNSManager(cfg, c.config.TunDevice, c.config.StateDir, c.logger)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.isRunning {
+		return nil
+	}
+	if err := c.dns.Restore(); err != nil {
+		c.logger.Errorf("Failed to restore DNS settings: %v", err)
+	}
+	c.dns = manager
+	return c.dns.Apply()
+}
+
+// sendKeepalives sends a keepalive to the server at the pushed interval until the connection is replaced
+func (c *Client) sendKeepalives(frames *FrameConn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mutex.Lock()
+		current := c.isRunning && c.frames == frames
+		c.mutex.Unlock()
+		if !current {
+			return
+		}
+
+		if err := frames.WriteControl(&ControlMessage{Type: ControlTypeKeepalive}); err != nil {
+			c.logger.Debugf("Failed to send keepalive: %v", err)
+			return
+		}
+	}
+}
+
+// pushedNetworks returns the pushed routes and host routes for the pushed DNS servers
+func pushedNetworks(settings *ClientSettings) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	var invalid []string
+	for _, cidr := range settings.Routes {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			invalid = append(invalid, cidr)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	for _, server := range settings.DNS {
+		ip := net.ParseIP(server)
+		if ip == nil {
+			invalid = append(invalid, server)
+			continue
+		}
+		networks = append(networks, hostIPNet(ip))
+	}
+
+	if len(invalid) > 0 {
+		return networks, fmt.Errorf("ignoring invalid networks %s", strings.Join(invalid, ", "))
+	}
+	return networks, nil
+}
+
+// sendICMPError answers a packet read from the TUN device with an ICMP error
+// The error appears to come from the packet's destination, as if from the next hop.
+func (c *Client) sendICMPError(packet *Packet, errType ICMPErrorType, mtu int) {
+	reply := c.icmp.Generate(packet, errType, packet.Destination, mtu)
+	if reply == nil {
+		return
+	}
+	if _, err := c.tunDevice.Write(reply); err != nil {
+		c.logger.Debugf("Failed to send ICMP %v to %s: %v", errType, packet.Source, err)
+	}
+}
+
 // GetStatistics returns the client connection statistics
 func (c *Client) GetStatistics() (bytesIn, bytesOut uint64, lastActive time.Time) {
 	c.mutex.Lock()
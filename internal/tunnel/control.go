@@ -0,0 +1,183 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Unix socket in the state directory accepting control commands
+	controlSocketFile = "tuno.sock"
+	// How long a control connection may take
+	controlTimeout = 30 * time.Second
+)
+
+// Control commands
+const (
+	ControlRouteAdd   = "route-add"
+	ControlRouteDel   = "route-del"
+	ControlRouteList  = "route-list"
+	ControlSetImport  = "set-import"
+	ControlSetEnable  = "set-enable"
+	ControlSetDisable = "set-disable"
+	ControlSetRemove  = "set-remove"
+	ControlStatus     = "status"
+)
+
+// ControlRequest is a command sent to a running client
+type ControlRequest struct {
+	Command  string `json:"command"`
+	Network  string `json:"network,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Name     string `json:"name,omitempty"`
+	File     string `json:"file,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// RouteInfo describes a route in a control response
+type RouteInfo struct {
+	Network string `json:"network"`
+	Type    string `json:"type"`
+}
+
+// ControlResponse is the answer to a ControlRequest
+type ControlResponse struct {
+	Error     string          `json:"error,omitempty"`
+	Routes    []RouteInfo     `json:"routes,omitempty"`
+	Sets      []RouteSet      `json:"sets,omitempty"`
+	Connected bool            `json:"connected,omitempty"`
+	Settings  *ClientSettings `json:"settings,omitempty"`
+}
+
+// ControlHandler executes a control command
+type ControlHandler func(req *ControlRequest) *ControlResponse
+
+// ControlServer accepts control commands on a Unix socket
+// Each connection carries a single JSON request and response. The socket is
+// only accessible to the user running the client.
+type ControlServer struct {
+	path     string
+	handler  ControlHandler
+	listener net.Listener
+	mutex    sync.Mutex
+	logger   *logrus.Logger
+}
+
+// ControlSocketPath returns the control socket path for a state directory
+func ControlSocketPath(stateDir string) string {
+	return filepath.Join(stateDir, controlSocketFile)
+}
+
+// NewControlServer creates a control server listening on path
+func NewControlServer(path string, handler ControlHandler, logger *logrus.Logger) *ControlServer {
+	return &ControlServer{
+		path:    path,
+		handler: handler,
+		logger:  logger,
+	}
+}
+
+// Start listens for control connections
+func (s *ControlServer) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.listener != nil {
+		return fmt.Errorf("control server is already running")
+	}
+
+	// Remove a socket left behind by a client that did not shut down cleanly
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	os.Remove(s.path)
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.path, err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict control socket: %v", err)
+	}
+
+	s.listener = listener
+	go s.serve(listener)
+
+	s.logger.Debugf("Control socket listening on %s", s.path)
+	return nil
+}
+
+// Stop closes the control socket
+func (s *ControlServer) Stop() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+		os.Remove(s.path)
+	}
+}
+
+// serve accepts connections until the listener is closed
+func (s *ControlServer) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn answers a single request
+func (s *ControlServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req ControlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(&ControlResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	s.logger.Debugf("Control command %s", req.Command)
+	if err := json.NewEncoder(conn).Encode(s.handler(&req)); err != nil {
+		s.logger.Debugf("Failed to send control response: %v", err)
+	}
+}
+
+// SendControl sends a command to the client listening on path
+func SendControl(path string, req *ControlRequest) (*ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the client at %s, is it running? (%v)", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send command: %v", err)
+	}
+
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.Error != "" {
+		return &resp, fmt.Errorf("%s", resp.Error)
+	}
+	return &resp, nil
+}
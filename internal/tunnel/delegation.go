@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// delegatedAddress returns the address a client takes from its delegated prefix:
+// the first address after the prefix itself, with the prefix length
+func delegatedAddress(prefix string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil || network.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid delegated prefix %q", prefix)
+	}
+	ip := append(net.IP(nil), network.IP...)
+	ip[len(ip)-1] |= 1
+	return &net.IPNet{IP: ip, Mask: network.Mask}, nil
+}
+
+// assignDelegatedPrefix puts an address from a delegated prefix on a LAN interface,
+// from where a router advertisement daemon such as radvd announces the prefix
+func assignDelegatedPrefix(iface, prefix string) error {
+	addr, err := delegatedAddress(prefix)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", iface, err)
+	}
+	if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: addr}); err != nil {
+		return fmt.Errorf("failed to add %s to %s: %v", addr, iface, err)
+	}
+	return nil
+}
+
+// removeDelegatedPrefix removes the address of a delegated prefix from a LAN interface
+func removeDelegatedPrefix(iface, prefix string) error {
+	addr, err := delegatedAddress(prefix)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", iface, err)
+	}
+	if err := netlink.AddrDel(link, &netlink.Addr{IPNet: addr}); err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+		return fmt.Errorf("failed to remove %s from %s: %v", addr, iface, err)
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DNS configuration methods
+	dnsModeResolved   = "resolved"
+	dnsModeResolvConf = "resolv.conf"
+
+	resolvConfPath = "/etc/resolv.conf"
+	// Present while systemd-resolved is running
+	resolvedRuntimeDir = "/run/systemd/resolve"
+
+	// Files under the state directory
+	dnsStateFile  = "dns-state.json"
+	dnsBackupFile = "resolv.conf.backup"
+
+	// nftables table blocking DNS outside the tunnel
+	dnsBlockTable = "tuno_dns"
+)
+
+// dnsState records what was changed, so that it can be undone after a crash
+type dnsState struct {
+	Mode    string `json:"mode"`
+	Device  string `json:"device,omitempty"`
+	Symlink string `json:"symlink,omitempty"`
+	Blocked bool   `json:"blocked,omitempty"`
+}
+
+// DNSManager applies the client's DNS settings while connected
+// Settings go through systemd-resolved's per-link configuration when it is
+// running, or replace /etc/resolv.conf otherwise. Every change is recorded in
+// the state directory before it is made. A nil DNSManager is valid and does nothing.
+type DNSManager struct {
+	config   config.DNSConfig
+	device   string
+	stateDir string
+	state    *dnsState
+	mutex    sync.Mutex
+	logger   *logrus.Logger
+}
+
+// NewDNSManager creates a DNS manager for the given TUN device
+// Returns nil if there is nothing to configure.
+func NewDNSManager(cfg config.DNSConfig, device, stateDir string, logger *logrus.Logger) *DNSManager {
+	if len(cfg.Servers) == 0 && !cfg.BlockOutside {
+		return nil
+	}
+	return &DNSManager{
+		config:   cfg,
+		device:   device,
+		stateDir: stateDir,
+		logger:   logger,
+	}
+}
+
+// Apply configures DNS for the tunnel
+func (d *DNSManager) Apply() error {
+	if d == nil {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.state != nil {
+		return nil
+	}
+
+	// Changes of a previous run that were never undone would be backed up as the original
+	statePath := filepath.Join(d.stateDir, dnsStateFile)
+	if _, err := os.Stat(statePath); err == nil {
+		return fmt.Errorf("DNS settings changed by a previous run were not restored; check %s and remove %s", resolvConfPath, statePath)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check DNS state: %v", err)
+	}
+
+	mode := d.config.Mode
+	if mode == "" || mode == "auto" {
+		mode = detectDNSMode()
+	}
+
+	state := &dnsState{
+		Mode:    mode,
+		Device:  d.device,
+		Blocked: d.config.BlockOutside,
+	}
+
+	// Back up resolv.conf before touching it
+	if mode == dnsModeResolvConf && len(d.config.Servers) > 0 {
+		if target, err := os.Readlink(resolvConfPath); err == nil {
+			state.Symlink = target
+		} else {
+			data, err := os.ReadFile(resolvConfPath)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to read %s: %v", resolvConfPath, err)
+			}
+			if err := os.MkdirAll(d.stateDir, 0700); err != nil {
+				return fmt.Errorf("failed to create state directory: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(d.stateDir, dnsBackupFile), data, 0600); err != nil {
+				return fmt.Errorf("failed to back up %s: %v", resolvConfPath, err)
+			}
+		}
+	}
+
+	// Record the state before changing anything, so a crash can be undone
+	if err := d.saveState(state); err != nil {
+		return err
+	}
+	d.state = state
+
+	if len(d.config.Servers) > 0 {
+		var err error
+		if mode == dnsModeResolved {
+			err = d.applyResolved()
+		} else {
+			err = d.applyResolvConf()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.config.BlockOutside {
+		if err := blockOutsideDNS(d.device); err != nil {
+			return err
+		}
+	}
+
+	d.logger.Infof("Applied DNS settings using %s", mode)
+	return nil
+}
+
+// Restore undoes the changes made by Apply
+func (d *DNSManager) Restore() error {
+	if d == nil {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.state == nil {
+		return nil
+	}
+
+	err := restoreDNS(d.state, d.stateDir)
+	d.state = nil
+	if err == nil {
+		d.logger.Info("Restored DNS settings")
+	}
+	return err
+}
+
+// RecoverDNS undoes DNS changes left in a state directory by a client that did not shut down cleanly
+func RecoverDNS(stateDir string, logger *logrus.Logger) {
+	data, err := os.ReadFile(filepath.Join(stateDir, dnsStateFile))
+	if err != nil {
+		return
+	}
+
+	var state dnsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		logger.Warnf("Ignoring invalid DNS state file: %v", err)
+		os.Remove(filepath.Join(stateDir, dnsStateFile))
+		return
+	}
+
+	if err := restoreDNS(&state, stateDir); err != nil {
+		logger.Errorf("Failed to restore DNS settings from a previous run: %v", err)
+		return
+	}
+	logger.Info("Restored DNS settings left by a previous run")
+}
+
+// applyResolved configures the TUN link through systemd-resolved
+func (d *DNSManager) applyResolved() error {
+	if err := runResolvectl(append([]string{"dns", d.device}, d.config.Servers...)...); err != nil {
+		return err
+	}
+
+	// Routing-only domains (~) send matching queries to this link; ~. captures all of them
+	domains := append([]string{}, d.config.Search...)
+	for _, domain := range d.config.SplitDomains {
+		domains = append(domains, "~"+strings.TrimPrefix(domain, "~"))
+	}
+	if len(d.config.SplitDomains) == 0 {
+		domains = append(domains, "~.")
+	}
+	if err := runResolvectl(append([]string{"domain", d.device}, domains...)...); err != nil {
+		return err
+	}
+
+	defaultRoute := "yes"
+	if len(d.config.SplitDomains) > 0 {
+		defaultRoute = "no"
+	}
+	return runResolvectl("default-route", d.device, defaultRoute)
+}
+
+// applyResolvConf replaces /etc/resolv.conf with the tunnel's servers
+func (d *DNSManager) applyResolvConf() error {
+	if len(d.config.SplitDomains) > 0 {
+		d.logger.Warn("Split DNS domains need systemd-resolved, all queries will use the tunnel servers")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by Tuno VPN, restored on disconnect\n")
+	for _, server := range d.config.Servers {
+		fmt.Fprintf(&buf, "nameserver %s\n", server)
+	}
+	if len(d.config.Search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(d.config.Search, " "))
+	}
+
+	// A symlink must be replaced by a file rather than written through
+	if d.state.Symlink != "" {
+		if err := os.Remove(resolvConfPath); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", resolvConfPath, err)
+		}
+	}
+	if err := os.WriteFile(resolvConfPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", resolvConfPath, err)
+	}
+	return nil
+}
+
+// saveState writes the DNS state file
+func (d *DNSManager) saveState(state *dnsState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(d.stateDir, dnsStateFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to save DNS state: %v", err)
+	}
+	return nil
+}
+
+// restoreDNS undoes the changes described by a state and removes the state file
+func restoreDNS(state *dnsState, stateDir string) error {
+	if state.Blocked {
+		if err := deleteNFTTable(dnsBlockTable); err != nil {
+			return fmt.Errorf("failed to remove DNS block: %v", err)
+		}
+	}
+
+	switch state.Mode {
+	case dnsModeResolved:
+		// The link may already be gone, which drops its settings anyway
+		if err := runResolvectl("revert", state.Device); err != nil && !strings.Contains(err.Error(), "No such device") {
+			return err
+		}
+	case dnsModeResolvConf:
+		backupPath := filepath.Join(stateDir, dnsBackupFile)
+		if state.Symlink != "" {
+			os.Remove(resolvConfPath)
+			if err := os.Symlink(state.Symlink, resolvConfPath); err != nil {
+				return fmt.Errorf("failed to restore %s: %v", resolvConfPath, err)
+			}
+		} else if data, err := os.ReadFile(backupPath); err == nil {
+			if err := os.WriteFile(resolvConfPath, data, 0644); err != nil {
+				return fmt.Errorf("failed to restore %s: %v", resolvConfPath, err)
+			}
+		}
+		os.Remove(backupPath)
+	}
+
+	os.Remove(filepath.Join(stateDir, dnsStateFile))
+	return nil
+}
+
+// blockOutsideDNS drops DNS traffic that does not leave through the TUN device
+// Plain DNS and DNS over TLS are blocked; loopback stays open for local stub resolvers.
+func blockOutsideDNS(device string) error {
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "table inet %s\n", dnsBlockTable)
+	fmt.Fprintf(&script, "delete table inet %s\n", dnsBlockTable)
+	fmt.Fprintf(&script, "table inet %s {\n", dnsBlockTable)
+	fmt.Fprintf(&script, "\tchain output {\n")
+	fmt.Fprintf(&script, "\t\ttype filter hook output priority 0; policy accept;\n")
+	fmt.Fprintf(&script, "\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&script, "\t\toifname %q accept\n", device)
+	fmt.Fprintf(&script, "\t\tudp dport 53 drop\n")
+	fmt.Fprintf(&script, "\t\ttcp dport { 53, 853 } drop\n")
+	fmt.Fprintf(&script, "\t}\n")
+	fmt.Fprintf(&script, "}\n")
+
+	if err := runNFT(script.String()); err != nil {
+		return fmt.Errorf("failed to block DNS outside the tunnel: %v", err)
+	}
+	return nil
+}
+
+// detectDNSMode picks systemd-resolved when it is running and resolvectl is available
+func detectDNSMode() string {
+	if _, err := os.Stat(resolvedRuntimeDir); err != nil {
+		return dnsModeResolvConf
+	}
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return dnsModeResolvConf
+	}
+	return dnsModeResolved
+}
+
+// runResolvectl runs a resolvectl command
+func runResolvectl(args ...string) error {
+	if output, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("resolvectl %s: %v: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	protocolUDP  = 17
+	udpHeaderLen = 8
+	dnsPort      = 53
+
+	// Domain routes outlive short DNS TTLs, since connections outlive lookups
+	domainRouteMinTTL = 5 * time.Minute
+	domainRouteMaxTTL = 24 * time.Hour
+	// How often expired domain routes are removed
+	domainRouteSweepInterval = 30 * time.Second
+	// Resolved addresses waiting for their routes to be installed
+	domainRouteQueueLen = 256
+)
+
+// resolvedAddress is an address resolved for a tunnelled domain
+type resolvedAddress struct {
+	ip   net.IP
+	ttl  time.Duration
+	name string
+}
+
+// DomainRouter sends traffic for configured domains through the tunnel
+// It watches DNS responses arriving through the tunnel and adds a tunnel host
+// route to the Router for every address resolved for a matching name. Routes
+// expire once the record's TTL has passed without the name being resolved again.
+// Only UDP responses are inspected, so the domains must be resolved by a DNS
+// server reached through the tunnel.
+type DomainRouter struct {
+	domains *dns.DomainSet
+	router  *Router
+	expiry  map[string]time.Time
+	queue   chan resolvedAddress
+	done    chan struct{}
+	mutex   sync.Mutex
+	logger  *logrus.Logger
+}
+
+// NewDomainRouter creates a domain router for names or *.domain patterns
+// Returns nil if no domains are configured.
+func NewDomainRouter(domains []string, router *Router, logger *logrus.Logger) *DomainRouter {
+	if len(domains) == 0 {
+		return nil
+	}
+
+	set := dns.NewDomainSet()
+	for _, domain := range domains {
+		set.Add(domain)
+	}
+
+	return &DomainRouter{
+		domains: set,
+		router:  router,
+		expiry:  make(map[string]time.Time),
+		queue:   make(chan resolvedAddress, domainRouteQueueLen),
+		logger:  logger,
+	}
+}
+
+// Inspect queues routes for addresses in a DNS response packet for a tunnelled domain
+// It runs before the packet is delivered, so the routes are usually in place
+// by the time the first connection starts. Installing them is left to the
+// background worker, so a slow kernel never stalls the packet path.
+func (d *DomainRouter) Inspect(packet *Packet) {
+	if d == nil {
+		return
+	}
+
+	offset, protocol := packet.TransportHeader()
+	if protocol != protocolUDP || offset < 0 || len(packet.Data) < offset+udpHeaderLen {
+		return
+	}
+	if binary.BigEndian.Uint16(packet.Data[offset:offset+2]) != dnsPort {
+		return
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(packet.Data[offset+udpHeaderLen:])
+	if err != nil || !header.Response || header.RCode != dnsmessage.RCodeSuccess {
+		return
+	}
+	question, err := parser.Question()
+	if err != nil || !d.domains.Match(dns.CanonicalName(question.Name.String())) {
+		return
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	// Every address in the answer belongs to the name, possibly through CNAMEs
+	for {
+		rh, err := parser.AnswerHeader()
+		if err != nil {
+			return
+		}
+
+		var ip net.IP
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			a, err := parser.AResource()
+			if err != nil {
+				return
+			}
+			ip = net.IP(a.A[:])
+		case dnsmessage.TypeAAAA:
+			aaaa, err := parser.AAAAResource()
+			if err != nil {
+				return
+			}
+			ip = net.IP(aaaa.AAAA[:])
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return
+			}
+			continue
+		}
+
+		select {
+		case d.queue <- resolvedAddress{ip: ip, ttl: time.Duration(rh.TTL) * time.Second, name: question.Name.String()}:
+		default:
+			d.logger.Debugf("Domain route queue full, not routing %s (%s)", question.Name, ip)
+		}
+	}
+}
+
+// Start begins installing routes and removing expired ones in the background
+func (d *DomainRouter) Start() {
+	if d == nil {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.done != nil {
+		return
+	}
+	d.done = make(chan struct{})
+	go d.run(d.done)
+}
+
+// Stop stops installing and removing routes
+func (d *DomainRouter) Stop() {
+	if d == nil {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.done != nil {
+		close(d.done)
+		d.done = nil
+	}
+}
+
+// run installs queued routes and removes expired ones until done is closed
+func (d *DomainRouter) run(done <-chan struct{}) {
+	ticker := time.NewTicker(domainRouteSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case resolved := <-d.queue:
+			d.addRoute(resolved.ip, resolved.ttl, resolved.name)
+		case now := <-ticker.C:
+			d.sweep(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// addRoute adds or refreshes the tunnel route for a resolved address
+func (d *DomainRouter) addRoute(ip net.IP, ttl time.Duration, name string) {
+	if ttl < domainRouteMinTTL {
+		ttl = domainRouteMinTTL
+	}
+	if ttl > domainRouteMaxTTL {
+		ttl = domainRouteMaxTTL
+	}
+
+	cidr := hostIPNet(ip).String()
+	expires := time.Now().Add(ttl)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if current, ok := d.expiry[cidr]; ok {
+		if expires.After(current) {
+			d.expiry[cidr] = expires
+		}
+		return
+	}
+
+	// Leave routes configured for the same address alone
+	if d.router.HasRoute(cidr) {
+		return
+	}
+
+	if err := d.router.AddRoute(cidr, RouteTypeTUN); err != nil {
+		d.logger.Warnf("Failed to add route for %s (%s): %v", name, ip, err)
+		return
+	}
+	d.expiry[cidr] = expires
+	d.logger.Debugf("Routing %s (%s) through the tunnel for %v", name, ip, ttl)
+}
+
+// sweep removes routes whose addresses have not been resolved again in time
+func (d *DomainRouter) sweep(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for cidr, expires := range d.expiry {
+		if now.Before(expires) {
+			continue
+		}
+		delete(d.expiry, cidr)
+		if err := d.router.RemoveRoute(cidr); err != nil {
+			d.logger.Debugf("Failed to remove expired route %s: %v", cidr, err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// Fragment header: 4 byte packet ID, 1 byte fragment index, 1 byte fragment count
+	fragmentHeaderLen = 6
+	// Most fragments a single packet may be split into
+	maxFragments = 255
+
+	// How long an incomplete packet is kept before it is discarded
+	reassemblyTimeout = 5 * time.Second
+	// Upper bound on memory held by incomplete packets per connection
+	reassemblyMaxMemory = 4 << 20
+	// Upper bound on the number of incomplete packets per connection
+	reassemblyMaxPending = 256
+	// Memory charged for each fragment slot of an incomplete packet, the size of a slice header
+	fragmentSlotSize = 24
+	// How often expired packets are swept
+	reassemblySweepInterval = time.Second
+)
+
+// partialPacket is a packet whose fragments have not all arrived yet
+type partialPacket struct {
+	fragments [][]byte
+	received  int
+	size      int
+	created   time.Time
+}
+
+// memory returns the bytes held by the packet, counting its fragment slots
+func (p *partialPacket) memory() int {
+	return p.size + len(p.fragments)*fragmentSlotSize
+}
+
+// Reassembler rebuilds packets from tunnel fragments
+// It is not safe for concurrent use; each connection's read loop owns one.
+type Reassembler struct {
+	pending   map[uint32]*partialPacket
+	memory    int
+	maxMemory int
+	timeout   time.Duration
+	lastSweep time.Time
+	dropped   uint64
+}
+
+// NewReassembler creates a reassembler with the default timeout and memory limit
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		pending:   make(map[uint32]*partialPacket),
+		maxMemory: reassemblyMaxMemory,
+		timeout:   reassemblyTimeout,
+		lastSweep: time.Now(),
+	}
+}
+
+// Add stores a fragment and returns the complete packet once all fragments have arrived
+func (r *Reassembler) Add(fragment []byte) ([]byte, error) {
+	if len(fragment) <= fragmentHeaderLen {
+		return nil, fmt.Errorf("fragment too short: %d bytes", len(fragment))
+	}
+
+	id := binary.BigEndian.Uint32(fragment[0:4])
+	index := int(fragment[4])
+	count := int(fragment[5])
+	data := fragment[fragmentHeaderLen:]
+	if count < 2 || index >= count {
+		return nil, fmt.Errorf("invalid fragment %d of %d", index, count)
+	}
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) >= reassemblySweepInterval {
+		r.sweep(now)
+	}
+
+	partial, ok := r.pending[id]
+	if !ok {
+		// Make room before the new packet's fragment slots are allocated
+		slots := count * fragmentSlotSize
+		for len(r.pending) > 0 && (len(r.pending) >= reassemblyMaxPending || r.memory+slots+len(data) > r.maxMemory) {
+			r.evictOldest(id)
+		}
+		if r.memory+slots+len(data) > r.maxMemory {
+			return nil, fmt.Errorf("reassembly memory limit reached")
+		}
+
+		partial = &partialPacket{
+			fragments: make([][]byte, count),
+			created:   now,
+		}
+		r.pending[id] = partial
+		r.memory += slots
+	}
+	if len(partial.fragments) != count {
+		r.drop(id, partial)
+		return nil, fmt.Errorf("fragment count mismatch for packet %d", id)
+	}
+	if partial.fragments[index] != nil {
+		return nil, nil // Duplicate
+	}
+
+	// Make room by discarding the oldest incomplete packets
+	for r.memory+len(data) > r.maxMemory && len(r.pending) > 1 {
+		r.evictOldest(id)
+	}
+	if r.memory+len(data) > r.maxMemory {
+		r.drop(id, partial)
+		return nil, fmt.Errorf("reassembly memory limit reached")
+	}
+
+	partial.fragments[index] = append([]byte(nil), data...)
+	partial.received++
+	partial.size += len(data)
+	r.memory += len(data)
+
+	if partial.received < count {
+		return nil, nil
+	}
+
+	// All fragments are in, rebuild the packet
+	packet := make([]byte, 0, partial.size)
+	for _, f := range partial.fragments {
+		packet = append(packet, f...)
+	}
+	r.memory -= partial.memory()
+	delete(r.pending, id)
+	return packet, nil
+}
+
+// Dropped returns the number of incomplete packets discarded so far
+func (r *Reassembler) Dropped() uint64 {
+	return r.dropped
+}
+
+// sweep discards incomplete packets older than the timeout
+func (r *Reassembler) sweep(now time.Time) {
+	for id, partial := range r.pending {
+		if now.Sub(partial.created) > r.timeout {
+			r.drop(id, partial)
+		}
+	}
+	r.lastSweep = now
+}
+
+// evictOldest discards the oldest incomplete packet other than keep
+func (r *Reassembler) evictOldest(keep uint32) {
+	var oldestID uint32
+	var oldest *partialPacket
+	for id, partial := range r.pending {
+		if id != keep && (oldest == nil || partial.created.Before(oldest.created)) {
+			oldestID, oldest = id, partial
+		}
+	}
+	if oldest != nil {
+		r.drop(oldestID, oldest)
+	}
+}
+
+// drop discards an incomplete packet
+func (r *Reassembler) drop(id uint32, partial *partialPacket) {
+	r.memory -= partial.memory()
+	r.dropped++
+	delete(r.pending, id)
+}
+
+// fragmentPacket splits a packet into fragment payloads of at most maxPayload bytes
+func fragmentPacket(id uint32, packet []byte, maxPayload int) ([][]byte, error) {
+	chunk := maxPayload - fragmentHeaderLen
+	if chunk <= 0 {
+		return nil, fmt.Errorf("payload limit %d too small to fragment", maxPayload)
+	}
+
+	count := (len(packet) + chunk - 1) / chunk
+	if count > maxFragments {
+		return nil, fmt.Errorf("packet of %d bytes needs %d fragments", len(packet), count)
+	}
+
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunk
+		if end > len(packet) {
+			end = len(packet)
+		}
+		data := packet[i*chunk : end]
+
+		fragment := make([]byte, fragmentHeaderLen+len(data))
+		binary.BigEndian.PutUint32(fragment[0:4], id)
+		fragment[4] = byte(i)
+		fragment[5] = byte(count)
+		copy(fragment[fragmentHeaderLen:], data)
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+// effectiveMTU returns the largest packet that crosses the tunnel without fragmentation
+func effectiveMTU(mtu, maxPayload int) int {
+	if maxPayload > 0 && maxPayload < mtu {
+		return maxPayload
+	}
+	return mtu
+}
@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// fragmentHeader returns a fragment of packet id carrying data
+func fragmentHeader(id uint32, index, count int, data []byte) []byte {
+	fragment := make([]byte, fragmentHeaderLen, fragmentHeaderLen+len(data))
+	binary.BigEndian.PutUint32(fragment[0:4], id)
+	fragment[4] = byte(index)
+	fragment[5] = byte(count)
+	return append(fragment, data...)
+}
+
+func TestReassemblerRebuildsPacket(t *testing.T) {
+	packet := bytes.Repeat([]byte("tuno"), 100)
+	fragments, err := fragmentPacket(7, packet, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReassembler()
+	for i := len(fragments) - 1; i >= 0; i-- {
+		got, err := r.Add(fragments[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && got != nil {
+			t.Fatalf("packet returned after %d of %d fragments", len(fragments)-i, len(fragments))
+		}
+		if i == 0 && !bytes.Equal(got, packet) {
+			t.Errorf("rebuilt packet = %q; want %q", got, packet)
+		}
+	}
+	if len(r.pending) != 0 || r.memory != 0 {
+		t.Errorf("%d packets and %d bytes left pending", len(r.pending), r.memory)
+	}
+}
+
+func TestReassemblerBoundsPendingPackets(t *testing.T) {
+	r := NewReassembler()
+
+	// First fragments of packets that never complete, each with the most fragment slots
+	for id := uint32(0); id < 4*reassemblyMaxPending; id++ {
+		if _, err := r.Add(fragmentHeader(id, 0, maxFragments, []byte{1})); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.pending) > reassemblyMaxPending {
+			t.Fatalf("%d packets pending; want at most %d", len(r.pending), reassemblyMaxPending)
+		}
+	}
+
+	want := 0
+	for _, partial := range r.pending {
+		want += partial.size + maxFragments*fragmentSlotSize
+	}
+	if r.memory != want {
+		t.Errorf("memory = %d; want %d counting fragment slots", r.memory, want)
+	}
+	if r.Dropped() != 3*reassemblyMaxPending {
+		t.Errorf("dropped %d; want %d", r.Dropped(), 3*reassemblyMaxPending)
+	}
+}
+
+func TestReassemblerMemoryLimit(t *testing.T) {
+	r := NewReassembler()
+	r.maxMemory = 4 * maxFragments * fragmentSlotSize
+
+	// Fragment slots alone fill the limit, so older packets make room for new ones
+	for id := uint32(0); id < 10; id++ {
+		if _, err := r.Add(fragmentHeader(id, 0, maxFragments, []byte{1})); err != nil {
+			t.Fatal(err)
+		}
+		if r.memory > r.maxMemory {
+			t.Fatalf("memory = %d; want at most %d", r.memory, r.maxMemory)
+		}
+	}
+	if len(r.pending) != 3 {
+		t.Errorf("%d packets pending; want 3", len(r.pending))
+	}
+}
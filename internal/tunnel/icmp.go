@@ -0,0 +1,252 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// ICMP protocol numbers
+	protocolICMPv4 = 1
+	protocolICMPv6 = 58
+
+	// Length of the ICMP header including the 4-byte rest-of-header field
+	icmpHeaderLen = 8
+	// Default hop limit for generated packets
+	icmpHopLimit = 64
+
+	// Generated ICMPv4 errors must fit in 576 bytes (RFC 1812)
+	icmpv4MaxLen = 576
+	// Generated ICMPv6 errors must fit in the IPv6 minimum MTU (RFC 4443)
+	icmpv6MaxLen = 1280
+)
+
+// ICMPErrorType identifies the kind of ICMP error to generate
+type ICMPErrorType int
+
+const (
+	// ICMPTimeExceeded reports that the TTL or Hop Limit reached zero in transit
+	ICMPTimeExceeded ICMPErrorType = iota
+	// ICMPHostUnreachable reports that no route exists to the destination
+	ICMPHostUnreachable
+	// ICMPPacketTooBig reports that the packet exceeds the next-hop MTU
+	// (Fragmentation Needed for IPv4, Packet Too Big for IPv6)
+	ICMPPacketTooBig
+	// ICMPAdminProhibited reports that policy forbids reaching the destination
+	ICMPAdminProhibited
+)
+
+// String returns a human readable name for the error type
+func (t ICMPErrorType) String() string {
+	switch t {
+	case ICMPTimeExceeded:
+		return "time exceeded"
+	case ICMPHostUnreachable:
+		return "host unreachable"
+	case ICMPPacketTooBig:
+		return "packet too big"
+	case ICMPAdminProhibited:
+		return "administratively prohibited"
+	default:
+		return "unknown"
+	}
+}
+
+// ICMPGenerator builds rate-limited ICMP error messages
+type ICMPGenerator struct {
+	limiter *rate.Limiter
+}
+
+// NewICMPGenerator creates a generator allowing up to perSecond messages per second
+// A non-positive rate disables ICMP error generation
+func NewICMPGenerator(perSecond int) *ICMPGenerator {
+	if perSecond <= 0 {
+		return &ICMPGenerator{}
+	}
+	return &ICMPGenerator{
+		limiter: rate.NewLimiter(rate.Limit(perSecond), perSecond),
+	}
+}
+
+// Generate builds an ICMP error for the offending packet, sourced from the given address
+// mtu is only used for ICMPPacketTooBig. It returns nil if no error should be sent,
+// either because the packet is not eligible or because the rate limit was hit.
+func (g *ICMPGenerator) Generate(original *Packet, errType ICMPErrorType, source net.IP, mtu int) []byte {
+	if g.limiter == nil || source == nil || !canSendICMPError(original) {
+		return nil
+	}
+	if !g.limiter.Allow() {
+		return nil
+	}
+
+	data, err := BuildICMPError(original, errType, source, mtu)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// canSendICMPError checks the RFC 1812 / RFC 4443 rules for when an error may be generated
+func canSendICMPError(p *Packet) bool {
+	// Never answer non-first fragments
+	if p.IsFragment() {
+		return false
+	}
+
+	// Never answer packets from unspecified, loopback or multicast sources
+	if p.Source.IsUnspecified() || p.Source.IsLoopback() || p.Source.IsMulticast() {
+		return false
+	}
+
+	// Never answer multicast or broadcast destinations
+	if p.Destination.IsMulticast() || p.Destination.Equal(net.IPv4bcast) {
+		return false
+	}
+
+	// Never answer ICMP error messages
+	switch p.Type {
+	case PacketTypeIPv4:
+		if p.Protocol == protocolICMPv4 {
+			ihl := int(p.Data[0]&0x0F) * 4
+			if len(p.Data) <= ihl {
+				return false
+			}
+			switch ipv4.ICMPType(p.Data[ihl]) {
+			case ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply:
+				return true
+			default:
+				return false
+			}
+		}
+	case PacketTypeIPv6:
+		if p.Protocol == protocolICMPv6 {
+			// ICMPv6 error messages have types below 128
+			if len(p.Data) <= ipv6.HeaderLen || p.Data[ipv6.HeaderLen] < 128 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// BuildICMPError builds a complete IP packet carrying an ICMP error for the original packet
+// The error is addressed to the original sender and sourced from source.
+func BuildICMPError(original *Packet, errType ICMPErrorType, source net.IP, mtu int) ([]byte, error) {
+	switch original.Type {
+	case PacketTypeIPv4:
+		src := source.To4()
+		if src == nil {
+			return nil, fmt.Errorf("ICMPv4 error requires an IPv4 source address")
+		}
+		return buildICMPv4Error(original, errType, src, mtu)
+	case PacketTypeIPv6:
+		if source.To4() != nil {
+			return nil, fmt.Errorf("ICMPv6 error requires an IPv6 source address")
+		}
+		return buildICMPv6Error(original, errType, source.To16(), mtu)
+	default:
+		return nil, fmt.Errorf("unsupported packet type")
+	}
+}
+
+// buildICMPv4Error builds an IPv4 packet carrying an ICMPv4 error
+func buildICMPv4Error(original *Packet, errType ICMPErrorType, source net.IP, mtu int) ([]byte, error) {
+	var icmpType, icmpCode byte
+	var restOfHeader uint32
+
+	switch errType {
+	case ICMPTimeExceeded:
+		icmpType, icmpCode = byte(ipv4.ICMPTypeTimeExceeded), 0 // TTL exceeded in transit
+	case ICMPHostUnreachable:
+		icmpType, icmpCode = byte(ipv4.ICMPTypeDestinationUnreachable), 1 // Host unreachable
+	case ICMPPacketTooBig:
+		icmpType, icmpCode = byte(ipv4.ICMPTypeDestinationUnreachable), 4 // Fragmentation needed
+		restOfHeader = uint32(mtu) & 0xFFFF                               // Next-hop MTU (RFC 1191)
+	case ICMPAdminProhibited:
+		icmpType, icmpCode = byte(ipv4.ICMPTypeDestinationUnreachable), 13 // Communication administratively prohibited
+	default:
+		return nil, fmt.Errorf("unsupported ICMP error type: %v", errType)
+	}
+
+	// Quote as much of the original packet as fits
+	quote := original.Data
+	if max := icmpv4MaxLen - ipv4.HeaderLen - icmpHeaderLen; len(quote) > max {
+		quote = quote[:max]
+	}
+
+	totalLen := ipv4.HeaderLen + icmpHeaderLen + len(quote)
+	pkt := make([]byte, totalLen)
+
+	// IPv4 header
+	pkt[0] = 0x45 // Version 4, IHL 5
+	pkt[1] = 0xC0 // Internetwork control precedence
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(totalLen))
+	pkt[8] = icmpHopLimit
+	pkt[9] = protocolICMPv4
+	copy(pkt[12:16], source)
+	copy(pkt[16:20], original.Source.To4())
+	binary.BigEndian.PutUint16(pkt[10:12], checksumFold(checksumAdd(0, pkt[:ipv4.HeaderLen])))
+
+	// ICMP message
+	msg := pkt[ipv4.HeaderLen:]
+	msg[0] = icmpType
+	msg[1] = icmpCode
+	binary.BigEndian.PutUint32(msg[4:8], restOfHeader)
+	copy(msg[icmpHeaderLen:], quote)
+	binary.BigEndian.PutUint16(msg[2:4], checksumFold(checksumAdd(0, msg)))
+
+	return pkt, nil
+}
+
+// buildICMPv6Error builds an IPv6 packet carrying an ICMPv6 error
+func buildICMPv6Error(original *Packet, errType ICMPErrorType, source net.IP, mtu int) ([]byte, error) {
+	var icmpType, icmpCode byte
+	var restOfHeader uint32
+
+	switch errType {
+	case ICMPTimeExceeded:
+		icmpType, icmpCode = byte(ipv6.ICMPTypeTimeExceeded), 0 // Hop limit exceeded in transit
+	case ICMPHostUnreachable:
+		icmpType, icmpCode = byte(ipv6.ICMPTypeDestinationUnreachable), 3 // Address unreachable
+	case ICMPPacketTooBig:
+		icmpType, icmpCode = byte(ipv6.ICMPTypePacketTooBig), 0
+		restOfHeader = uint32(mtu) // MTU of the next-hop link
+	case ICMPAdminProhibited:
+		icmpType, icmpCode = byte(ipv6.ICMPTypeDestinationUnreachable), 1 // Administratively prohibited
+	default:
+		return nil, fmt.Errorf("unsupported ICMP error type: %v", errType)
+	}
+
+	// Quote as much of the original packet as fits
+	quote := original.Data
+	if max := icmpv6MaxLen - ipv6.HeaderLen - icmpHeaderLen; len(quote) > max {
+		quote = quote[:max]
+	}
+
+	payloadLen := icmpHeaderLen + len(quote)
+	pkt := make([]byte, ipv6.HeaderLen+payloadLen)
+
+	// IPv6 header
+	pkt[0] = 0x60 // Version 6
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(payloadLen))
+	pkt[6] = protocolICMPv6
+	pkt[7] = icmpHopLimit
+	copy(pkt[8:24], source)
+	copy(pkt[24:40], original.Source.To16())
+
+	// ICMPv6 message, checksummed over the pseudo-header
+	msg := pkt[ipv6.HeaderLen:]
+	msg[0] = icmpType
+	msg[1] = icmpCode
+	binary.BigEndian.PutUint32(msg[4:8], restOfHeader)
+	copy(msg[icmpHeaderLen:], quote)
+	sum := pseudoHeaderSum(source, original.Source, protocolICMPv6, payloadLen)
+	binary.BigEndian.PutUint16(msg[2:4], checksumFold(checksumAdd(sum, msg)))
+
+	return pkt, nil
+}
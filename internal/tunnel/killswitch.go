@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// killSwitchTable is the nftables table holding the kill switch rules
+// It survives a crashed client on purpose, so that traffic stays blocked
+// until the client is restarted or the table is deleted by hand.
+const killSwitchTable = "tuno_killswitch"
+
+// Networks reachable outside the tunnel when the LAN is allowed
+var (
+	lanNetworks4 = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16"}
+	lanNetworks6 = []string{"fe80::/10", "fc00::/7"}
+)
+
+// KillSwitch blocks all traffic that does not go through the tunnel
+// Only the TUN device, loopback, the server endpoint and optionally the LAN
+// are reachable. The rules stay in place across reconnects. A nil
+// KillSwitch is valid and does nothing.
+type KillSwitch struct {
+	device   string
+	allowLAN bool
+	enabled  bool
+	mutex    sync.Mutex
+	logger   *logrus.Logger
+}
+
+// NewKillSwitch creates a kill switch for the given TUN device
+// Returns nil if the kill switch is disabled.
+func NewKillSwitch(enabled bool, device string, allowLAN bool, logger *logrus.Logger) *KillSwitch {
+	if !enabled {
+		return nil
+	}
+	return &KillSwitch{
+		device:   device,
+		allowLAN: allowLAN,
+		logger:   logger,
+	}
+}
+
+// Enable installs the kill switch rules, replacing any left by a previous client
+// IPv6 is blocked entirely unless the tunnel carries it.
+func (k *KillSwitch) Enable(servers []net.IP, port int, tunnelIPv6 bool) error {
+	if k == nil {
+		return nil
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	var script bytes.Buffer
+
+	// Declare and delete first so the table is replaced atomically
+	fmt.Fprintf(&script, "table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&script, "delete table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&script, "table inet %s {\n", killSwitchTable)
+	fmt.Fprintf(&script, "\tset servers4 { type ipv4_addr; }\n")
+	fmt.Fprintf(&script, "\tset servers6 { type ipv6_addr; }\n")
+
+	for _, hook := range []string{"output", "input"} {
+		iface, addr, service := "oifname", "daddr", "dport"
+		if hook == "input" {
+			iface, addr, service = "iifname", "saddr", "sport"
+		}
+
+		fmt.Fprintf(&script, "\tchain %s {\n", hook)
+		fmt.Fprintf(&script, "\t\ttype filter hook %s priority 0; policy drop;\n", hook)
+		fmt.Fprintf(&script, "\t\t%s \"lo\" accept\n", iface)
+		if !tunnelIPv6 {
+			fmt.Fprintf(&script, "\t\tmeta nfproto ipv6 drop\n")
+		}
+		fmt.Fprintf(&script, "\t\t%s %q accept\n", iface, k.device)
+		fmt.Fprintf(&script, "\t\tip %s @servers4 meta l4proto { tcp, udp } th %s %d accept\n", addr, service, port)
+		fmt.Fprintf(&script, "\t\tip6 %s @servers6 meta l4proto { tcp, udp } th %s %d accept\n", addr, service, port)
+
+		// DHCP keeps the physical link configured
+		fmt.Fprintf(&script, "\t\tudp sport { 67, 68 } udp dport { 67, 68 } accept\n")
+
+		if k.allowLAN {
+			fmt.Fprintf(&script, "\t\tip %s { %s } accept\n", addr, strings.Join(lanNetworks4, ", "))
+			fmt.Fprintf(&script, "\t\tip6 %s { %s } accept\n", addr, strings.Join(lanNetworks6, ", "))
+		}
+		fmt.Fprintf(&script, "\t}\n")
+	}
+	fmt.Fprintf(&script, "}\n")
+
+	if err := runNFT(script.String()); err != nil {
+		return fmt.Errorf("failed to install kill switch: %v", err)
+	}
+	k.enabled = true
+
+	if err := k.allowServers(servers); err != nil {
+		return err
+	}
+
+	k.logger.Info("Kill switch enabled, traffic outside the tunnel is blocked")
+	return nil
+}
+
+// AllowServers permits traffic to additional server addresses
+// Used when the server resolves to a new address on reconnect.
+func (k *KillSwitch) AllowServers(servers []net.IP) error {
+	if k == nil {
+		return nil
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if !k.enabled {
+		return nil
+	}
+	return k.allowServers(servers)
+}
+
+// allowServers adds server addresses to the kill switch sets
+func (k *KillSwitch) allowServers(servers []net.IP) error {
+	var v4, v6 []string
+	for _, ip := range servers {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+
+	var script bytes.Buffer
+	if len(v4) > 0 {
+		fmt.Fprintf(&script, "add element inet %s servers4 { %s }\n", killSwitchTable, strings.Join(v4, ", "))
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(&script, "add element inet %s servers6 { %s }\n", killSwitchTable, strings.Join(v6, ", "))
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+
+	if err := runNFT(script.String()); err != nil {
+		return fmt.Errorf("failed to allow server addresses: %v", err)
+	}
+	return nil
+}
+
+// Disable removes the kill switch rules
+func (k *KillSwitch) Disable() error {
+	if k == nil {
+		return nil
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if !k.enabled {
+		return nil
+	}
+
+	if err := deleteNFTTable(killSwitchTable); err != nil {
+		return fmt.Errorf("failed to remove kill switch: %v", err)
+	}
+	k.enabled = false
+
+	k.logger.Info("Kill switch disabled")
+	return nil
+}
+
+// runNFT applies an nftables script
+func runNFT(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// deleteNFTTable removes an inet table, succeeding if it does not exist
+// Declaring the table first makes the delete valid either way.
+func deleteNFTTable(name string) error {
+	return runNFT(fmt.Sprintf("table inet %s\ndelete table inet %s\n", name, name))
+}
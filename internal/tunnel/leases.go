@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Name of the server state file holding address and prefix leases
+const leaseStateFile = "leases.json"
+
+// leaseState is the on-disk form of the server's leases
+type leaseState struct {
+	Addresses  []Lease `json:"addresses,omitempty"`
+	Addresses6 []Lease `json:"addresses6,omitempty"`
+	Prefixes   []Lease `json:"prefixes,omitempty"`
+}
+
+// loadLeaseState reads the lease state file, which may not exist yet
+func loadLeaseState(path string) (*leaseState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &leaseState{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease state: %v", err)
+	}
+
+	var state leaseState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid lease state %s: %v", path, err)
+	}
+	return &state, nil
+}
+
+// saveLeaseState writes the lease state file
+func saveLeaseState(path string, state *leaseState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode lease state: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write lease state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package tunnel
+
+import (
+	"math/bits"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// lpmNode is a node of a path-compressed binary trie
+// Nodes are never modified once published; writers copy the path they change.
+type lpmNode[T any] struct {
+	prefix   netip.Prefix
+	value    T
+	hasValue bool
+	children [2]*lpmNode[T]
+}
+
+// lpmSnapshot is an immutable version of the table
+type lpmSnapshot[T any] struct {
+	v4     *lpmNode[T]
+	v6     *lpmNode[T]
+	count4 int
+	count6 int
+}
+
+// PrefixTable is a longest-prefix-match table for IPv4 and IPv6 prefixes
+// Lookups are lock-free and read an immutable snapshot; writers are serialised
+// and publish a new snapshot sharing all unchanged nodes with the previous one.
+type PrefixTable[T any] struct {
+	snapshot atomic.Pointer[lpmSnapshot[T]]
+	mutex    sync.Mutex
+}
+
+// NewPrefixTable creates an empty prefix table
+func NewPrefixTable[T any]() *PrefixTable[T] {
+	t := &PrefixTable[T]{}
+	t.snapshot.Store(&lpmSnapshot[T]{})
+	return t
+}
+
+// Lookup returns the value of the longest prefix containing addr
+func (t *PrefixTable[T]) Lookup(addr netip.Addr) (T, netip.Prefix, bool) {
+	var zero T
+	addr = addr.Unmap()
+	snap := t.snapshot.Load()
+
+	node := snap.v4
+	if addr.Is6() {
+		node = snap.v6
+	}
+
+	var best *lpmNode[T]
+	for node != nil && node.prefix.Contains(addr) {
+		if node.hasValue {
+			best = node
+		}
+		if node.prefix.Bits() == addr.BitLen() {
+			break
+		}
+		node = node.children[addrBit(addr, node.prefix.Bits())]
+	}
+
+	if best == nil {
+		return zero, netip.Prefix{}, false
+	}
+	return best.value, best.prefix, true
+}
+
+// LookupIP is Lookup for a net.IP
+func (t *PrefixTable[T]) LookupIP(ip net.IP) (T, bool) {
+	var zero T
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return zero, false
+	}
+	value, _, found := t.Lookup(addr)
+	return value, found
+}
+
+// Get returns the value stored for exactly the given prefix
+func (t *PrefixTable[T]) Get(prefix netip.Prefix) (T, bool) {
+	var zero T
+	prefix = normalizePrefix(prefix)
+	snap := t.snapshot.Load()
+
+	node := snap.v4
+	if prefix.Addr().Is6() {
+		node = snap.v6
+	}
+
+	for node != nil && node.prefix.Bits() <= prefix.Bits() && node.prefix.Contains(prefix.Addr()) {
+		if node.prefix == prefix {
+			if node.hasValue {
+				return node.value, true
+			}
+			break
+		}
+		node = node.children[addrBit(prefix.Addr(), node.prefix.Bits())]
+	}
+	return zero, false
+}
+
+// Insert adds or replaces the value for a prefix
+// Returns true if the prefix was not present before.
+func (t *PrefixTable[T]) Insert(prefix netip.Prefix, value T) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	snap := *t.snapshot.Load()
+	added := snap.insert(normalizePrefix(prefix), value)
+	t.snapshot.Store(&snap)
+	return added
+}
+
+// Delete removes a prefix, returning true if it was present
+func (t *PrefixTable[T]) Delete(prefix netip.Prefix) bool {
+	return t.DeleteFunc(prefix, nil)
+}
+
+// DeleteFunc removes a prefix if match returns true for its current value
+// A nil match removes the prefix unconditionally.
+func (t *PrefixTable[T]) DeleteFunc(prefix netip.Prefix, match func(T) bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	prefix = normalizePrefix(prefix)
+	if match != nil {
+		value, ok := t.Get(prefix)
+		if !ok || !match(value) {
+			return false
+		}
+	}
+
+	snap := *t.snapshot.Load()
+	removed := snap.delete(prefix)
+	if removed {
+		t.snapshot.Store(&snap)
+	}
+	return removed
+}
+
+// Update removes and inserts many prefixes as a single change
+// Deletions are applied before insertions. Lookups see the table either
+// before or after the whole update, never in between.
+func (t *PrefixTable[T]) Update(deletes []netip.Prefix, inserts map[netip.Prefix]T) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	snap := *t.snapshot.Load()
+	for _, prefix := range deletes {
+		snap.delete(normalizePrefix(prefix))
+	}
+	for prefix, value := range inserts {
+		snap.insert(normalizePrefix(prefix), value)
+	}
+	t.snapshot.Store(&snap)
+}
+
+// Clear removes every prefix
+func (t *PrefixTable[T]) Clear() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.snapshot.Store(&lpmSnapshot[T]{})
+}
+
+// Len returns the number of IPv4 and IPv6 prefixes in the table
+func (t *PrefixTable[T]) Len() (int, int) {
+	snap := t.snapshot.Load()
+	return snap.count4, snap.count6
+}
+
+// Walk calls fn for every prefix in the table, IPv4 first, in address order
+// Iteration stops if fn returns false.
+func (t *PrefixTable[T]) Walk(fn func(netip.Prefix, T) bool) {
+	snap := t.snapshot.Load()
+	if walkNode(snap.v4, fn) {
+		walkNode(snap.v6, fn)
+	}
+}
+
+// walkNode walks a subtree in order, returning false if iteration was stopped
+func walkNode[T any](n *lpmNode[T], fn func(netip.Prefix, T) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.hasValue && !fn(n.prefix, n.value) {
+		return false
+	}
+	return walkNode(n.children[0], fn) && walkNode(n.children[1], fn)
+}
+
+// insert adds a prefix to the snapshot, copying the modified path
+func (s *lpmSnapshot[T]) insert(prefix netip.Prefix, value T) bool {
+	var added bool
+	if prefix.Addr().Is4() {
+		s.v4, added = insertNode(s.v4, prefix, value)
+		if added {
+			s.count4++
+		}
+	} else {
+		s.v6, added = insertNode(s.v6, prefix, value)
+		if added {
+			s.count6++
+		}
+	}
+	return added
+}
+
+// delete removes a prefix from the snapshot, copying the modified path
+func (s *lpmSnapshot[T]) delete(prefix netip.Prefix) bool {
+	var removed bool
+	if prefix.Addr().Is4() {
+		s.v4, removed = deleteNode(s.v4, prefix)
+		if removed {
+			s.count4--
+		}
+	} else {
+		s.v6, removed = deleteNode(s.v6, prefix)
+		if removed {
+			s.count6--
+		}
+	}
+	return removed
+}
+
+// insertNode returns a copy of the subtree rooted at n with prefix added
+func insertNode[T any](n *lpmNode[T], prefix netip.Prefix, value T) (*lpmNode[T], bool) {
+	leaf := &lpmNode[T]{prefix: prefix, value: value, hasValue: true}
+	if n == nil {
+		return leaf, true
+	}
+
+	common := commonPrefixLen(n.prefix, prefix)
+	switch {
+	case common == n.prefix.Bits() && common == prefix.Bits():
+		// Same prefix, replace the value
+		c := *n
+		c.value = value
+		c.hasValue = true
+		return &c, !n.hasValue
+
+	case common == n.prefix.Bits():
+		// New prefix lies below this node
+		c := *n
+		bit := addrBit(prefix.Addr(), common)
+		var added bool
+		c.children[bit], added = insertNode(n.children[bit], prefix, value)
+		return &c, added
+
+	case common == prefix.Bits():
+		// This node lies below the new prefix
+		leaf.children[addrBit(n.prefix.Addr(), common)] = n
+		return leaf, true
+
+	default:
+		// The prefixes diverge, join them under a new branch node
+		branch := &lpmNode[T]{prefix: netip.PrefixFrom(prefix.Addr(), common).Masked()}
+		branch.children[addrBit(n.prefix.Addr(), common)] = n
+		branch.children[addrBit(prefix.Addr(), common)] = leaf
+		return branch, true
+	}
+}
+
+// deleteNode returns a copy of the subtree rooted at n with prefix removed
+func deleteNode[T any](n *lpmNode[T], prefix netip.Prefix) (*lpmNode[T], bool) {
+	if n == nil || n.prefix.Bits() > prefix.Bits() || !n.prefix.Contains(prefix.Addr()) {
+		return n, false
+	}
+
+	if n.prefix == prefix {
+		if !n.hasValue {
+			return n, false
+		}
+		c := *n
+		var zero T
+		c.value = zero
+		c.hasValue = false
+		return compactNode(&c), true
+	}
+
+	bit := addrBit(prefix.Addr(), n.prefix.Bits())
+	child, removed := deleteNode(n.children[bit], prefix)
+	if !removed {
+		return n, false
+	}
+	c := *n
+	c.children[bit] = child
+	return compactNode(&c), true
+}
+
+// compactNode removes branch nodes that no longer join two subtrees
+func compactNode[T any](n *lpmNode[T]) *lpmNode[T] {
+	if n.hasValue {
+		return n
+	}
+	switch {
+	case n.children[0] == nil:
+		return n.children[1]
+	case n.children[1] == nil:
+		return n.children[0]
+	default:
+		return n
+	}
+}
+
+// addrBit returns bit i of the address, counting from the most significant bit
+func addrBit(addr netip.Addr, i int) int {
+	if addr.Is4() {
+		b := addr.As4()
+		return int(b[i/8]>>(7-uint(i%8))) & 1
+	}
+	b := addr.As16()
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+// commonPrefixLen returns the number of leading bits two prefixes share
+func commonPrefixLen(a, b netip.Prefix) int {
+	limit := a.Bits()
+	if b.Bits() < limit {
+		limit = b.Bits()
+	}
+
+	var x, y []byte
+	if a.Addr().Is4() {
+		a4, b4 := a.Addr().As4(), b.Addr().As4()
+		x, y = a4[:], b4[:]
+	} else {
+		a16, b16 := a.Addr().As16(), b.Addr().As16()
+		x, y = a16[:], b16[:]
+	}
+
+	n := 0
+	for i := range x {
+		if diff := x[i] ^ y[i]; diff != 0 {
+			n += bits.LeadingZeros8(diff)
+			break
+		}
+		n += 8
+	}
+	if n > limit {
+		n = limit
+	}
+	return n
+}
+
+// normalizePrefix unmaps IPv4-mapped addresses and clears host bits
+func normalizePrefix(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr()
+	if addr.Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			bits = 0
+		}
+		return netip.PrefixFrom(addr.Unmap(), bits).Masked()
+	}
+	return prefix.Masked()
+}
+
+// prefixFromIPNet converts a net.IPNet into a normalised prefix
+func prefixFromIPNet(network *net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(network.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ones, _ := network.Mask.Size()
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, ones).Masked(), true
+}
+
+// hostPrefix returns the single-address prefix for an IP
+func hostPrefix(ip net.IP) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
@@ -0,0 +1,252 @@
+package tunnel
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixTableLookup(t *testing.T) {
+	table := NewPrefixTable[string]()
+	for prefix, value := range map[string]string{
+		"0.0.0.0/0":       "default",
+		"10.0.0.0/8":      "corp",
+		"10.1.0.0/16":     "branch",
+		"10.1.2.0/24":     "lab",
+		"10.1.2.3/32":     "host",
+		"::/0":            "default6",
+		"2001:db8::/32":   "doc",
+		"2001:db8:1::/48": "site",
+	} {
+		if !table.Insert(netip.MustParsePrefix(prefix), value) {
+			t.Fatalf("Insert(%s) reported an existing prefix", prefix)
+		}
+	}
+
+	tests := []struct {
+		addr   string
+		want   string
+		prefix string
+	}{
+		{"192.0.2.1", "default", "0.0.0.0/0"},
+		{"10.200.0.1", "corp", "10.0.0.0/8"},
+		{"10.1.9.9", "branch", "10.1.0.0/16"},
+		{"10.1.2.4", "lab", "10.1.2.0/24"},
+		{"10.1.2.3", "host", "10.1.2.3/32"},
+		{"2001:db8:2::1", "doc", "2001:db8::/32"},
+		{"2001:db8:1::1", "site", "2001:db8:1::/48"},
+		{"fe80::1", "default6", "::/0"},
+	}
+	for _, tt := range tests {
+		got, prefix, ok := table.Lookup(netip.MustParseAddr(tt.addr))
+		if !ok || got != tt.want || prefix != netip.MustParsePrefix(tt.prefix) {
+			t.Errorf("Lookup(%s) = %q, %s, %v; want %q, %s", tt.addr, got, prefix, ok, tt.want, tt.prefix)
+		}
+	}
+
+	// IPv4-mapped addresses match IPv4 prefixes
+	if got, ok := table.LookupIP(net.ParseIP("10.1.2.3").To16()); !ok || got != "host" {
+		t.Errorf("LookupIP(mapped 10.1.2.3) = %q, %v; want host", got, ok)
+	}
+
+	if n4, n6 := table.Len(); n4 != 5 || n6 != 3 {
+		t.Errorf("Len() = %d, %d; want 5, 3", n4, n6)
+	}
+}
+
+func TestPrefixTableInsertReplaces(t *testing.T) {
+	table := NewPrefixTable[int]()
+	prefix := netip.MustParsePrefix("192.168.1.0/24")
+
+	if !table.Insert(prefix, 1) {
+		t.Fatal("first Insert reported an existing prefix")
+	}
+	if table.Insert(netip.MustParsePrefix("192.168.1.77/24"), 2) {
+		t.Fatal("Insert of an unmasked duplicate reported a new prefix")
+	}
+	if got, ok := table.Get(prefix); !ok || got != 2 {
+		t.Errorf("Get() = %d, %v; want 2", got, ok)
+	}
+}
+
+func TestPrefixTableDelete(t *testing.T) {
+	table := NewPrefixTable[string]()
+	table.Insert(netip.MustParsePrefix("10.0.0.0/8"), "corp")
+	table.Insert(netip.MustParsePrefix("10.1.0.0/16"), "branch")
+
+	if table.Delete(netip.MustParsePrefix("10.2.0.0/16")) {
+		t.Error("Delete of a missing prefix reported success")
+	}
+	if !table.Delete(netip.MustParsePrefix("10.1.0.0/16")) {
+		t.Fatal("Delete of an existing prefix failed")
+	}
+	if got, _, _ := table.Lookup(netip.MustParseAddr("10.1.0.1")); got != "corp" {
+		t.Errorf("Lookup after Delete = %q; want corp", got)
+	}
+
+	if table.DeleteFunc(netip.MustParsePrefix("10.0.0.0/8"), func(v string) bool { return v == "other" }) {
+		t.Error("DeleteFunc removed a prefix whose value did not match")
+	}
+	if !table.DeleteFunc(netip.MustParsePrefix("10.0.0.0/8"), func(v string) bool { return v == "corp" }) {
+		t.Error("DeleteFunc kept a prefix whose value matched")
+	}
+	if _, _, ok := table.Lookup(netip.MustParseAddr("10.1.0.1")); ok {
+		t.Error("Lookup in an empty table succeeded")
+	}
+}
+
+func TestPrefixTableUpdate(t *testing.T) {
+	table := NewPrefixTable[string]()
+	table.Insert(netip.MustParsePrefix("10.0.0.0/24"), "old")
+	table.Insert(netip.MustParsePrefix("10.0.1.0/24"), "kept")
+
+	// Snapshots taken before an update keep seeing the old table
+	before := table.snapshot.Load()
+
+	table.Update(
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+		map[netip.Prefix]string{
+			netip.MustParsePrefix("10.0.0.0/25"): "new",
+			netip.MustParsePrefix("fd00::/64"):   "new6",
+		},
+	)
+
+	for addr, want := range map[string]string{
+		"10.0.0.1":   "new",
+		"10.0.1.1":   "kept",
+		"fd00::1":    "new6",
+		"10.0.0.200": "",
+	} {
+		got, _, _ := table.Lookup(netip.MustParseAddr(addr))
+		if got != want {
+			t.Errorf("Lookup(%s) = %q; want %q", addr, got, want)
+		}
+	}
+
+	if before.count4 != 2 || before.count6 != 0 {
+		t.Errorf("snapshot before Update changed to %d, %d prefixes", before.count4, before.count6)
+	}
+	if n4, n6 := table.Len(); n4 != 2 || n6 != 1 {
+		t.Errorf("Len() = %d, %d; want 2, 1", n4, n6)
+	}
+}
+
+func TestPrefixTableMatchesLinearScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	table := NewPrefixTable[int]()
+	reference := make(map[netip.Prefix]int)
+
+	for i := 0; i < 5000; i++ {
+		prefix := randomPrefix(r, r.Intn(2) == 0)
+		if r.Intn(3) == 0 {
+			_, had := reference[prefix]
+			if table.Delete(prefix) != had {
+				t.Fatalf("Delete(%s) disagrees with the reference", prefix)
+			}
+			delete(reference, prefix)
+			continue
+		}
+		table.Insert(prefix, i)
+		reference[prefix] = i
+	}
+
+	for i := 0; i < 5000; i++ {
+		addr := randomPrefix(r, r.Intn(2) == 0).Addr()
+		want, bits := 0, -1
+		for prefix, value := range reference {
+			if prefix.Contains(addr) && prefix.Bits() > bits {
+				want, bits = value, prefix.Bits()
+			}
+		}
+		got, _, ok := table.Lookup(addr)
+		if ok != (bits >= 0) || got != want {
+			t.Fatalf("Lookup(%s) = %d, %v; want %d, %v", addr, got, ok, want, bits >= 0)
+		}
+	}
+}
+
+// randomPrefix returns a random prefix from a small part of the address space, so prefixes overlap
+func randomPrefix(r *rand.Rand, v6 bool) netip.Prefix {
+	if v6 {
+		var b [16]byte
+		r.Read(b[:4])
+		b[0] = 0x20
+		return netip.PrefixFrom(netip.AddrFrom16(b), r.Intn(33)).Masked()
+	}
+	var b [4]byte
+	r.Read(b[:])
+	b[0] &= 0x0F
+	return netip.PrefixFrom(netip.AddrFrom4(b), r.Intn(33)).Masked()
+}
+
+// benchmarkTable returns a table of random IPv4 routes and client host addresses, and addresses to look up
+func benchmarkTable(routes, clients int) (*PrefixTable[int], []netip.Addr) {
+	r := rand.New(rand.NewSource(1))
+	table := NewPrefixTable[int]()
+	for i := 0; i < routes; i++ {
+		var b [4]byte
+		r.Read(b[:])
+		table.Insert(netip.PrefixFrom(netip.AddrFrom4(b), 8+r.Intn(17)).Masked(), i)
+	}
+	for i := 0; i < clients; i++ {
+		addr := netip.AddrFrom4([4]byte{100, 64, byte(i >> 8), byte(i)})
+		table.Insert(netip.PrefixFrom(addr, 32), routes+i)
+	}
+
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		var b [4]byte
+		r.Read(b[:])
+		if i%2 == 0 && clients > 0 {
+			b = [4]byte{100, 64, byte(i % clients >> 8), byte(i % clients)}
+		}
+		addrs[i] = netip.AddrFrom4(b)
+	}
+	return table, addrs
+}
+
+func BenchmarkPrefixTableLookup10kRoutes1kClients(b *testing.B) {
+	table, addrs := benchmarkTable(10000, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Lookup(addrs[i%len(addrs)])
+	}
+}
+
+func BenchmarkPrefixTableLookupParallel(b *testing.B) {
+	table, addrs := benchmarkTable(10000, 1000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			table.Lookup(addrs[i%len(addrs)])
+			i++
+		}
+	})
+}
+
+func BenchmarkPrefixTableInsertDelete(b *testing.B) {
+	table, _ := benchmarkTable(10000, 1000)
+	prefix := netip.MustParsePrefix("198.51.100.0/24")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Insert(prefix, i)
+		table.Delete(prefix)
+	}
+}
+
+func BenchmarkPrefixTableUpdate1kClients(b *testing.B) {
+	table, _ := benchmarkTable(10000, 1000)
+	inserts := make(map[netip.Prefix]int, 1000)
+	deletes := make([]netip.Prefix, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		prefix := netip.PrefixFrom(netip.AddrFrom4([4]byte{100, 64, byte(i >> 8), byte(i)}), 32)
+		inserts[prefix] = i
+		deletes = append(deletes, prefix)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Update(deletes, inserts)
+	}
+}
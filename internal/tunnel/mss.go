@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// TCP protocol number
+	protocolTCP = 6
+
+	// Minimum TCP header length
+	tcpHeaderLen = 20
+	// TCP flags
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	// TCP MSS option kind and length
+	tcpOptionMSS    = 2
+	tcpOptionMSSLen = 4
+
+	// Smallest MSS we will ever clamp to (RFC 879 default for IPv4)
+	minClampMSSv4 = 536
+	// Smallest IPv6 MSS, a segment in a packet of the IPv6 minimum MTU of 1280
+	minClampMSSv6 = 1220
+)
+
+// MSSClamper rewrites the MSS option of TCP SYN and SYN-ACK packets so that
+// segments fit in the tunnel without relying on path MTU discovery
+type MSSClamper struct {
+	// Fixed MSS to clamp to, or 0 to derive it from the tunnel MTU
+	mss int
+}
+
+// NewMSSClamper creates a clamper, returning nil if clamping is disabled
+// A zero mss derives the value from the tunnel MTU of each packet's family.
+func NewMSSClamper(enabled bool, mss int) *MSSClamper {
+	if !enabled {
+		return nil
+	}
+	return &MSSClamper{mss: mss}
+}
+
+// Clamp clamps the MSS of the packet for a tunnel with the given MTU
+// It is safe to call on a nil clamper. Returns true if the packet was modified.
+func (c *MSSClamper) Clamp(p *Packet, mtu int) bool {
+	if c == nil {
+		return false
+	}
+
+	mss := c.mss
+	if mss == 0 {
+		mss = MSSForMTU(mtu, p.Type == PacketTypeIPv6)
+	}
+	return p.ClampMSS(mss)
+}
+
+// MSSForMTU returns the largest TCP MSS that fits in a packet of the given MTU
+func MSSForMTU(mtu int, ipv6Packet bool) int {
+	if ipv6Packet {
+		return max(mtu-ipv6.HeaderLen-tcpHeaderLen, minClampMSSv6)
+	}
+	return max(mtu-ipv4.HeaderLen-tcpHeaderLen, minClampMSSv4)
+}
+
+// ClampMSS lowers the MSS option of a TCP SYN packet to at most mss,
+// fixing up the TCP checksum. Returns true if the packet was modified.
+func (p *Packet) ClampMSS(mss int) bool {
+	offset, protocol := p.TransportHeader()
+	if offset < 0 || protocol != protocolTCP || len(p.Data) < offset+tcpHeaderLen {
+		return false
+	}
+	tcp := p.Data[offset:]
+
+	// Only SYN and SYN-ACK segments carry the MSS option
+	if tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+
+	// Data offset gives the header length including options
+	headerLen := int(tcp[12]>>4) * 4
+	if headerLen < tcpHeaderLen || len(tcp) < headerLen {
+		return false
+	}
+
+	// Walk the options looking for MSS
+	options := tcp[tcpHeaderLen:headerLen]
+	for i := 0; i < len(options); {
+		kind := options[i]
+		switch kind {
+		case 0: // End of option list
+			return false
+		case 1: // No-operation
+			i++
+			continue
+		}
+
+		if i+1 >= len(options) {
+			return false
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			return false
+		}
+
+		if kind == tcpOptionMSS && length == tcpOptionMSSLen {
+			current := binary.BigEndian.Uint16(options[i+2 : i+4])
+			if int(current) <= mss {
+				return false
+			}
+
+			// Rewrite the option and patch the checksum at offset 16-17
+			binary.BigEndian.PutUint16(options[i+2:i+4], uint16(mss))
+			oldWord, newWord := current, uint16(mss)
+			if i%2 == 1 {
+				// A field at an odd offset contributes to the checksum byte-swapped
+				oldWord, newWord = bits.ReverseBytes16(oldWord), bits.ReverseBytes16(newWord)
+			}
+			checksum := binary.BigEndian.Uint16(tcp[16:18])
+			binary.BigEndian.PutUint16(tcp[16:18], checksumUpdate16(checksum, oldWord, newWord))
+			return true
+		}
+		i += length
+	}
+
+	return false
+}
@@ -0,0 +1,27 @@
+package tunnel
+
+import "testing"
+
+func TestMSSForMTU(t *testing.T) {
+	tests := []struct {
+		name       string
+		mtu        int
+		ipv6Packet bool
+		want       int
+	}{
+		{"IPv4", 1400, false, 1360},
+		{"IPv4 small MTU", 576, false, 536},
+		{"IPv4 below the floor", 400, false, 536},
+		{"IPv6", 1400, true, 1340},
+		{"IPv6 minimum MTU", 1280, true, 1220},
+		{"IPv6 below the floor", 1000, true, 1220},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MSSForMTU(tt.mtu, tt.ipv6Packet); got != tt.want {
+				t.Errorf("MSSForMTU(%d, %v) = %d; want %d", tt.mtu, tt.ipv6Packet, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,681 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// Well-known NAT64 prefix (RFC 6052)
+	DefaultNAT64Prefix = "64:ff9b::/96"
+	// Translated packets grow by this much on the way to IPv6 clients
+	nat64HeaderGrowth = ipv6.HeaderLen - ipv4.HeaderLen
+	// First port and ICMP identifier handed out to mappings
+	nat64FirstPort = 1024
+	// Idle time before an established TCP mapping is dropped (RFC 6146 established timeout)
+	nat64TCPTimeout = 2 * time.Hour
+	// Idle time before a TCP mapping that is opening or closing is dropped (RFC 6146 transitory timeout)
+	nat64TCPTransitoryTimeout = 4 * time.Minute
+	// How often expired mappings are removed
+	nat64SweepInterval = 10 * time.Second
+	// Most mappings a single client address may hold, so one client cannot use up the shared ports
+	nat64MaxMappingsPerClient = 4096
+)
+
+// nat64NonGlobal holds the IPv4 ranges that are not globally reachable (RFC 6890)
+// RFC 6052 forbids representing them with the well-known prefix; they are not
+// translated with any prefix, so clients cannot reach the server's networks through NAT64.
+var nat64NonGlobal = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// nat64Key identifies the IPv6 side of a mapping
+type nat64Key struct {
+	protocol int
+	addr     netip.Addr
+	port     uint16
+}
+
+// nat64Port identifies the IPv4 side of a mapping
+type nat64Port struct {
+	protocol int
+	port     uint16
+}
+
+// nat64Mapping binds an IPv6 client address and port to an IPv4 port
+// TCP mappings also follow the connection, which is established once the
+// IPv4 side answered a SYN and closed by a RST or a FIN in each direction.
+type nat64Mapping struct {
+	key         nat64Key
+	port        uint16
+	expires     time.Time
+	established bool
+	finOut      bool
+	finIn       bool
+	closed      bool
+}
+
+// NAT64 translates between IPv6-only clients and IPv4 destinations (RFC 6146)
+// IPv4 destinations are embedded in the last 32 bits of a /96 prefix. Client
+// addresses and ports, or ICMP echo identifiers, are mapped to ports of a
+// single IPv4 address, and replies to that address are translated back.
+// Packets with IPv6 extension headers and fragmented IPv4 packets are not
+// translated, and neither are packets for non-global or excluded addresses.
+type NAT64 struct {
+	prefix    netip.Prefix
+	addr      netip.Addr
+	timeout   time.Duration
+	excluded  []netip.Prefix
+	out       map[nat64Key]*nat64Mapping
+	in        map[nat64Port]*nat64Mapping
+	clients   map[netip.Addr]int
+	nextPort  uint16
+	nextID    uint16
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+// NewNAT64 creates a translator for a /96 prefix using addr as the IPv4 source
+// UDP and ICMP mappings are dropped after timeout without traffic. Packets
+// for the excluded prefixes, such as the tunnel network and the server's own
+// addresses, are never translated.
+func NewNAT64(prefix netip.Prefix, addr netip.Addr, timeout time.Duration, excluded ...netip.Prefix) (*NAT64, error) {
+	if !prefix.Addr().Is6() || prefix.Bits() != 96 {
+		return nil, fmt.Errorf("NAT64 prefix %s must be an IPv6 /96", prefix)
+	}
+	if !addr.Is4() {
+		return nil, fmt.Errorf("NAT64 address %s must be an IPv4 address", addr)
+	}
+
+	return &NAT64{
+		prefix:    prefix.Masked(),
+		addr:      addr,
+		timeout:   timeout,
+		excluded:  append(append([]netip.Prefix{}, nat64NonGlobal...), excluded...),
+		out:       make(map[nat64Key]*nat64Mapping),
+		in:        make(map[nat64Port]*nat64Mapping),
+		clients:   make(map[netip.Addr]int),
+		nextPort:  nat64FirstPort,
+		lastSweep: time.Now(),
+	}, nil
+}
+
+// Prefix returns the prefix IPv4 addresses are embedded in
+func (n *NAT64) Prefix() netip.Prefix {
+	return n.prefix
+}
+
+// Address returns the IPv4 source address of translated packets
+func (n *NAT64) Address() netip.Addr {
+	return n.addr
+}
+
+// Outbound reports whether a packet from a client is for an IPv4 destination
+func (n *NAT64) Outbound(p *Packet) bool {
+	addr, ok := netip.AddrFromSlice(p.Destination)
+	return ok && p.Type == PacketTypeIPv6 && n.prefix.Contains(addr)
+}
+
+// Inbound reports whether a packet from the TUN device is for a mapping
+func (n *NAT64) Inbound(p *Packet) bool {
+	addr, ok := netip.AddrFromSlice(p.Destination)
+	return ok && p.Type == PacketTypeIPv4 && addr.Unmap() == n.addr
+}
+
+// Len returns the number of active mappings
+func (n *NAT64) Len() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return len(n.out)
+}
+
+// TranslateOut translates an IPv6 packet from a client into an IPv4 packet
+func (n *NAT64) TranslateOut(p *Packet) ([]byte, error) {
+	offset, protocol := p.TransportHeader()
+	if offset != ipv6.HeaderLen {
+		return nil, fmt.Errorf("IPv6 packets with extension headers are not translated")
+	}
+
+	src, _ := netip.AddrFromSlice(p.Source)
+	dst := n.extract(p.Destination)
+	if !n.translatable(dst) {
+		return nil, fmt.Errorf("destination %s is not translated", dst)
+	}
+	payload := p.Data[ipv6.HeaderLen:]
+	trafficClass := byte(binary.BigEndian.Uint16(p.Data[0:2]) >> 4)
+	hopLimit := p.Data[7]
+
+	var out []byte
+	switch protocol {
+	case protocolTCP, protocolUDP:
+		if len(payload) < transportMinLen(protocol) {
+			return nil, fmt.Errorf("truncated %s header", protocolName(protocol))
+		}
+		port, err := n.mapOut(protocol, src, binary.BigEndian.Uint16(payload[0:2]), tcpFlags(protocol, payload))
+		if err != nil {
+			return nil, err
+		}
+		out = n.buildIPv4(n.addr, dst, protocol, hopLimit, trafficClass, payload)
+		binary.BigEndian.PutUint16(out[ipv4.HeaderLen:], port)
+
+	case protocolICMPv6:
+		if len(payload) < icmpHeaderLen {
+			return nil, fmt.Errorf("truncated ICMPv6 header")
+		}
+		switch ipv6.ICMPType(payload[0]) {
+		case ipv6.ICMPTypeEchoRequest:
+			id, err := n.mapOut(protocolICMPv4, src, binary.BigEndian.Uint16(payload[4:6]), 0)
+			if err != nil {
+				return nil, err
+			}
+			out = n.buildIPv4(n.addr, dst, protocolICMPv4, hopLimit, trafficClass, payload)
+			msg := out[ipv4.HeaderLen:]
+			msg[0], msg[1] = byte(ipv4.ICMPTypeEcho), 0
+			binary.BigEndian.PutUint16(msg[4:6], id)
+		case ipv6.ICMPTypeDestinationUnreachable, ipv6.ICMPTypePacketTooBig, ipv6.ICMPTypeTimeExceeded:
+			msg, err := n.translateErrorOut(payload)
+			if err != nil {
+				return nil, err
+			}
+			out = n.buildIPv4(n.addr, dst, protocolICMPv4, hopLimit, trafficClass, msg)
+		default:
+			return nil, fmt.Errorf("ICMPv6 type %d is not translated", payload[0])
+		}
+
+	default:
+		return nil, fmt.Errorf("protocol %d is not translated", protocol)
+	}
+
+	setTransportChecksum(out[9], out[12:16], out[16:20], out[ipv4.HeaderLen:])
+	return out, nil
+}
+
+// TranslateIn translates an IPv4 packet for a mapping into an IPv6 packet for the client
+func (n *NAT64) TranslateIn(p *Packet) ([]byte, error) {
+	if p.IsFragment() || p.Data[6]&0x20 != 0 {
+		return nil, fmt.Errorf("fragmented IPv4 packets are not translated")
+	}
+
+	headerLen := int(p.Data[0]&0x0F) * 4
+	totalLen := int(binary.BigEndian.Uint16(p.Data[2:4]))
+	if totalLen > len(p.Data) || totalLen < headerLen {
+		return nil, fmt.Errorf("invalid IPv4 total length %d", totalLen)
+	}
+	payload := p.Data[headerLen:totalLen]
+	src := n.embed(p.Source)
+	tos, ttl := p.Data[1], p.Data[8]
+
+	var out []byte
+	switch p.Protocol {
+	case protocolTCP, protocolUDP:
+		if len(payload) < transportMinLen(p.Protocol) {
+			return nil, fmt.Errorf("truncated %s header", protocolName(p.Protocol))
+		}
+		mapping, ok := n.lookupIn(p.Protocol, binary.BigEndian.Uint16(payload[2:4]), tcpFlags(p.Protocol, payload))
+		if !ok {
+			return nil, fmt.Errorf("no mapping for %s port %d", protocolName(p.Protocol), binary.BigEndian.Uint16(payload[2:4]))
+		}
+		out = buildIPv6(src, mapping.key.addr, p.Protocol, ttl, tos, payload)
+		binary.BigEndian.PutUint16(out[ipv6.HeaderLen+2:], mapping.key.port)
+
+	case protocolICMPv4:
+		if len(payload) < icmpHeaderLen {
+			return nil, fmt.Errorf("truncated ICMP header")
+		}
+		switch ipv4.ICMPType(payload[0]) {
+		case ipv4.ICMPTypeEchoReply:
+			mapping, ok := n.lookupIn(protocolICMPv4, binary.BigEndian.Uint16(payload[4:6]), 0)
+			if !ok {
+				return nil, fmt.Errorf("no mapping for ICMP identifier %d", binary.BigEndian.Uint16(payload[4:6]))
+			}
+			out = buildIPv6(src, mapping.key.addr, protocolICMPv6, ttl, tos, payload)
+			msg := out[ipv6.HeaderLen:]
+			msg[0], msg[1] = byte(ipv6.ICMPTypeEchoReply), 0
+			binary.BigEndian.PutUint16(msg[4:6], mapping.key.port)
+		case ipv4.ICMPTypeDestinationUnreachable, ipv4.ICMPTypeTimeExceeded:
+			msg, client, err := n.translateErrorIn(payload)
+			if err != nil {
+				return nil, err
+			}
+			out = buildIPv6(src, client, protocolICMPv6, ttl, tos, msg)
+		default:
+			return nil, fmt.Errorf("ICMP type %d is not translated", payload[0])
+		}
+
+	default:
+		return nil, fmt.Errorf("protocol %d is not translated", p.Protocol)
+	}
+
+	setTransportChecksum(out[6], out[8:24], out[24:40], out[ipv6.HeaderLen:])
+	return out, nil
+}
+
+// translateErrorOut translates an ICMPv6 error from a client about a packet it received
+// The quoted packet is translated back into the IPv4 packet the sender saw.
+func (n *NAT64) translateErrorOut(msg []byte) ([]byte, error) {
+	var icmpType, icmpCode byte
+	var rest uint32
+
+	switch ipv6.ICMPType(msg[0]) {
+	case ipv6.ICMPTypeDestinationUnreachable:
+		icmpType = byte(ipv4.ICMPTypeDestinationUnreachable)
+		switch msg[1] {
+		case 0, 2, 3: // No route, beyond scope, address unreachable
+			icmpCode = 1 // Host unreachable
+		case 1: // Administratively prohibited
+			icmpCode = 10 // Host administratively prohibited
+		case 4: // Port unreachable
+			icmpCode = 3
+		default:
+			return nil, fmt.Errorf("ICMPv6 destination unreachable code %d is not translated", msg[1])
+		}
+	case ipv6.ICMPTypePacketTooBig:
+		icmpType, icmpCode = byte(ipv4.ICMPTypeDestinationUnreachable), 4 // Fragmentation needed
+		mtu := binary.BigEndian.Uint32(msg[4:8])
+		if mtu < 1280 || mtu > 0xFFFF {
+			mtu = 1280
+		}
+		rest = mtu - nat64HeaderGrowth
+	case ipv6.ICMPTypeTimeExceeded:
+		icmpType, icmpCode = byte(ipv4.ICMPTypeTimeExceeded), msg[1]
+	}
+
+	// The quoted packet went from the IPv4 sender to the client
+	quote := msg[icmpHeaderLen:]
+	if len(quote) < ipv6.HeaderLen+8 || quote[6] == 0 || quote[6] == 43 || quote[6] == 44 || quote[6] == 60 {
+		return nil, fmt.Errorf("quoted packet cannot be translated")
+	}
+	protocol := int(quote[6])
+	inner := quote[ipv6.HeaderLen:]
+	client, _ := netip.AddrFromSlice(quote[24:40])
+	sender := n.extract(quote[8:24])
+
+	key := nat64Key{protocol: protocol, addr: client}
+	switch protocol {
+	case protocolTCP, protocolUDP:
+		key.port = binary.BigEndian.Uint16(inner[2:4])
+	case protocolICMPv6:
+		key.protocol, key.port = protocolICMPv4, binary.BigEndian.Uint16(inner[4:6])
+	default:
+		return nil, fmt.Errorf("quoted protocol %d is not translated", protocol)
+	}
+	mapping, ok := n.lookupOut(key)
+	if !ok {
+		return nil, fmt.Errorf("no mapping for the quoted packet")
+	}
+
+	// Quote as much of the translated packet as an ICMPv4 error may carry
+	if max := icmpv4MaxLen - 2*ipv4.HeaderLen - icmpHeaderLen; len(inner) > max {
+		inner = inner[:max]
+	}
+	quoted := n.buildIPv4(sender, n.addr, key.protocol, quote[7], byte(binary.BigEndian.Uint16(quote[0:2])>>4), inner)
+	binary.BigEndian.PutUint16(quoted[2:4], uint16(ipv4.HeaderLen+int(binary.BigEndian.Uint16(quote[4:6]))))
+	binary.BigEndian.PutUint16(quoted[10:12], 0)
+	binary.BigEndian.PutUint16(quoted[10:12], checksumFold(checksumAdd(0, quoted[:ipv4.HeaderLen])))
+	innerOut := quoted[ipv4.HeaderLen:]
+	switch protocol {
+	case protocolTCP, protocolUDP:
+		binary.BigEndian.PutUint16(innerOut[2:4], mapping.port)
+	case protocolICMPv6:
+		innerOut[0] = byte(ipv4.ICMPTypeEcho)
+		binary.BigEndian.PutUint16(innerOut[4:6], mapping.port)
+	}
+
+	out := make([]byte, icmpHeaderLen+len(quoted))
+	out[0], out[1] = icmpType, icmpCode
+	binary.BigEndian.PutUint32(out[4:8], rest)
+	copy(out[icmpHeaderLen:], quoted)
+	return out, nil
+}
+
+// translateErrorIn translates an ICMPv4 error about a translated packet for the client that sent it
+// Returns the ICMPv6 message and the client's address.
+func (n *NAT64) translateErrorIn(msg []byte) ([]byte, netip.Addr, error) {
+	var icmpType, icmpCode byte
+	var rest uint32
+
+	switch ipv4.ICMPType(msg[0]) {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		icmpType = byte(ipv6.ICMPTypeDestinationUnreachable)
+		switch msg[1] {
+		case 0, 1, 5, 6, 7, 8, 11, 12: // Net or host unreachable, unknown or isolated, bad TOS
+			icmpCode = 0 // No route to destination
+		case 2: // Protocol unreachable
+			icmpType, icmpCode = byte(ipv6.ICMPTypeParameterProblem), 1
+			rest = 6 // Points at the next header field
+		case 3: // Port unreachable
+			icmpCode = 4
+		case 4: // Fragmentation needed
+			icmpType, icmpCode = byte(ipv6.ICMPTypePacketTooBig), 0
+			mtu := uint32(binary.BigEndian.Uint16(msg[6:8])) + nat64HeaderGrowth
+			if mtu < 1280 {
+				mtu = 1280
+			}
+			rest = mtu
+		case 9, 10, 13, 15: // Administratively prohibited
+			icmpCode = 1
+		default:
+			return nil, netip.Addr{}, fmt.Errorf("ICMP destination unreachable code %d is not translated", msg[1])
+		}
+	case ipv4.ICMPTypeTimeExceeded:
+		icmpType, icmpCode = byte(ipv6.ICMPTypeTimeExceeded), msg[1]
+	}
+
+	// The quoted packet went from the NAT64 address to the IPv4 destination
+	quote := msg[icmpHeaderLen:]
+	if len(quote) < ipv4.HeaderLen {
+		return nil, netip.Addr{}, fmt.Errorf("quoted packet is truncated")
+	}
+	headerLen := int(quote[0]&0x0F) * 4
+	if len(quote) < headerLen+8 {
+		return nil, netip.Addr{}, fmt.Errorf("quoted packet is truncated")
+	}
+	protocol := int(quote[9])
+	inner := quote[headerLen:]
+
+	var mapping *nat64Mapping
+	var ok bool
+	switch protocol {
+	case protocolTCP, protocolUDP:
+		mapping, ok = n.lookupIn(protocol, binary.BigEndian.Uint16(inner[0:2]), 0)
+	case protocolICMPv4:
+		mapping, ok = n.lookupIn(protocolICMPv4, binary.BigEndian.Uint16(inner[4:6]), 0)
+	default:
+		return nil, netip.Addr{}, fmt.Errorf("quoted protocol %d is not translated", protocol)
+	}
+	if !ok {
+		return nil, netip.Addr{}, fmt.Errorf("no mapping for the quoted packet")
+	}
+
+	// Quote as much of the translated packet as an ICMPv6 error may carry
+	if max := icmpv6MaxLen - 2*ipv6.HeaderLen - icmpHeaderLen; len(inner) > max {
+		inner = inner[:max]
+	}
+	innerProtocol := protocol
+	if protocol == protocolICMPv4 {
+		innerProtocol = protocolICMPv6
+	}
+	quoted := buildIPv6(mapping.key.addr, n.embed(quote[16:20]), innerProtocol, quote[8], quote[1], inner)
+	totalLen := int(binary.BigEndian.Uint16(quote[2:4]))
+	if totalLen > headerLen {
+		binary.BigEndian.PutUint16(quoted[4:6], uint16(totalLen-headerLen))
+	}
+	innerOut := quoted[ipv6.HeaderLen:]
+	switch protocol {
+	case protocolTCP, protocolUDP:
+		binary.BigEndian.PutUint16(innerOut[0:2], mapping.key.port)
+	case protocolICMPv4:
+		innerOut[0] = byte(ipv6.ICMPTypeEchoRequest)
+		binary.BigEndian.PutUint16(innerOut[4:6], mapping.key.port)
+	}
+
+	out := make([]byte, icmpHeaderLen+len(quoted))
+	out[0], out[1] = icmpType, icmpCode
+	binary.BigEndian.PutUint32(out[4:8], rest)
+	copy(out[icmpHeaderLen:], quoted)
+	return out, mapping.key.addr, nil
+}
+
+// mapOut returns the IPv4 port for a client address and port, creating a mapping if needed
+// flags are the TCP flags of the packet, or zero for other protocols.
+func (n *NAT64) mapOut(protocol int, addr netip.Addr, port uint16, flags byte) (uint16, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+	n.sweep(now)
+
+	key := nat64Key{protocol: protocol, addr: addr, port: port}
+	if mapping, ok := n.out[key]; ok {
+		n.track(mapping, flags, true)
+		mapping.expires = now.Add(n.timeoutFor(mapping))
+		return mapping.port, nil
+	}
+
+	// Only a SYN opens a TCP mapping (RFC 6146)
+	if protocol == protocolTCP && flags&(tcpFlagSYN|tcpFlagRST) != tcpFlagSYN {
+		return 0, fmt.Errorf("no mapping for TCP port %d", port)
+	}
+	if n.clients[addr] >= nat64MaxMappingsPerClient {
+		return 0, fmt.Errorf("client %s has too many NAT64 mappings", addr)
+	}
+
+	for i := nat64FirstPort; i <= 0xFFFF; i++ {
+		candidate := n.nextPort
+		n.nextPort++
+		if n.nextPort < nat64FirstPort {
+			n.nextPort = nat64FirstPort
+		}
+		if _, used := n.in[nat64Port{protocol, candidate}]; used {
+			continue
+		}
+
+		mapping := &nat64Mapping{key: key, port: candidate}
+		mapping.expires = now.Add(n.timeoutFor(mapping))
+		n.out[key] = mapping
+		n.in[nat64Port{protocol, candidate}] = mapping
+		n.clients[addr]++
+		return candidate, nil
+	}
+
+	return 0, fmt.Errorf("no free NAT64 %s ports", protocolName(protocol))
+}
+
+// lookupIn returns the mapping for an IPv4 port, keeping it alive
+// flags are the TCP flags of the packet, or zero for other protocols and ICMP errors.
+func (n *NAT64) lookupIn(protocol int, port uint16, flags byte) (*nat64Mapping, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	mapping, ok := n.in[nat64Port{protocol, port}]
+	if !ok || time.Now().After(mapping.expires) {
+		return nil, false
+	}
+	n.track(mapping, flags, false)
+	mapping.expires = time.Now().Add(n.timeoutFor(mapping))
+	return mapping, true
+}
+
+// track follows the TCP connection of a mapping through the flags of a packet
+func (n *NAT64) track(mapping *nat64Mapping, flags byte, outbound bool) {
+	if mapping.key.protocol != protocolTCP {
+		return
+	}
+
+	// A new connection may reuse the client port of a closed one
+	if outbound && mapping.closed && flags&tcpFlagSYN != 0 {
+		*mapping = nat64Mapping{key: mapping.key, port: mapping.port}
+	}
+
+	switch {
+	case flags&tcpFlagRST != 0:
+		mapping.closed = true
+	case flags&tcpFlagSYN != 0 && !outbound:
+		mapping.established = true
+	}
+	if flags&tcpFlagFIN != 0 {
+		if outbound {
+			mapping.finOut = true
+		} else {
+			mapping.finIn = true
+		}
+		mapping.closed = mapping.closed || mapping.finOut && mapping.finIn
+	}
+}
+
+// lookupOut returns the mapping for a client address and port
+func (n *NAT64) lookupOut(key nat64Key) (*nat64Mapping, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	mapping, ok := n.out[key]
+	if !ok || time.Now().After(mapping.expires) {
+		return nil, false
+	}
+	return mapping, true
+}
+
+// sweep removes expired mappings, at most once per sweep interval
+func (n *NAT64) sweep(now time.Time) {
+	if now.Sub(n.lastSweep) < nat64SweepInterval {
+		return
+	}
+	n.lastSweep = now
+
+	for key, mapping := range n.out {
+		if now.After(mapping.expires) {
+			delete(n.out, key)
+			delete(n.in, nat64Port{key.protocol, mapping.port})
+			if n.clients[key.addr]--; n.clients[key.addr] <= 0 {
+				delete(n.clients, key.addr)
+			}
+		}
+	}
+}
+
+// timeoutFor returns how long an idle mapping is kept
+// TCP mappings only get the long timeout while their connection is established.
+func (n *NAT64) timeoutFor(mapping *nat64Mapping) time.Duration {
+	if mapping.key.protocol != protocolTCP {
+		return n.timeout
+	}
+	if mapping.established && !mapping.closed {
+		return nat64TCPTimeout
+	}
+	return nat64TCPTransitoryTimeout
+}
+
+// translatable reports whether packets for an IPv4 destination may be translated
+func (n *NAT64) translatable(dst netip.Addr) bool {
+	if dst == n.addr {
+		return false
+	}
+	for _, prefix := range n.excluded {
+		if prefix.Contains(dst) {
+			return false
+		}
+	}
+	return true
+}
+
+// tcpFlags returns the flags of a TCP segment, or zero for other protocols
+func tcpFlags(protocol int, segment []byte) byte {
+	if protocol != protocolTCP || len(segment) < tcpHeaderLen {
+		return 0
+	}
+	return segment[13]
+}
+
+// embed returns the IPv6 address of an IPv4 address within the prefix
+func (n *NAT64) embed(ip net.IP) netip.Addr {
+	addr := n.prefix.Addr().As16()
+	copy(addr[12:], ip.To4())
+	return netip.AddrFrom16(addr)
+}
+
+// extract returns the IPv4 address embedded in an IPv6 address of the prefix
+func (n *NAT64) extract(ip []byte) netip.Addr {
+	ip = net.IP(ip).To16()
+	return netip.AddrFrom4([4]byte{ip[12], ip[13], ip[14], ip[15]})
+}
+
+// buildIPv4 builds an IPv4 packet around a translated payload (RFC 7915)
+// Packets small enough for any IPv4 path may be fragmented on the way, larger
+// ones keep the path MTU discovery IPv6 requires.
+func (n *NAT64) buildIPv4(src, dst netip.Addr, protocol int, ttl, tos byte, payload []byte) []byte {
+	pkt := make([]byte, ipv4.HeaderLen+len(payload))
+	pkt[0] = 0x45 // Version 4, IHL 5
+	pkt[1] = tos
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	if len(pkt) > 1260 {
+		pkt[6] = 0x40 // Don't fragment
+	} else {
+		n.mutex.Lock()
+		n.nextID++
+		if n.nextID == 0 {
+			n.nextID++
+		}
+		binary.BigEndian.PutUint16(pkt[4:6], n.nextID)
+		n.mutex.Unlock()
+	}
+	pkt[8] = ttl
+	pkt[9] = byte(protocol)
+	src4, dst4 := src.As4(), dst.As4()
+	copy(pkt[12:16], src4[:])
+	copy(pkt[16:20], dst4[:])
+	binary.BigEndian.PutUint16(pkt[10:12], checksumFold(checksumAdd(0, pkt[:ipv4.HeaderLen])))
+	copy(pkt[ipv4.HeaderLen:], payload)
+	return pkt
+}
+
+// buildIPv6 builds an IPv6 packet around a translated payload
+func buildIPv6(src, dst netip.Addr, protocol int, hopLimit, trafficClass byte, payload []byte) []byte {
+	pkt := make([]byte, ipv6.HeaderLen+len(payload))
+	binary.BigEndian.PutUint16(pkt[0:2], 0x6000|uint16(trafficClass)<<4)
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(payload)))
+	pkt[6] = byte(protocol)
+	pkt[7] = hopLimit
+	src16, dst16 := src.As16(), dst.As16()
+	copy(pkt[8:24], src16[:])
+	copy(pkt[24:40], dst16[:])
+	copy(pkt[ipv6.HeaderLen:], payload)
+	return pkt
+}
+
+// transportMinLen returns the shortest header of a transport protocol whose ports are rewritten
+func transportMinLen(protocol int) int {
+	if protocol == protocolTCP {
+		return 20
+	}
+	return 8
+}
+
+// setTransportChecksum recomputes the checksum of a translated transport segment
+// ICMPv4 is checksummed without a pseudo-header; TCP, UDP and ICMPv6 include one.
+func setTransportChecksum(protocol byte, src, dst net.IP, segment []byte) {
+	var field int
+	switch int(protocol) {
+	case protocolTCP:
+		field = 16
+	case protocolUDP:
+		field = 6
+	case protocolICMPv4, protocolICMPv6:
+		field = 2
+	default:
+		return
+	}
+	if len(segment) < field+2 {
+		return
+	}
+
+	binary.BigEndian.PutUint16(segment[field:field+2], 0)
+	var sum uint32
+	if int(protocol) != protocolICMPv4 {
+		sum = pseudoHeaderSum(src, dst, int(protocol), len(segment))
+	}
+	checksum := checksumFold(checksumAdd(sum, segment))
+	if checksum == 0 && int(protocol) == protocolUDP {
+		checksum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(segment[field:field+2], checksum)
+}
@@ -0,0 +1,381 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	testNAT64Client = netip.MustParseAddr("fd00::2")
+	testNAT64Addr   = netip.MustParseAddr("10.0.0.254")
+	testNAT64Remote = netip.MustParseAddr("8.8.8.8")
+)
+
+// newTestNAT64 returns a translator for the well-known prefix
+func newTestNAT64(t *testing.T, excluded ...netip.Prefix) *NAT64 {
+	t.Helper()
+	n, err := NewNAT64(netip.MustParsePrefix(DefaultNAT64Prefix), testNAT64Addr, time.Minute, excluded...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// clientPacket builds an IPv6 packet from the test client to an IPv4 destination behind the prefix
+func clientPacket(t *testing.T, n *NAT64, dst netip.Addr, protocol int, segment []byte) *Packet {
+	t.Helper()
+	pkt := buildIPv6(testNAT64Client, n.embed(dst.AsSlice()), protocol, 64, 0, segment)
+	setTransportChecksum(pkt[6], pkt[8:24], pkt[24:40], pkt[ipv6.HeaderLen:])
+	p, err := ParsePacket(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// remotePacket builds an IPv4 packet from src to the translator's address
+func remotePacket(t *testing.T, n *NAT64, src netip.Addr, protocol int, segment []byte) *Packet {
+	t.Helper()
+	pkt := n.buildIPv4(src, n.addr, protocol, 64, 0, segment)
+	setTransportChecksum(pkt[9], pkt[12:16], pkt[16:20], pkt[ipv4.HeaderLen:])
+	p, err := ParsePacket(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// tcpSegment returns a TCP segment with the given ports and flags and a short payload
+func tcpSegment(srcPort, dstPort uint16, flags byte) []byte {
+	segment := make([]byte, tcpHeaderLen+4)
+	binary.BigEndian.PutUint16(segment[0:2], srcPort)
+	binary.BigEndian.PutUint16(segment[2:4], dstPort)
+	segment[12] = tcpHeaderLen / 4 << 4
+	segment[13] = flags
+	copy(segment[tcpHeaderLen:], "data")
+	return segment
+}
+
+// udpSegment returns a UDP datagram with the given ports and a short payload
+func udpSegment(srcPort, dstPort uint16) []byte {
+	segment := make([]byte, 8+4)
+	binary.BigEndian.PutUint16(segment[0:2], srcPort)
+	binary.BigEndian.PutUint16(segment[2:4], dstPort)
+	binary.BigEndian.PutUint16(segment[4:6], uint16(len(segment)))
+	copy(segment[8:], "data")
+	return segment
+}
+
+// echoMessage returns an ICMP or ICMPv6 echo message
+func echoMessage(icmpType byte, id, seq uint16) []byte {
+	msg := make([]byte, icmpHeaderLen+4)
+	msg[0] = icmpType
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	copy(msg[icmpHeaderLen:], "ping")
+	return msg
+}
+
+// checkIPv4 verifies the header and transport checksums of an IPv4 packet
+func checkIPv4(t *testing.T, pkt []byte) {
+	t.Helper()
+	if checksumFold(checksumAdd(0, pkt[:ipv4.HeaderLen])) != 0 {
+		t.Error("invalid IPv4 header checksum")
+	}
+	if total := int(binary.BigEndian.Uint16(pkt[2:4])); total != len(pkt) {
+		t.Errorf("IPv4 total length %d, packet is %d bytes", total, len(pkt))
+	}
+	segment := pkt[ipv4.HeaderLen:]
+	var sum uint32
+	if int(pkt[9]) != protocolICMPv4 {
+		sum = pseudoHeaderSum(pkt[12:16], pkt[16:20], int(pkt[9]), len(segment))
+	}
+	if checksumFold(checksumAdd(sum, segment)) != 0 {
+		t.Errorf("invalid %s checksum", protocolName(int(pkt[9])))
+	}
+}
+
+// checkIPv6 verifies the transport checksum of an IPv6 packet
+func checkIPv6(t *testing.T, pkt []byte) {
+	t.Helper()
+	segment := pkt[ipv6.HeaderLen:]
+	if payloadLen := int(binary.BigEndian.Uint16(pkt[4:6])); payloadLen != len(segment) {
+		t.Errorf("IPv6 payload length %d, payload is %d bytes", payloadLen, len(segment))
+	}
+	sum := pseudoHeaderSum(pkt[8:24], pkt[24:40], int(pkt[6]), len(segment))
+	if checksumFold(checksumAdd(sum, segment)) != 0 {
+		t.Errorf("invalid %s checksum", protocolName(int(pkt[6])))
+	}
+}
+
+func TestNAT64TranslateTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol int
+		out      []byte
+		reply    func(port uint16) []byte
+	}{
+		{"TCP", protocolTCP, tcpSegment(40000, 443, tcpFlagSYN), func(port uint16) []byte {
+			return tcpSegment(443, port, tcpFlagSYN|0x10)
+		}},
+		{"UDP", protocolUDP, udpSegment(40000, 53), func(port uint16) []byte {
+			return udpSegment(53, port)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newTestNAT64(t)
+
+			out, err := n.TranslateOut(clientPacket(t, n, testNAT64Remote, tt.protocol, tt.out))
+			if err != nil {
+				t.Fatalf("TranslateOut: %v", err)
+			}
+			checkIPv4(t, out)
+			if src, dst := net.IP(out[12:16]), net.IP(out[16:20]); !src.Equal(testNAT64Addr.AsSlice()) || !dst.Equal(testNAT64Remote.AsSlice()) {
+				t.Errorf("translated %s -> %s; want %s -> %s", src, dst, testNAT64Addr, testNAT64Remote)
+			}
+			if int(out[9]) != tt.protocol {
+				t.Errorf("translated protocol %d; want %d", out[9], tt.protocol)
+			}
+			port := binary.BigEndian.Uint16(out[ipv4.HeaderLen:])
+			if port < nat64FirstPort {
+				t.Errorf("mapped port %d is below %d", port, nat64FirstPort)
+			}
+
+			in, err := n.TranslateIn(remotePacket(t, n, testNAT64Remote, tt.protocol, tt.reply(port)))
+			if err != nil {
+				t.Fatalf("TranslateIn: %v", err)
+			}
+			checkIPv6(t, in)
+			src, _ := netip.AddrFromSlice(in[8:24])
+			dst, _ := netip.AddrFromSlice(in[24:40])
+			if src != n.embed(testNAT64Remote.AsSlice()) || dst != testNAT64Client {
+				t.Errorf("translated reply %s -> %s; want %s -> %s", src, dst, n.embed(testNAT64Remote.AsSlice()), testNAT64Client)
+			}
+			if got := binary.BigEndian.Uint16(in[ipv6.HeaderLen+2:]); got != 40000 {
+				t.Errorf("reply destination port %d; want 40000", got)
+			}
+		})
+	}
+}
+
+func TestNAT64TranslateEcho(t *testing.T) {
+	n := newTestNAT64(t)
+
+	out, err := n.TranslateOut(clientPacket(t, n, testNAT64Remote, protocolICMPv6, echoMessage(byte(ipv6.ICMPTypeEchoRequest), 7, 1)))
+	if err != nil {
+		t.Fatalf("TranslateOut: %v", err)
+	}
+	checkIPv4(t, out)
+	msg := out[ipv4.HeaderLen:]
+	if int(out[9]) != protocolICMPv4 || msg[0] != byte(ipv4.ICMPTypeEcho) {
+		t.Fatalf("translated to protocol %d type %d; want an ICMP echo request", out[9], msg[0])
+	}
+	id := binary.BigEndian.Uint16(msg[4:6])
+
+	reply := echoMessage(byte(ipv4.ICMPTypeEchoReply), id, 1)
+	in, err := n.TranslateIn(remotePacket(t, n, testNAT64Remote, protocolICMPv4, reply))
+	if err != nil {
+		t.Fatalf("TranslateIn: %v", err)
+	}
+	checkIPv6(t, in)
+	msg = in[ipv6.HeaderLen:]
+	if int(in[6]) != protocolICMPv6 || msg[0] != byte(ipv6.ICMPTypeEchoReply) {
+		t.Fatalf("translated to protocol %d type %d; want an ICMPv6 echo reply", in[6], msg[0])
+	}
+	if got := binary.BigEndian.Uint16(msg[4:6]); got != 7 {
+		t.Errorf("echo reply identifier %d; want 7", got)
+	}
+}
+
+func TestNAT64TranslateErrorIn(t *testing.T) {
+	n := newTestNAT64(t)
+
+	out, err := n.TranslateOut(clientPacket(t, n, testNAT64Remote, protocolTCP, tcpSegment(40000, 443, tcpFlagSYN)))
+	if err != nil {
+		t.Fatalf("TranslateOut: %v", err)
+	}
+
+	// A router on the way reports that the translated packet is too big
+	router := netip.MustParseAddr("1.1.1.1")
+	icmp := make([]byte, icmpHeaderLen+len(out))
+	icmp[0], icmp[1] = byte(ipv4.ICMPTypeDestinationUnreachable), 4
+	binary.BigEndian.PutUint16(icmp[6:8], 1400)
+	copy(icmp[icmpHeaderLen:], out)
+
+	in, err := n.TranslateIn(remotePacket(t, n, router, protocolICMPv4, icmp))
+	if err != nil {
+		t.Fatalf("TranslateIn: %v", err)
+	}
+	checkIPv6(t, in)
+	if dst, _ := netip.AddrFromSlice(in[24:40]); dst != testNAT64Client {
+		t.Errorf("error sent to %s; want %s", dst, testNAT64Client)
+	}
+
+	msg := in[ipv6.HeaderLen:]
+	if msg[0] != byte(ipv6.ICMPTypePacketTooBig) {
+		t.Fatalf("translated to ICMPv6 type %d; want packet too big", msg[0])
+	}
+	if mtu := binary.BigEndian.Uint32(msg[4:8]); mtu != 1400+nat64HeaderGrowth {
+		t.Errorf("packet too big MTU %d; want %d", mtu, 1400+nat64HeaderGrowth)
+	}
+
+	// The quoted packet is the one the client sent
+	quote := msg[icmpHeaderLen:]
+	if src, _ := netip.AddrFromSlice(quote[8:24]); src != testNAT64Client {
+		t.Errorf("quoted source %s; want %s", src, testNAT64Client)
+	}
+	if port := binary.BigEndian.Uint16(quote[ipv6.HeaderLen:]); port != 40000 {
+		t.Errorf("quoted source port %d; want 40000", port)
+	}
+}
+
+func TestNAT64TranslateErrorOut(t *testing.T) {
+	n := newTestNAT64(t)
+
+	out, err := n.TranslateOut(clientPacket(t, n, testNAT64Remote, protocolUDP, udpSegment(40000, 53)))
+	if err != nil {
+		t.Fatalf("TranslateOut: %v", err)
+	}
+	port := binary.BigEndian.Uint16(out[ipv4.HeaderLen:])
+
+	// The client reports that nothing listens on the port a reply came to
+	received := buildIPv6(n.embed(testNAT64Remote.AsSlice()), testNAT64Client, protocolUDP, 60, 0, udpSegment(53, 40000))
+	icmp := make([]byte, icmpHeaderLen+len(received))
+	icmp[0], icmp[1] = byte(ipv6.ICMPTypeDestinationUnreachable), 4
+	copy(icmp[icmpHeaderLen:], received)
+
+	out, err = n.TranslateOut(clientPacket(t, n, testNAT64Remote, protocolICMPv6, icmp))
+	if err != nil {
+		t.Fatalf("TranslateOut: %v", err)
+	}
+	checkIPv4(t, out)
+	msg := out[ipv4.HeaderLen:]
+	if msg[0] != byte(ipv4.ICMPTypeDestinationUnreachable) || msg[1] != 3 {
+		t.Fatalf("translated to ICMP type %d code %d; want port unreachable", msg[0], msg[1])
+	}
+
+	// The quoted packet is the one the IPv4 sender sent
+	quote := msg[icmpHeaderLen:]
+	if checksumFold(checksumAdd(0, quote[:ipv4.HeaderLen])) != 0 {
+		t.Error("invalid quoted IPv4 header checksum")
+	}
+	if src, dst := net.IP(quote[12:16]), net.IP(quote[16:20]); !src.Equal(testNAT64Remote.AsSlice()) || !dst.Equal(testNAT64Addr.AsSlice()) {
+		t.Errorf("quoted %s -> %s; want %s -> %s", src, dst, testNAT64Remote, testNAT64Addr)
+	}
+	if got := binary.BigEndian.Uint16(quote[ipv4.HeaderLen+2:]); got != port {
+		t.Errorf("quoted destination port %d; want %d", got, port)
+	}
+}
+
+func TestNAT64RejectsNonGlobalDestinations(t *testing.T) {
+	n := newTestNAT64(t, netip.MustParsePrefix("192.0.2.128/25"), netip.MustParsePrefix("8.8.4.4/32"))
+
+	for _, dst := range []string{
+		"10.0.0.5",        // Tunnel clients
+		"10.0.0.254",      // The translator itself
+		"127.0.0.1",       // Loopback
+		"192.168.1.1",     // Private
+		"172.16.0.1",      // Private
+		"169.254.169.254", // Link-local
+		"100.64.0.1",      // Shared address space
+		"224.0.0.1",       // Multicast
+		"255.255.255.255", // Broadcast
+		"8.8.4.4",         // Excluded
+	} {
+		addr := netip.MustParseAddr(dst)
+		if _, err := n.TranslateOut(clientPacket(t, n, addr, protocolUDP, udpSegment(40000, 53))); err == nil {
+			t.Errorf("TranslateOut to %s succeeded", dst)
+		}
+	}
+	if n.Len() != 0 {
+		t.Errorf("rejected packets created %d mappings", n.Len())
+	}
+}
+
+func TestNAT64TCPTimeouts(t *testing.T) {
+	n := newTestNAT64(t)
+	key := nat64Key{protocol: protocolTCP, addr: testNAT64Client, port: 40000}
+
+	// remaining returns the idle time left for the connection's mapping
+	remaining := func() time.Duration {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		return time.Until(n.out[key].expires)
+	}
+	send := func(flags byte) uint16 {
+		t.Helper()
+		out, err := n.TranslateOut(clientPacket(t, n, testNAT64Remote, protocolTCP, tcpSegment(40000, 443, flags)))
+		if err != nil {
+			t.Fatalf("TranslateOut: %v", err)
+		}
+		return binary.BigEndian.Uint16(out[ipv4.HeaderLen:])
+	}
+	receive := func(port uint16, flags byte) {
+		t.Helper()
+		if _, err := n.TranslateIn(remotePacket(t, n, testNAT64Remote, protocolTCP, tcpSegment(443, port, flags))); err != nil {
+			t.Fatalf("TranslateIn: %v", err)
+		}
+	}
+
+	// Only a SYN creates a mapping
+	if _, err := n.TranslateOut(clientPacket(t, n, testNAT64Remote, protocolTCP, tcpSegment(40000, 443, 0x10))); err == nil {
+		t.Fatal("TranslateOut created a mapping without a SYN")
+	}
+
+	port := send(tcpFlagSYN)
+	if got := remaining(); got > nat64TCPTransitoryTimeout {
+		t.Errorf("opening connection kept for %v; want at most %v", got, nat64TCPTransitoryTimeout)
+	}
+	receive(port, tcpFlagSYN|0x10)
+	if got := remaining(); got <= nat64TCPTransitoryTimeout {
+		t.Errorf("established connection kept for %v; want %v", got, nat64TCPTimeout)
+	}
+
+	send(tcpFlagFIN | 0x10)
+	if got := remaining(); got <= nat64TCPTransitoryTimeout {
+		t.Errorf("half-closed connection kept for %v; want %v", got, nat64TCPTimeout)
+	}
+	receive(port, tcpFlagFIN|0x10)
+	if got := remaining(); got > nat64TCPTransitoryTimeout {
+		t.Errorf("closed connection kept for %v; want at most %v", got, nat64TCPTransitoryTimeout)
+	}
+
+	// A new connection from the same port starts over
+	if got := send(tcpFlagSYN); got != port {
+		t.Errorf("new connection mapped to port %d; want %d", got, port)
+	}
+	receive(port, tcpFlagSYN|0x10)
+	receive(port, tcpFlagRST)
+	if got := remaining(); got > nat64TCPTransitoryTimeout {
+		t.Errorf("reset connection kept for %v; want at most %v", got, nat64TCPTransitoryTimeout)
+	}
+}
+
+func TestNAT64MappingLimit(t *testing.T) {
+	n := newTestNAT64(t)
+
+	for port := 0; port < nat64MaxMappingsPerClient; port++ {
+		if _, err := n.mapOut(protocolUDP, testNAT64Client, uint16(port), 0); err != nil {
+			t.Fatalf("mapping %d: %v", port, err)
+		}
+	}
+	if _, err := n.mapOut(protocolUDP, testNAT64Client, nat64MaxMappingsPerClient, 0); err == nil {
+		t.Error("client exceeded the mapping limit")
+	}
+
+	// Existing mappings and other clients are not affected
+	if _, err := n.mapOut(protocolUDP, testNAT64Client, 0, 0); err != nil {
+		t.Errorf("existing mapping: %v", err)
+	}
+	if _, err := n.mapOut(protocolUDP, netip.MustParseAddr("fd00::3"), 0, 0); err != nil {
+		t.Errorf("other client: %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// routeProtocol tags every kernel route Tuno installs, so that leftovers
+// from a crashed client can be found and removed
+const routeProtocol netlink.RouteProtocol = 0x74
+
+// KernelRoutes mirrors Router routes into the kernel routing table
+// Tunnel and drop routes point at the TUN device, where the client applies
+// the routing decision; internet routes are exceptions pinned to the
+// original default gateway.
+type KernelRoutes struct {
+	device    string
+	installed map[string][]*netlink.Route
+	active    bool
+	mutex     sync.Mutex
+	logger    *logrus.Logger
+}
+
+// NewKernelRoutes creates a route installer for the given TUN device
+func NewKernelRoutes(device string, logger *logrus.Logger) *KernelRoutes {
+	return &KernelRoutes{
+		device:    device,
+		installed: make(map[string][]*netlink.Route),
+		logger:    logger,
+	}
+}
+
+// Install installs all routes and keeps following changes until Flush
+func (k *KernelRoutes) Install(routes []Route) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.active = true
+	for _, route := range routes {
+		if err := k.apply(route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleChange keeps the kernel in sync with a Router change
+// It is meant to be registered with Router.SetChangeHandler.
+func (k *KernelRoutes) HandleChange(route Route, removed bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// Routes are only installed while connected
+	if !k.active {
+		return
+	}
+
+	var err error
+	if removed {
+		err = k.remove(route.Network)
+	} else {
+		err = k.apply(route)
+	}
+	if err != nil {
+		k.logger.Errorf("Failed to update kernel route %s: %v", route.Network, err)
+	}
+}
+
+// Flush removes every route installed by this instance
+func (k *KernelRoutes) Flush() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.active = false
+	for key := range k.installed {
+		if err := k.removeKey(key); err != nil {
+			k.logger.Warnf("Failed to remove kernel route: %v", err)
+		}
+	}
+}
+
+// RedirectGateway sends all traffic through the TUN device
+// The halves of the address space override the default route without
+// replacing it, so the original gateway stays available for pinned hosts.
+// Unless allowLAN is set, directly connected subnets are captured as well.
+// Without ipv6 the tunnel does not carry IPv6, so it is rejected instead and
+// applications fall back to IPv4 at once rather than timing out.
+func (k *KernelRoutes) RedirectGateway(allowLAN, ipv6 bool) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	_, all4, _ := net.ParseCIDR("0.0.0.0/0")
+	if err := k.apply(Route{Network: all4, Type: RouteTypeTUN}); err != nil {
+		return err
+	}
+	_, all6, _ := net.ParseCIDR("::/0")
+	if ipv6 {
+		if err := k.apply(Route{Network: all6, Type: RouteTypeTUN}); err != nil {
+			return err
+		}
+	} else if err := k.reject(all6); err != nil {
+		return err
+	}
+
+	if !allowLAN {
+		if err := k.captureLAN(ipv6); err != nil {
+			return err
+		}
+	}
+
+	k.logger.Info("Redirected default gateway through the tunnel")
+	return nil
+}
+
+// PinHost routes a single address via its current path outside the tunnel
+// Used for the server endpoint so that tunnel traffic does not loop back into the TUN device.
+func (k *KernelRoutes) PinHost(ip net.IP) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	link, err := netlink.LinkByName(k.device)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", k.device, err)
+	}
+
+	// Use the kernel's current path unless it already points into the tunnel
+	var via *netlink.Route
+	if routes, err := netlink.RouteGet(ip); err == nil && len(routes) > 0 && routes[0].LinkIndex != link.Attrs().Index {
+		via = &routes[0]
+	} else if via, err = defaultRoute(ip.To4() == nil); err != nil {
+		return err
+	}
+
+	r := &netlink.Route{
+		LinkIndex: via.LinkIndex,
+		Dst:       hostIPNet(ip),
+		Gw:        via.Gw,
+		Protocol:  routeProtocol,
+	}
+	if err := netlink.RouteReplace(r); err != nil {
+		return fmt.Errorf("failed to pin route to %s: %v", ip, err)
+	}
+	k.installed["pin:"+ip.String()] = []*netlink.Route{r}
+	k.logger.Debugf("Pinned route to %s outside the tunnel", ip)
+	return nil
+}
+
+// captureLAN routes directly connected subnets through the TUN device
+// Each subnet is split in two so its halves win over the connected route;
+// the default gateways keep host routes so pinned hosts stay reachable.
+// IPv6 subnets are rejected unless the tunnel carries IPv6.
+func (k *KernelRoutes) captureLAN(ipv6 bool) error {
+	link, err := netlink.LinkByName(k.device)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", k.device, err)
+	}
+
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses: %v", err)
+	}
+
+	for _, addr := range addrs {
+		if addr.LinkIndex == link.Attrs().Index || addr.IP.IsLoopback() || addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ones, total := addr.Mask.Size()
+		if ones == total {
+			continue
+		}
+
+		// Keep the gateway on this subnet reachable
+		subnet := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+		if gateway, err := defaultRoute(addr.IP.To4() == nil); err == nil && gateway.Gw != nil && subnet.Contains(gateway.Gw) {
+			r := &netlink.Route{
+				LinkIndex: gateway.LinkIndex,
+				Dst:       hostIPNet(gateway.Gw),
+				Scope:     netlink.SCOPE_LINK,
+				Protocol:  routeProtocol,
+			}
+			if err := netlink.RouteReplace(r); err != nil {
+				return fmt.Errorf("failed to pin gateway %s: %v", gateway.Gw, err)
+			}
+			k.installed["pin:"+gateway.Gw.String()] = []*netlink.Route{r}
+		}
+
+		if addr.IP.To4() == nil && !ipv6 {
+			if err := k.reject(subnet); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := k.apply(Route{Network: subnet, Type: RouteTypeTUN}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply installs or replaces the kernel route for a Router route
+// Networks that would replace the default route or a connected route are
+// installed as their two halves instead.
+func (k *KernelRoutes) apply(route Route) error {
+	key := route.Network.String()
+
+	var routes []*netlink.Route
+	switch route.Type {
+	case RouteTypeTUN, RouteTypeDrop:
+		link, err := netlink.LinkByName(k.device)
+		if err != nil {
+			return fmt.Errorf("failed to get link for %s: %v", k.device, err)
+		}
+		networks := []*net.IPNet{route.Network}
+		if ones, _ := route.Network.Mask.Size(); ones == 0 || isConnectedSubnet(route.Network, link.Attrs().Index) {
+			networks = splitNetwork(route.Network)
+		}
+		for _, network := range networks {
+			routes = append(routes, &netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       network,
+				Scope:     netlink.SCOPE_LINK,
+				Protocol:  routeProtocol,
+			})
+		}
+	case RouteTypeInternet:
+		// A direct default route is what the kernel does anyway
+		if ones, _ := route.Network.Mask.Size(); ones == 0 {
+			return k.remove(route.Network)
+		}
+		gateway, err := defaultRoute(route.Network.IP.To4() == nil)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, &netlink.Route{
+			LinkIndex: gateway.LinkIndex,
+			Dst:       route.Network,
+			Gw:        gateway.Gw,
+			Protocol:  routeProtocol,
+		})
+	default:
+		return fmt.Errorf("unsupported route type: %v", route.Type)
+	}
+
+	// Replacing a route with a different shape must not leave the old one behind
+	if err := k.removeKey(key); err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if err := netlink.RouteReplace(r); err != nil {
+			return fmt.Errorf("failed to install route %s: %v", r.Dst, err)
+		}
+		k.installed[key] = append(k.installed[key], r)
+	}
+	k.logger.Debugf("Installed kernel route %s (%v)", key, route.Type)
+	return nil
+}
+
+// reject installs unreachable routes for a network, split in two so they win over existing routes
+func (k *KernelRoutes) reject(network *net.IPNet) error {
+	key := network.String()
+	if err := k.removeKey(key); err != nil {
+		return err
+	}
+	for _, half := range splitNetwork(network) {
+		r := &netlink.Route{
+			Dst:      half,
+			Type:     unix.RTN_UNREACHABLE,
+			Protocol: routeProtocol,
+		}
+		if err := netlink.RouteReplace(r); err != nil {
+			return fmt.Errorf("failed to install unreachable route %s: %v", half, err)
+		}
+		k.installed[key] = append(k.installed[key], r)
+	}
+	k.logger.Debugf("Rejecting traffic to %s", key)
+	return nil
+}
+
+// remove deletes the kernel routes for a network if we installed any
+func (k *KernelRoutes) remove(network *net.IPNet) error {
+	return k.removeKey(network.String())
+}
+
+// removeKey deletes the kernel routes installed under a key
+func (k *KernelRoutes) removeKey(key string) error {
+	routes, ok := k.installed[key]
+	if !ok {
+		return nil
+	}
+
+	delete(k.installed, key)
+	for _, r := range routes {
+		if err := netlink.RouteDel(r); err != nil && !isNotExist(err) {
+			return fmt.Errorf("failed to remove route %s: %v", r.Dst, err)
+		}
+	}
+	k.logger.Debugf("Removed kernel route %s", key)
+	return nil
+}
+
+// defaultRoute returns the main table's default route for the given family
+func defaultRoute(ipv6 bool) (*netlink.Route, error) {
+	family := netlink.FAMILY_V4
+	if ipv6 {
+		family = netlink.FAMILY_V6
+	}
+
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	var best *netlink.Route
+	for i := range routes {
+		r := &routes[i]
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if best == nil || r.Priority < best.Priority {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no default route found")
+	}
+	return best, nil
+}
+
+// enableForwarding turns on IP forwarding so packets can pass between the TUN device and other interfaces
+func enableForwarding(ipv6 bool) error {
+	if err := os.WriteFile(ipv4ForwardingSysctl, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable IPv4 forwarding: %v", err)
+	}
+	if ipv6 {
+		if err := os.WriteFile(ipv6ForwardingSysctl, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %v", err)
+		}
+	}
+	return nil
+}
+
+// setForwarding turns on IP forwarding until restoreForwarding is called
+// The client uses it, since forwarding is only needed while it is connected.
+func setForwarding(stateDir string, ipv6 bool) error {
+	if err := setSysctl(stateDir, ipv4ForwardingSysctl, "1"); err != nil {
+		return fmt.Errorf("failed to enable IPv4 forwarding: %v", err)
+	}
+	if ipv6 {
+		if err := setSysctl(stateDir, ipv6ForwardingSysctl, "1"); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %v", err)
+		}
+	}
+	return nil
+}
+
+// restoreForwarding puts IP forwarding back the way it was before setForwarding
+func restoreForwarding(stateDir string, logger *logrus.Logger) {
+	for _, path := range []string{ipv4ForwardingSysctl, ipv6ForwardingSysctl} {
+		if err := restoreSysctl(stateDir, path); err != nil {
+			logger.Warnf("Failed to restore IP forwarding: %v", err)
+		}
+	}
+}
+
+// flushStaleRoutes removes routes left behind by a previous run that did not shut down cleanly
+// Only Tuno routes through device or in one of tables are removed, so
+// another client or server on the same host keeps its routes. The client
+// also sets rejects to remove the unreachable routes it installs.
+func flushStaleRoutes(device string, tables []int, rejects bool, logger *logrus.Logger) {
+	linkIndex := -1
+	if link, err := netlink.LinkByName(device); err == nil {
+		linkIndex = link.Attrs().Index
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Protocol: routeProtocol, Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			logger.Debugf("Failed to list stale routes: %v", err)
+			continue
+		}
+		for i := range routes {
+			owned := routes[i].LinkIndex == linkIndex || slices.Contains(tables, routes[i].Table) ||
+				(rejects && routes[i].Type == unix.RTN_UNREACHABLE)
+			if !owned {
+				continue
+			}
+			if err := netlink.RouteDel(&routes[i]); err == nil {
+				logger.Infof("Removed stale route %s", routes[i].Dst)
+			}
+		}
+	}
+}
+
+// splitNetwork returns the two halves of a network
+func splitNetwork(network *net.IPNet) []*net.IPNet {
+	ones, total := network.Mask.Size()
+	if ones == total {
+		return []*net.IPNet{network}
+	}
+
+	mask := net.CIDRMask(ones+1, total)
+	low := &net.IPNet{IP: network.IP.Mask(network.Mask), Mask: mask}
+
+	highIP := make(net.IP, len(low.IP))
+	copy(highIP, low.IP)
+	highIP[ones/8] |= 0x80 >> uint(ones%8)
+	high := &net.IPNet{IP: highIP, Mask: mask}
+
+	return []*net.IPNet{low, high}
+}
+
+// isConnectedSubnet reports whether a network is exactly a subnet directly
+// connected to an interface other than the given one
+func isConnectedSubnet(network *net.IPNet, excludeLink int) bool {
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.LinkIndex == excludeLink {
+			continue
+		}
+		if addr.Mask.String() == network.Mask.String() && addr.IP.Mask(addr.Mask).Equal(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostIPNet returns the single-address network for an IP
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+// isNotExist reports whether a netlink error means the object is already gone
+func isNotExist(err error) bool {
+	return errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOENT)
+}
@@ -14,8 +14,8 @@ const (
 	IPv4Version = 4
 	// IPv6 protocol version
 	IPv6Version = 6
-	// Maximum packet size
-	MaxPacketSize = 1500
+	// Maximum IP packet size, the actual limit is the tunnel MTU
+	MaxPacketSize = 65535
 )
 
 // PacketType represents the type of IP packet
@@ -44,6 +44,18 @@ type Packet struct {
 	Type PacketType
 }
 
+// Flow identifies the connection a packet belongs to
+type Flow struct {
+	// Protocol number of the transport header
+	Protocol int
+	// Source and destination IP addresses
+	Source      net.IP
+	Destination net.IP
+	// Source and destination ports, zero for protocols without ports
+	SourcePort      uint16
+	DestinationPort uint16
+}
+
 // ParsePacket parses a raw IP packet and extracts key information
 func ParsePacket(data []byte) (*Packet, error) {
 	if len(data) < 1 {
@@ -53,8 +65,6 @@ func ParsePacket(data []byte) (*Packet, error) {
 	// Check IP version in the first byte
 	version := (data[0] >> 4) & 0x0F
 
-	var pkt *Packet
-
 	switch version {
 	case IPv4Version:
 		return parseIPv4Packet(data)
@@ -105,6 +115,77 @@ func parseIPv6Packet(data []byte) (*Packet, error) {
 	}, nil
 }
 
+// IsFragment returns true if the packet is a non-first IPv4 fragment
+func (p *Packet) IsFragment() bool {
+	if p.Type != PacketTypeIPv4 {
+		return false
+	}
+	// Fragment offset is the low 13 bits of offset 6-7
+	return binary.BigEndian.Uint16(p.Data[6:8])&0x1FFF != 0
+}
+
+// DontFragment returns true if the IPv4 DF bit is set
+// IPv6 packets are never fragmented in transit, so they always report true
+func (p *Packet) DontFragment() bool {
+	if p.Type == PacketTypeIPv6 {
+		return true
+	}
+	// DF is bit 1 of the flags at offset 6
+	return p.Data[6]&0x40 != 0
+}
+
+// TransportHeader returns the offset and protocol of the transport header
+// IPv6 extension headers are skipped. The offset is -1 for non-first fragments.
+func (p *Packet) TransportHeader() (int, int) {
+	switch p.Type {
+	case PacketTypeIPv4:
+		if p.IsFragment() {
+			return -1, p.Protocol
+		}
+		return int(p.Data[0]&0x0F) * 4, p.Protocol
+	case PacketTypeIPv6:
+		offset := ipv6.HeaderLen
+		next := int(p.Data[6])
+		for {
+			switch next {
+			case 0, 43, 60: // Hop-by-hop, routing and destination options
+				if len(p.Data) < offset+8 {
+					return -1, next
+				}
+				next, offset = int(p.Data[offset]), offset+(int(p.Data[offset+1])+1)*8
+			case 44: // Fragment header
+				if len(p.Data) < offset+8 {
+					return -1, next
+				}
+				// Only the first fragment carries the transport header
+				if binary.BigEndian.Uint16(p.Data[offset+2:offset+4])&0xFFF8 != 0 {
+					return -1, int(p.Data[offset])
+				}
+				next, offset = int(p.Data[offset]), offset+8
+			default:
+				return offset, next
+			}
+		}
+	}
+	return -1, p.Protocol
+}
+
+// Flow returns the 5-tuple of the packet
+// Ports are only set for TCP and UDP, and are zero for non-first fragments.
+func (p *Packet) Flow() Flow {
+	offset, protocol := p.TransportHeader()
+	flow := Flow{
+		Protocol:    protocol,
+		Source:      p.Source,
+		Destination: p.Destination,
+	}
+	if (protocol == protocolTCP || protocol == protocolUDP) && offset >= 0 && len(p.Data) >= offset+4 {
+		flow.SourcePort = binary.BigEndian.Uint16(p.Data[offset : offset+2])
+		flow.DestinationPort = binary.BigEndian.Uint16(p.Data[offset+2 : offset+4])
+	}
+	return flow
+}
+
 // GetDestinationNetwork returns the destination network for routing decisions
 func (p *Packet) GetDestinationNetwork() string {
 	return p.Destination.String()
@@ -237,3 +318,44 @@ func recalculateIPv4Checksum(packet []byte, oldAddr, newAddr []byte) {
 	// Write new checksum back to packet
 	binary.BigEndian.PutUint16(packet[10:12], newChecksum)
 }
+
+// checksumAdd adds data to a running ones' complement sum
+func checksumAdd(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	// Pad an odd trailing byte with zero
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds a running sum into a final 16-bit Internet checksum
+func checksumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// checksumUpdate16 incrementally updates a checksum after a 16-bit field changes (RFC 1624)
+func checksumUpdate16(checksum, oldValue, newValue uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^oldValue) + uint32(newValue)
+	return checksumFold(sum)
+}
+
+// pseudoHeaderSum returns the partial checksum of the TCP/UDP/ICMPv6 pseudo-header
+func pseudoHeaderSum(src, dst net.IP, protocol int, length int) uint32 {
+	var sum uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		sum = checksumAdd(sum, src4)
+		sum = checksumAdd(sum, dst4)
+	} else {
+		sum = checksumAdd(sum, src.To16())
+		sum = checksumAdd(sum, dst.To16())
+	}
+	sum += uint32(protocol)
+	sum += uint32(length)
+	return sum
+}
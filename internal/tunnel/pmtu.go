@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// MinTunnelMTU is the smallest MTU we will configure on the tunnel (IPv4 minimum reassembly size)
+	MinTunnelMTU = 576
+
+	// Worst-case TLS record overhead: header, explicit nonce and AEAD tag
+	tlsRecordOverhead = 5 + 8 + 16
+	// TCP header including the timestamp option
+	tcpOverhead = tcpHeaderLen + 12
+)
+
+// socketPathMTU returns the kernel's path MTU estimate for a connected TCP socket
+func socketPathMTU(conn net.Conn) (int, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var mtu int
+	var sockErr error
+	ipv6Socket := false
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6Socket = true
+	}
+
+	err = raw.Control(func(fd uintptr) {
+		if ipv6Socket {
+			mtu, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		} else {
+			mtu, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+		}
+	})
+	if err != nil || sockErr != nil || mtu <= 0 {
+		return 0, false
+	}
+
+	// Convert the IP MTU into the largest frame payload a single segment can carry
+	ipOverhead := ipv4.HeaderLen
+	if ipv6Socket {
+		ipOverhead = ipv6.HeaderLen
+	}
+	return mtu - ipOverhead - tcpOverhead - tlsRecordOverhead - frameHeaderLen, true
+}
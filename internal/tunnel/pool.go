@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Most addresses tried when looking for a free one, which bounds the search in large IPv6 pools
+const maxPoolSearch = 1 << 16
+
+// errLeaseInUse is returned for a key whose lease a connected client holds
+var errLeaseInUse = errors.New("lease is in use by another connection")
+
+// Lease binds a pool address to a client key
+// In a prefix pool Addr is the first address of the leased prefix.
+type Lease struct {
+	Key     string     `json:"key"`
+	Addr    netip.Addr `json:"addr"`
+	Expires time.Time  `json:"expires"`
+	active  bool
+}
+
+// AddressPool hands out tunnel addresses, or whole prefixes, from a prefix
+// Addresses are leased to a key, usually the client's identity, so a client
+// reconnecting within the lease time gets its previous address back.
+type AddressPool struct {
+	prefix    netip.Prefix
+	bits      int
+	reserved  map[netip.Addr]bool
+	leases    map[string]*Lease
+	byAddr    map[netip.Addr]*Lease
+	leaseTime time.Duration
+	next      netip.Addr
+	mutex     sync.Mutex
+}
+
+// NewAddressPool creates a pool for the addresses of prefix
+// The reserved addresses, such as the server's own, are never handed out,
+// and neither are the network and IPv4 broadcast addresses.
+func NewAddressPool(prefix netip.Prefix, leaseTime time.Duration, reserved ...netip.Addr) *AddressPool {
+	p := newPool(prefix, prefix.Addr().BitLen(), leaseTime)
+	p.next = p.prefix.Addr().Next()
+
+	p.reserved[p.prefix.Addr()] = true
+	if p.prefix.Addr().Is4() {
+		p.reserved[lastAddr(p.prefix)] = true
+	}
+	for _, addr := range reserved {
+		p.reserved[addr.Unmap()] = true
+	}
+	return p
+}
+
+// NewPrefixPool creates a pool leasing the prefixes of length bits within prefix,
+// such as the /64s of a /56 delegated to site-to-site clients
+func NewPrefixPool(prefix netip.Prefix, bits int, leaseTime time.Duration) (*AddressPool, error) {
+	if bits <= 0 || bits < prefix.Bits() || bits > prefix.Addr().BitLen() {
+		return nil, fmt.Errorf("cannot split %s into /%d prefixes", prefix, bits)
+	}
+	return newPool(prefix, bits, leaseTime), nil
+}
+
+// newPool creates an empty pool leasing blocks of length bits
+func newPool(prefix netip.Prefix, bits int, leaseTime time.Duration) *AddressPool {
+	prefix = prefix.Masked()
+	return &AddressPool{
+		prefix:    prefix,
+		bits:      bits,
+		reserved:  make(map[netip.Addr]bool),
+		leases:    make(map[string]*Lease),
+		byAddr:    make(map[netip.Addr]*Lease),
+		leaseTime: leaseTime,
+		next:      prefix.Addr(),
+	}
+}
+
+// Prefix returns the prefix addresses are allocated from
+func (p *AddressPool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Bits returns the prefix length of a leased block, the address length for address pools
+func (p *AddressPool) Bits() int {
+	return p.bits
+}
+
+// Acquire returns the address leased to key, leasing a free one if there is none
+// A lease is held by one connection at a time; while it is, Acquire returns errLeaseInUse.
+func (p *AddressPool) Acquire(key string) (netip.Addr, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Sharing a lease would route the holder's traffic to the new connection
+	if lease, ok := p.leases[key]; ok {
+		if lease.active {
+			return netip.Addr{}, errLeaseInUse
+		}
+		lease.active = true
+		lease.Expires = time.Time{}
+		return lease.Addr, nil
+	}
+
+	now := time.Now()
+	addr := p.next
+	for i := 0; i < maxPoolSearch; i++ {
+		if !p.prefix.Contains(addr) {
+			addr = p.prefix.Addr()
+		}
+		candidate := addr
+		addr = nextBlock(addr, p.bits)
+
+		if p.reserved[candidate] {
+			continue
+		}
+		if lease, ok := p.byAddr[candidate]; ok {
+			// Expired leases of disconnected clients are reused
+			if lease.active || now.Before(lease.Expires) {
+				continue
+			}
+			delete(p.leases, lease.Key)
+			delete(p.byAddr, candidate)
+		}
+
+		lease := &Lease{Key: key, Addr: candidate, active: true}
+		p.leases[key] = lease
+		p.byAddr[candidate] = lease
+		p.next = addr
+		return candidate, nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("address pool %s is exhausted", p.prefix)
+}
+
+// Release marks the address leased to key as unused
+// The lease is kept until the lease time has passed.
+func (p *AddressPool) Release(key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	lease, ok := p.leases[key]
+	if !ok || !lease.active {
+		return
+	}
+	lease.active = false
+	lease.Expires = time.Now().Add(p.leaseTime)
+}
+
+// Remove drops the lease of key at once, freeing its address
+func (p *AddressPool) Remove(key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if lease, ok := p.leases[key]; ok {
+		delete(p.leases, key)
+		delete(p.byAddr, lease.Addr)
+	}
+}
+
+// Restore re-creates leases saved before a restart
+// Clients that were connected when the leases were saved get the full lease
+// time to come back. Leases outside the pool, on reserved addresses or for
+// keys that already hold one are ignored.
+func (p *AddressPool) Restore(leases []Lease) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	for _, saved := range leases {
+		addr := saved.Addr.Unmap()
+		if !p.prefix.Contains(addr) || p.reserved[addr] || addr != netip.PrefixFrom(addr, p.bits).Masked().Addr() {
+			continue
+		}
+		if _, ok := p.leases[saved.Key]; ok {
+			continue
+		}
+		if _, ok := p.byAddr[addr]; ok {
+			continue
+		}
+
+		lease := &Lease{Key: saved.Key, Addr: addr, Expires: saved.Expires}
+		if lease.Expires.IsZero() {
+			lease.Expires = now.Add(p.leaseTime)
+		}
+		p.leases[lease.Key] = lease
+		p.byAddr[addr] = lease
+	}
+}
+
+// Leases returns a copy of all leases
+func (p *AddressPool) Leases() []Lease {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	leases := make([]Lease, 0, len(p.leases))
+	for _, lease := range p.leases {
+		leases = append(leases, *lease)
+	}
+	return leases
+}
+
+// nextBlock returns the first address of the block of length bits following addr
+func nextBlock(addr netip.Addr, bits int) netip.Addr {
+	if bits == addr.BitLen() {
+		return addr.Next()
+	}
+	bytes := addr.AsSlice()
+	for i := (bits - 1) / 8; i >= 0; i-- {
+		step := byte(1)
+		if i == (bits-1)/8 {
+			step = 0x80 >> ((bits - 1) % 8)
+		}
+		bytes[i] += step
+		if bytes[i] >= step {
+			break
+		}
+	}
+	next, _ := netip.AddrFromSlice(bytes)
+	return next
+}
+
+// lastAddr returns the highest address of a prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
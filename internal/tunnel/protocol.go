@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// FrameType identifies the content of a tunnel frame
+type FrameType byte
+
+const (
+	// FrameTypeData carries a single IP packet
+	FrameTypeData FrameType = iota + 1
+	// FrameTypeControl carries a JSON encoded ControlMessage
+	FrameTypeControl
+	// FrameTypeFragment carries part of an IP packet too large for a single frame
+	FrameTypeFragment
+)
+
+const (
+	// Frame header on stream transports: 1 byte type, 2 byte payload length
+	frameHeaderLen = 3
+	// Largest payload a single frame can carry
+	maxFramePayload = 0xFFFF
+	// Buffer size needed to read any frame payload
+	MaxFrameSize = maxFramePayload
+)
+
+// Control message types
+const (
+	// ControlTypeMTU announces the tunnel MTU chosen by the sender
+	ControlTypeMTU = "mtu"
+	// ControlTypeHello identifies the client after connecting
+	ControlTypeHello = "hello"
+	// ControlTypeConfig pushes the server-assigned client settings
+	ControlTypeConfig = "config"
+	// ControlTypeApplied reports the settings the client applied
+	ControlTypeApplied = "applied"
+	// ControlTypeKeepalive keeps an idle connection alive
+	ControlTypeKeepalive = "keepalive"
+)
+
+// ClientSettings is the configuration the server pushes to a client after it says hello
+type ClientSettings struct {
+	Address          string   `json:"address"`
+	Address6         string   `json:"address6,omitempty"`
+	DelegatedPrefix  string   `json:"delegated_prefix,omitempty"`
+	Routes           []string `json:"routes,omitempty"`
+	DNS              []string `json:"dns,omitempty"`
+	Domains          []string `json:"domains,omitempty"`
+	MTU              int      `json:"mtu,omitempty"`
+	Keepalive        int      `json:"keepalive,omitempty"`
+	KeepaliveTimeout int      `json:"keepalive_timeout,omitempty"`
+}
+
+// ControlMessage is exchanged between client and server on the control channel
+type ControlMessage struct {
+	Type       string          `json:"type"`
+	MTU        int             `json:"mtu,omitempty"`
+	MaxPayload int             `json:"max_payload,omitempty"`
+	Username   string          `json:"username,omitempty"`
+	Device     string          `json:"device,omitempty"`
+	Networks   []string        `json:"networks,omitempty"`
+	Settings   *ClientSettings `json:"settings,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// FrameConn carries typed frames over a transport connection
+// Packets larger than the configured payload limit are split into fragments
+// and reassembled transparently on the receiving side.
+type FrameConn struct {
+	conn        TransportConn
+	maxPayload  atomic.Int32
+	nextFragID  atomic.Uint32
+	reassembler *Reassembler
+}
+
+// NewFrameConn wraps a transport connection with tunnel framing
+func NewFrameConn(conn TransportConn) *FrameConn {
+	return &FrameConn{
+		conn:        conn,
+		reassembler: NewReassembler(),
+	}
+}
+
+// SetMaxPayload sets the largest packet sent in a single frame (0 = no limit)
+func (f *FrameConn) SetMaxPayload(size int) {
+	f.maxPayload.Store(int32(size))
+}
+
+// MaxPayload returns the largest packet sent in a single frame (0 = no limit)
+func (f *FrameConn) MaxPayload() int {
+	return int(f.maxPayload.Load())
+}
+
+// WriteFrame writes a single frame
+func (f *FrameConn) WriteFrame(frameType FrameType, payload []byte) error {
+	if len(payload) > maxFramePayload {
+		return fmt.Errorf("frame payload too large: %d bytes", len(payload))
+	}
+	return f.conn.SendFrame(frameType, payload)
+}
+
+// ReadFrame reads the next frame into buf and returns its type and payload
+// Fragments are consumed internally and surface as a data frame once the packet is complete.
+func (f *FrameConn) ReadFrame(buf []byte) (FrameType, []byte, error) {
+	for {
+		frameType, payload, err := f.conn.ReceiveFrame(buf)
+		if err != nil || frameType != FrameTypeFragment {
+			return frameType, payload, err
+		}
+
+		packet, err := f.reassembler.Add(payload)
+		if err != nil || packet == nil {
+			// Incomplete or broken packets are not fatal for the connection
+			continue
+		}
+		if len(packet) > len(buf) {
+			continue
+		}
+		return FrameTypeData, buf[:copy(buf, packet)], nil
+	}
+}
+
+// WritePacket sends an IP packet as a data frame, fragmenting it if it exceeds the payload limit
+func (f *FrameConn) WritePacket(packet []byte) error {
+	limit := f.MaxPayload()
+	if limit == 0 || len(packet) <= limit {
+		return f.WriteFrame(FrameTypeData, packet)
+	}
+
+	fragments, err := fragmentPacket(f.nextFragID.Add(1), packet, limit)
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		if err := f.WriteFrame(FrameTypeFragment, fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteControl sends a control message
+func (f *FrameConn) WriteControl(msg *ControlMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode control message: %v", err)
+	}
+	return f.WriteFrame(FrameTypeControl, payload)
+}
+
+// Close closes the underlying connection
+func (f *FrameConn) Close() error {
+	return f.conn.Close()
+}
+
+// ParseControlMessage decodes a control frame payload
+func ParseControlMessage(payload []byte) (*ControlMessage, error) {
+	var msg ControlMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, fmt.Errorf("invalid control message: %v", err)
+	}
+	return &msg, nil
+}
@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// DropPolicy decides which packet is discarded when a send queue is full
+type DropPolicy int
+
+const (
+	// DropPolicyTail discards the packet being enqueued
+	DropPolicyTail DropPolicy = iota
+	// DropPolicyOldest discards the oldest queued packet to make room
+	DropPolicyOldest
+)
+
+// ParseDropPolicy parses a drop policy name from the configuration
+func ParseDropPolicy(name string) (DropPolicy, error) {
+	switch name {
+	case "", "tail", "tail-drop":
+		return DropPolicyTail, nil
+	case "oldest", "drop-oldest":
+		return DropPolicyOldest, nil
+	default:
+		return DropPolicyTail, fmt.Errorf("unknown queue drop policy: %s", name)
+	}
+}
+
+// String returns the configuration name of the policy
+func (p DropPolicy) String() string {
+	if p == DropPolicyOldest {
+		return "drop-oldest"
+	}
+	return "tail-drop"
+}
+
+// SendQueue is a bounded packet queue drained by a dedicated writer goroutine,
+// so that a slow connection only delays its own packets
+type SendQueue struct {
+	packets   chan []byte
+	policy    DropPolicy
+	done      chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Uint64
+}
+
+// NewSendQueue creates a queue holding up to depth packets
+func NewSendQueue(depth int, policy DropPolicy) *SendQueue {
+	if depth < 1 {
+		depth = 1
+	}
+	return &SendQueue{
+		packets: make(chan []byte, depth),
+		policy:  policy,
+		done:    make(chan struct{}),
+	}
+}
+
+// Enqueue queues a copy of packet without blocking
+// Returns false if the queue was full and the drop policy had to discard a packet.
+func (q *SendQueue) Enqueue(packet []byte) bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+
+	data := make([]byte, len(packet))
+	copy(data, packet)
+
+	select {
+	case q.packets <- data:
+		return true
+	default:
+	}
+
+	// Queue is full
+	if q.policy == DropPolicyOldest {
+		// Discard the oldest packet, unless the writer just made room itself
+		select {
+		case <-q.packets:
+			q.dropped.Add(1)
+		default:
+		}
+
+		select {
+		case q.packets <- data:
+			return false
+		default:
+			// Another producer took the free slot, drop the new packet too
+		}
+	}
+
+	q.dropped.Add(1)
+	return false
+}
+
+// Run writes queued packets until the queue is closed or a write fails
+func (q *SendQueue) Run(write func([]byte) error) error {
+	for {
+		select {
+		case packet := <-q.packets:
+			if err := write(packet); err != nil {
+				return err
+			}
+		case <-q.done:
+			return nil
+		}
+	}
+}
+
+// Close stops the writer and discards any queued packets
+func (q *SendQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+}
+
+// Len returns the number of packets waiting to be written
+func (q *SendQueue) Len() int {
+	return len(q.packets)
+}
+
+// Dropped returns the number of packets discarded because the queue was full
+func (q *SendQueue) Dropped() uint64 {
+	return q.dropped.Load()
+}
@@ -0,0 +1,46 @@
+package tunnel
+
+// Sequence numbers behind the highest one received that are still accepted
+const replayWindowSize = 2048
+
+// ReplayWindow rejects duplicated and stale sequence numbers (RFC 6479)
+// The bitmap is a ring of words, so sliding the window only clears the words
+// it moves over instead of shifting the whole bitmap.
+type ReplayWindow struct {
+	highest uint64
+	bitmap  [replayWindowSize / 64]uint64
+}
+
+// Check reports whether seq has not been seen and is recent enough, without recording it
+// Sequence numbers start at 1.
+func (w *ReplayWindow) Check(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > w.highest {
+		return true
+	}
+	if w.highest/64-seq/64 >= uint64(len(w.bitmap)) {
+		return false
+	}
+	return w.bitmap[(seq/64)%uint64(len(w.bitmap))]&(1<<(seq%64)) == 0
+}
+
+// Accept records seq once the packet carrying it has been authenticated
+func (w *ReplayWindow) Accept(seq uint64) {
+	words := uint64(len(w.bitmap))
+	if seq > w.highest {
+		// Clear the words the window slides over
+		if from, to := w.highest/64+1, seq/64; to >= from {
+			if to-from >= words {
+				w.bitmap = [replayWindowSize / 64]uint64{}
+			} else {
+				for i := from; i <= to; i++ {
+					w.bitmap[i%words] = 0
+				}
+			}
+		}
+		w.highest = seq
+	}
+	w.bitmap[(seq/64)%words] |= 1 << (seq % 64)
+}
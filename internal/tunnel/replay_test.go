@@ -0,0 +1,80 @@
+package tunnel
+
+import "testing"
+
+// receive checks and accepts seq like handleDatagram does for an authentic datagram
+func receive(w *ReplayWindow, seq uint64) bool {
+	if !w.Check(seq) {
+		return false
+	}
+	w.Accept(seq)
+	return true
+}
+
+func TestReplayWindowRejectsDuplicates(t *testing.T) {
+	var w ReplayWindow
+
+	if w.Check(0) {
+		t.Error("sequence number 0 was accepted")
+	}
+	for _, seq := range []uint64{1, 2, 5, 3} {
+		if !receive(&w, seq) {
+			t.Errorf("first %d was rejected", seq)
+		}
+	}
+	for _, seq := range []uint64{1, 2, 3, 5} {
+		if receive(&w, seq) {
+			t.Errorf("duplicate %d was accepted", seq)
+		}
+	}
+	if !receive(&w, 4) {
+		t.Error("reordered 4 was rejected")
+	}
+}
+
+func TestReplayWindowCheckDoesNotRecord(t *testing.T) {
+	var w ReplayWindow
+
+	// A forged datagram is checked but never accepted
+	if !w.Check(10) || !w.Check(10) {
+		t.Fatal("Check of an unseen sequence number failed")
+	}
+	if !receive(&w, 10) {
+		t.Error("sequence number only checked before was rejected")
+	}
+}
+
+func TestReplayWindowSlides(t *testing.T) {
+	var w ReplayWindow
+
+	receive(&w, 1)
+	receive(&w, replayWindowSize+100)
+
+	if w.Check(1) || w.Check(50) {
+		t.Error("sequence number behind the window was accepted")
+	}
+	if !receive(&w, replayWindowSize+100-replayWindowSize/2) {
+		t.Error("sequence number within the window was rejected")
+	}
+
+	// Bits left by earlier rounds of the ring are cleared as the window slides over them
+	for seq := uint64(replayWindowSize + 101); seq < 4*replayWindowSize; seq += 63 {
+		if !receive(&w, seq) {
+			t.Fatalf("new %d was rejected", seq)
+		}
+	}
+	if !receive(&w, 4*replayWindowSize-10) {
+		t.Error("unseen sequence number after sliding was rejected")
+	}
+
+	// A jump far beyond the window clears it completely
+	high := uint64(100 * replayWindowSize)
+	if !receive(&w, high) {
+		t.Fatal("jump ahead was rejected")
+	}
+	for seq := high - 1; seq > high-replayWindowSize/2; seq -= 97 {
+		if !receive(&w, seq) {
+			t.Errorf("unseen %d after a jump was rejected", seq)
+		}
+	}
+}
@@ -3,8 +3,14 @@ package tunnel
 import (
 	"fmt"
 	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,27 +26,222 @@ const (
 	RouteTypeDrop
 )
 
+// String returns the configuration name of the route type
+func (t RouteType) String() string {
+	switch t {
+	case RouteTypeTUN:
+		return "tun"
+	case RouteTypeInternet:
+		return "internet"
+	case RouteTypeDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("RouteType(%d)", int(t))
+	}
+}
+
+// ParseRouteType parses a route type name from the configuration
+func ParseRouteType(name string) (RouteType, error) {
+	switch name {
+	case "tun", "vpn":
+		return RouteTypeTUN, nil
+	case "internet", "direct":
+		return RouteTypeInternet, nil
+	case "drop", "block":
+		return RouteTypeDrop, nil
+	default:
+		return RouteTypeInternet, fmt.Errorf("unknown route type: %s", name)
+	}
+}
+
+// RouteChangeHandler is called after a route is added, updated or removed
+type RouteChangeHandler func(route Route, removed bool)
+
 // Route represents a network route
 type Route struct {
 	// Network CIDR (e.g., 192.168.1.0/24)
 	Network *net.IPNet
 	// Type of routing to apply
 	Type RouteType
+	// Name of the route set the route belongs to, empty for individual routes
+	Set string
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// Contains reports whether port lies within the range
+func (p PortRange) Contains(port uint16) bool {
+	return port >= p.First && port <= p.Last
+}
+
+// String returns the range in configuration form
+func (p PortRange) String() string {
+	if p.First == p.Last {
+		return strconv.Itoa(int(p.First))
+	}
+	return fmt.Sprintf("%d-%d", p.First, p.Last)
+}
+
+// Rule routes traffic by protocol and destination port
+// Rules are evaluated in ascending priority order before the routing table, and
+// the first rule matching a packet decides how it is routed.
+type Rule struct {
+	// Lower priorities are evaluated first
+	Priority int
+	// Destination network, nil matches any destination
+	Network *net.IPNet
+	// Protocol number, 0 matches any protocol and ICMP matches ICMPv6 too
+	Protocol int
+	// Destination ports, empty matches any port
+	Ports []PortRange
+	// Type of routing to apply
+	Type RouteType
+}
+
+// Match reports whether the rule applies to a flow
+func (rule *Rule) Match(flow Flow) bool {
+	if rule.Network != nil && !rule.Network.Contains(flow.Destination) {
+		return false
+	}
+
+	switch rule.Protocol {
+	case 0:
+	case protocolICMPv4:
+		if flow.Protocol != protocolICMPv4 && flow.Protocol != protocolICMPv6 {
+			return false
+		}
+	default:
+		if flow.Protocol != rule.Protocol {
+			return false
+		}
+	}
+
+	if len(rule.Ports) == 0 {
+		return true
+	}
+	if flow.Protocol != protocolTCP && flow.Protocol != protocolUDP {
+		return false
+	}
+	for _, ports := range rule.Ports {
+		if ports.Contains(flow.DestinationPort) {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the rule for logging
+func (rule *Rule) String() string {
+	parts := []string{fmt.Sprintf("priority %d", rule.Priority)}
+	if rule.Protocol != 0 {
+		parts = append(parts, protocolName(rule.Protocol))
+	}
+	if rule.Network != nil {
+		parts = append(parts, "to "+rule.Network.String())
+	}
+	if len(rule.Ports) > 0 {
+		ports := make([]string, len(rule.Ports))
+		for i, p := range rule.Ports {
+			ports[i] = p.String()
+		}
+		parts = append(parts, "port "+strings.Join(ports, ","))
+	}
+	return strings.Join(parts, " ") + " as " + rule.Type.String()
+}
+
+// ParseRule parses a routing rule from the configuration
+func ParseRule(cfg config.RuleConfig) (Rule, error) {
+	rule := Rule{Priority: cfg.Priority}
+
+	var err error
+	if rule.Type, err = ParseRouteType(cfg.Type); err != nil {
+		return rule, err
+	}
+
+	if cfg.Network != "" {
+		if _, rule.Network, err = net.ParseCIDR(cfg.Network); err != nil {
+			return rule, fmt.Errorf("invalid CIDR: %v", err)
+		}
+	}
+
+	switch strings.ToLower(cfg.Protocol) {
+	case "", "any":
+	case "tcp":
+		rule.Protocol = protocolTCP
+	case "udp":
+		rule.Protocol = protocolUDP
+	case "icmp":
+		rule.Protocol = protocolICMPv4
+	default:
+		return rule, fmt.Errorf("unknown protocol: %s", cfg.Protocol)
+	}
+
+	for _, ports := range cfg.Ports {
+		portRange, err := parsePortRange(ports)
+		if err != nil {
+			return rule, err
+		}
+		rule.Ports = append(rule.Ports, portRange)
+	}
+	if len(rule.Ports) > 0 && rule.Protocol != 0 && rule.Protocol != protocolTCP && rule.Protocol != protocolUDP {
+		return rule, fmt.Errorf("ports require tcp or udp")
+	}
+
+	return rule, nil
+}
+
+// parsePortRange parses a port or a first-last port range
+func parsePortRange(s string) (PortRange, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		last = first
+	}
+
+	start, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	end, err := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+	if err != nil || end < start {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{First: uint16(start), Last: uint16(end)}, nil
+}
+
+// protocolName returns the configuration name of a protocol number
+func protocolName(protocol int) string {
+	switch protocol {
+	case protocolTCP:
+		return "tcp"
+	case protocolUDP:
+		return "udp"
+	case protocolICMPv4, protocolICMPv6:
+		return "icmp"
+	default:
+		return strconv.Itoa(protocol)
+	}
 }
 
 // Router handles packet routing decisions
+// Routes live in a longest-prefix-match table, so lookups cost the same
+// regardless of how many routes are installed. Rules are replaced as a whole
+// on every change, so packets are matched against them without locking.
 type Router struct {
-	routes    []Route
-	mutex     sync.RWMutex
-	logger    *logrus.Logger
-	ipv4Count int
-	ipv6Count int
+	table    *PrefixTable[Route]
+	rules    atomic.Pointer[[]Rule]
+	onChange RouteChangeHandler
+	mutex    sync.Mutex
+	logger   *logrus.Logger
 }
 
 // NewRouter creates a new router with default routes
 func NewRouter(logger *logrus.Logger) *Router {
 	r := &Router{
-		routes: make([]Route, 0),
+		table:  NewPrefixTable[Route](),
 		logger: logger,
 	}
 
@@ -50,6 +251,42 @@ func NewRouter(logger *logrus.Logger) *Router {
 	return r
 }
 
+// NewRouterFromConfig creates a router holding only the configured routes and rules
+func NewRouterFromConfig(routes []config.RouteConfig, rules []config.RuleConfig, logger *logrus.Logger) (*Router, error) {
+	r := &Router{
+		table:  NewPrefixTable[Route](),
+		logger: logger,
+	}
+
+	for _, route := range routes {
+		routeType, err := ParseRouteType(route.Type)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", route.Network, err)
+		}
+		if err := r.AddRoute(route.Network, routeType); err != nil {
+			return nil, fmt.Errorf("route %s: %v", route.Network, err)
+		}
+	}
+
+	for i, rc := range rules {
+		rule, err := ParseRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		r.AddRule(rule)
+	}
+
+	return r, nil
+}
+
+// SetChangeHandler registers a handler called after every routing table change
+// Handlers run with the router's write lock held, so changes are seen in order.
+func (r *Router) SetChangeHandler(handler RouteChangeHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.onChange = handler
+}
+
 // addPrivateNetworkRoutes adds routes for standard private networks
 func (r *Router) addPrivateNetworkRoutes() {
 	// RFC1918 private networks
@@ -72,93 +309,132 @@ func (r *Router) AddRoute(cidr string, routeType RouteType) error {
 	if err != nil {
 		return fmt.Errorf("invalid CIDR: %v", err)
 	}
+	prefix, ok := prefixFromIPNet(network)
+	if !ok {
+		return fmt.Errorf("invalid CIDR: %s", cidr)
+	}
 
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	// Check if we already have this route
-	for i, route := range r.routes {
-		if route.Network.String() == network.String() {
-			// Replace existing route
-			r.routes[i].Type = routeType
-			r.logger.Infof("Updated route %s to %v", cidr, routeType)
-			return nil
-		}
-	}
-
-	// Add new route
-	r.routes = append(r.routes, Route{
-		Network: network,
-		Type:    routeType,
-	})
-
-	// Update metrics
-	if network.IP.To4() != nil {
-		r.ipv4Count++
+	// Add the route, replacing any existing route for the same network
+	route := Route{Network: network, Type: routeType}
+	if r.table.Insert(prefix, route) {
+		r.logger.Infof("Added route %s as %v", cidr, routeType)
 	} else {
-		r.ipv6Count++
+		r.logger.Infof("Updated route %s to %v", cidr, routeType)
 	}
 
-	r.logger.Infof("Added route %s as %v", cidr, routeType)
+	if r.onChange != nil {
+		r.onChange(route, false)
+	}
 	return nil
 }
 
 // RemoveRoute removes a route from the routing table
+// Members of a route set are removed by changing the set instead.
 func (r *Router) RemoveRoute(cidr string) error {
 	_, network, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return fmt.Errorf("invalid CIDR: %v", err)
 	}
+	prefix, ok := prefixFromIPNet(network)
+	if !ok {
+		return fmt.Errorf("invalid CIDR: %s", cidr)
+	}
 
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	for i, route := range r.routes {
-		if route.Network.String() == network.String() {
-			// Remove route by swapping with last element and truncating
-			r.routes[i] = r.routes[len(r.routes)-1]
-			r.routes = r.routes[:len(r.routes)-1]
-
-			// Update metrics
-			if network.IP.To4() != nil {
-				r.ipv4Count--
-			} else {
-				r.ipv6Count--
+	route, ok := r.table.Get(prefix)
+	if !ok {
+		return fmt.Errorf("route not found: %s", cidr)
+	}
+	// The set would bring it back when it is next applied
+	if route.Set != "" {
+		return fmt.Errorf("route %s belongs to route set %s, remove it from the set file and import the set again", cidr, route.Set)
+	}
+	r.table.Delete(prefix)
+
+	r.logger.Infof("Removed route %s", cidr)
+	if r.onChange != nil {
+		r.onChange(route, true)
+	}
+	return nil
+}
+
+// ReplaceSet replaces the routes of a named set in a single step
+// Routes of the set missing from networks are removed and the rest are added,
+// so lookups never see a partially applied set. Networks that already have an
+// individual route or belong to another set are left alone. Passing no
+// networks removes the set.
+func (r *Router) ReplaceSet(name string, networks []*net.IPNet, routeType RouteType) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	inserts := make(map[netip.Prefix]Route, len(networks))
+	var added []Route
+	for _, network := range networks {
+		prefix, ok := prefixFromIPNet(network)
+		if !ok {
+			continue
+		}
+		current, found := r.table.Get(prefix)
+		if found && current.Set != name {
+			continue
+		}
+		route := Route{Network: network, Type: routeType, Set: name}
+		inserts[prefix] = route
+		// Only changed routes are passed on to the change handler
+		if !found || current.Type != routeType {
+			added = append(added, route)
+		}
+	}
+
+	var deletes []netip.Prefix
+	var removed []Route
+	r.table.Walk(func(prefix netip.Prefix, route Route) bool {
+		if route.Set == name {
+			if _, keep := inserts[prefix]; !keep {
+				deletes = append(deletes, prefix)
+				removed = append(removed, route)
 			}
+		}
+		return true
+	})
+
+	r.table.Update(deletes, inserts)
+	r.logger.Infof("Route set %s now has %d routes as %v (%d removed)", name, len(inserts), routeType, len(deletes))
 
-			r.logger.Infof("Removed route %s", cidr)
-			return nil
+	if r.onChange != nil {
+		for _, route := range removed {
+			r.onChange(route, true)
+		}
+		for _, route := range added {
+			r.onChange(route, false)
 		}
 	}
+}
 
-	return fmt.Errorf("route not found: %s", cidr)
+// HasRoute reports whether a route exists for exactly the given network
+func (r *Router) HasRoute(cidr string) bool {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	prefix, ok := prefixFromIPNet(network)
+	if !ok {
+		return false
+	}
+	_, found := r.table.Get(prefix)
+	return found
 }
 
 // GetRoute determines how a packet should be routed
 func (r *Router) GetRoute(ip net.IP) RouteType {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-
 	// Find the most specific route that matches the IP
-	var matchedRoute *Route
-	var matchedMaskSize int
-
-	for i := range r.routes {
-		route := &r.routes[i]
-		if route.Network.Contains(ip) {
-			// Get the mask size
-			maskSize, _ := route.Network.Mask.Size()
-
-			// If this is the first match or has a more specific mask
-			if matchedRoute == nil || maskSize > matchedMaskSize {
-				matchedRoute = route
-				matchedMaskSize = maskSize
-			}
-		}
-	}
-
-	if matchedRoute != nil {
-		return matchedRoute.Type
+	if route, ok := r.table.LookupIP(ip); ok {
+		return route.Type
 	}
 
 	// Default to internet routing if no match is found
@@ -167,22 +443,19 @@ func (r *Router) GetRoute(ip net.IP) RouteType {
 
 // GetRoutes returns a copy of all routes
 func (r *Router) GetRoutes() []Route {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-
-	// Create a copy to avoid race conditions
-	routes := make([]Route, len(r.routes))
-	copy(routes, r.routes)
-
+	v4, v6 := r.table.Len()
+	routes := make([]Route, 0, v4+v6)
+	r.table.Walk(func(_ netip.Prefix, route Route) bool {
+		routes = append(routes, route)
+		return true
+	})
 	return routes
 }
 
 // GetStats returns statistics about the routing table
 func (r *Router) GetStats() (int, int, int) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-
-	return len(r.routes), r.ipv4Count, r.ipv6Count
+	v4, v6 := r.table.Len()
+	return v4 + v6, v4, v6
 }
 
 // ClearRoutes removes all routes
@@ -190,14 +463,60 @@ func (r *Router) ClearRoutes() {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	r.routes = make([]Route, 0)
-	r.ipv4Count = 0
-	r.ipv6Count = 0
-
+	routes := r.GetRoutes()
+	r.table.Clear()
 	r.logger.Info("All routes cleared")
+
+	if r.onChange != nil {
+		for _, route := range routes {
+			r.onChange(route, true)
+		}
+	}
+}
+
+// AddRule adds a protocol and port rule
+// Rules with equal priority are evaluated in the order they were added.
+func (r *Router) AddRule(rule Rule) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rules := append(r.GetRules(), rule)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	r.rules.Store(&rules)
+
+	r.logger.Infof("Added rule %s", rule.String())
+}
+
+// GetRules returns a copy of all rules in evaluation order
+func (r *Router) GetRules() []Rule {
+	rules := r.rules.Load()
+	if rules == nil {
+		return nil
+	}
+	return append([]Rule(nil), *rules...)
+}
+
+// ClearRules removes all rules
+func (r *Router) ClearRules() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.rules.Store(nil)
+	r.logger.Info("All rules cleared")
 }
 
 // ShouldRoute determines if a packet should be routed over the VPN or direct
+// Rules matching the packet's protocol and ports take precedence over routes.
 func (r *Router) ShouldRoute(packet *Packet) RouteType {
+	if rules := r.rules.Load(); rules != nil && len(*rules) > 0 {
+		flow := packet.Flow()
+		for i := range *rules {
+			if (*rules)[i].Match(flow) {
+				return (*rules)[i].Type
+			}
+		}
+	}
 	return r.GetRoute(packet.Destination)
 }
@@ -0,0 +1,387 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// File in the state directory holding routes changed at runtime
+	routeStateFile = "routes.json"
+	// Route set holding the routes pushed by the server, set names starting with @ are reserved
+	pushedRouteSet = "@server"
+)
+
+// RouteSet is a named list of networks imported from a file and routed the same way
+type RouteSet struct {
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+	Count   int    `json:"count"`
+}
+
+// routeState is the persisted form of the runtime route changes
+type routeState struct {
+	Routes  map[string]string `json:"routes,omitempty"`
+	Removed []string          `json:"removed,omitempty"`
+	Sets    []*RouteSet       `json:"sets,omitempty"`
+}
+
+// RouteManager changes Router state at runtime and persists the changes
+// Routes added or removed through it and imported route sets are written to
+// the state directory and applied again when the client starts.
+type RouteManager struct {
+	router  *Router
+	path    string
+	routes  map[string]string
+	removed map[string]bool
+	sets    map[string]*RouteSet
+	mutex   sync.Mutex
+	logger  *logrus.Logger
+}
+
+// NewRouteManager creates a route manager persisting to stateDir
+func NewRouteManager(router *Router, stateDir string, logger *logrus.Logger) *RouteManager {
+	return &RouteManager{
+		router:  router,
+		path:    filepath.Join(stateDir, routeStateFile),
+		routes:  make(map[string]string),
+		removed: make(map[string]bool),
+		sets:    make(map[string]*RouteSet),
+		logger:  logger,
+	}
+}
+
+// Load applies the persisted route changes to the router
+// Sets whose file can no longer be read are kept, but not applied.
+func (m *RouteManager) Load() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read route state: %v", err)
+	}
+
+	var state routeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse route state %s: %v", m.path, err)
+	}
+
+	for _, cidr := range state.Removed {
+		m.removed[cidr] = true
+		m.router.RemoveRoute(cidr)
+	}
+	for cidr, name := range state.Routes {
+		routeType, err := ParseRouteType(name)
+		if err != nil {
+			return fmt.Errorf("route %s: %v", cidr, err)
+		}
+		if err := m.router.AddRoute(cidr, routeType); err != nil {
+			return fmt.Errorf("route %s: %v", cidr, err)
+		}
+		m.routes[cidr] = name
+	}
+	for _, set := range state.Sets {
+		m.sets[set.Name] = set
+		if !set.Enabled {
+			continue
+		}
+		if err := m.applySet(set); err != nil {
+			m.logger.Errorf("Failed to load route set %s: %v", set.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// AddRoute adds or updates a route
+func (m *RouteManager) AddRoute(cidr, typeName string) error {
+	routeType, err := ParseRouteType(typeName)
+	if err != nil {
+		return err
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR: %v", err)
+	}
+	cidr = network.String()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.router.AddRoute(cidr, routeType); err != nil {
+		return err
+	}
+	m.routes[cidr] = routeType.String()
+	delete(m.removed, cidr)
+	return m.save()
+}
+
+// RemoveRoute removes a route, including one from the configuration
+func (m *RouteManager) RemoveRoute(cidr string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR: %v", err)
+	}
+	cidr = network.String()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.router.RemoveRoute(cidr); err != nil {
+		return err
+	}
+	if _, ok := m.routes[cidr]; ok {
+		delete(m.routes, cidr)
+	} else {
+		m.removed[cidr] = true
+	}
+	return m.save()
+}
+
+// ImportSet loads a CIDR list file into a named set, replacing a set of the same name
+// An enabled set is swapped for the new list in a single step.
+func (m *RouteManager) ImportSet(name, file, typeName string, enabled bool) (*RouteSet, error) {
+	if name == "" {
+		return nil, fmt.Errorf("route set name cannot be empty")
+	}
+	if strings.HasPrefix(name, "@") {
+		return nil, fmt.Errorf("route set names starting with @ are reserved")
+	}
+	routeType, err := ParseRouteType(typeName)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	set := &RouteSet{Name: name, File: file, Type: routeType.String(), Enabled: enabled}
+	if enabled {
+		if err := m.applySet(set); err != nil {
+			return nil, err
+		}
+	} else {
+		networks, err := LoadCIDRList(file)
+		if err != nil {
+			return nil, err
+		}
+		set.Count = len(networks)
+		// The previous version of the set may be active
+		if current, ok := m.sets[name]; ok && current.Enabled {
+			m.router.ReplaceSet(name, nil, routeType)
+		}
+	}
+
+	m.sets[name] = set
+	return set, m.save()
+}
+
+// EnableSet routes the networks of a set, reading its file again
+func (m *RouteManager) EnableSet(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	set, ok := m.sets[name]
+	if !ok {
+		return fmt.Errorf("route set not found: %s", name)
+	}
+	if err := m.applySet(set); err != nil {
+		return err
+	}
+	set.Enabled = true
+	return m.save()
+}
+
+// DisableSet removes the routes of a set, keeping the set itself
+func (m *RouteManager) DisableSet(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	set, ok := m.sets[name]
+	if !ok {
+		return fmt.Errorf("route set not found: %s", name)
+	}
+	m.router.ReplaceSet(name, nil, RouteTypeTUN)
+	set.Enabled = false
+	return m.save()
+}
+
+// RemoveSet removes a set and its routes
+func (m *RouteManager) RemoveSet(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.sets[name]; !ok {
+		return fmt.Errorf("route set not found: %s", name)
+	}
+	m.router.ReplaceSet(name, nil, RouteTypeTUN)
+	delete(m.sets, name)
+	return m.save()
+}
+
+// Sets returns a copy of all route sets sorted by name
+func (m *RouteManager) Sets() []RouteSet {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	sets := make([]RouteSet, 0, len(m.sets))
+	for _, set := range m.sets {
+		sets = append(sets, *set)
+	}
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Name < sets[j].Name
+	})
+	return sets
+}
+
+// HandleControl executes route and route set control commands
+func (m *RouteManager) HandleControl(req *ControlRequest) *ControlResponse {
+	var err error
+	switch req.Command {
+	case ControlRouteAdd:
+		err = m.AddRoute(req.Network, req.Type)
+	case ControlRouteDel:
+		err = m.RemoveRoute(req.Network)
+	case ControlRouteList:
+		resp := &ControlResponse{Sets: m.Sets()}
+		for _, route := range m.router.GetRoutes() {
+			// Set members are summarised by their set
+			if route.Set != "" {
+				continue
+			}
+			resp.Routes = append(resp.Routes, RouteInfo{
+				Network: route.Network.String(),
+				Type:    route.Type.String(),
+			})
+		}
+		return resp
+	case ControlSetImport:
+		var set *RouteSet
+		if set, err = m.ImportSet(req.Name, req.File, req.Type, !req.Disabled); err == nil {
+			return &ControlResponse{Sets: []RouteSet{*set}}
+		}
+	case ControlSetEnable:
+		err = m.EnableSet(req.Name)
+	case ControlSetDisable:
+		err = m.DisableSet(req.Name)
+	case ControlSetRemove:
+		err = m.RemoveSet(req.Name)
+	default:
+		err = fmt.Errorf("unknown command: %s", req.Command)
+	}
+
+	if err != nil {
+		return &ControlResponse{Error: err.Error()}
+	}
+	return &ControlResponse{}
+}
+
+// applySet loads the file of a set and swaps its networks into the router
+func (m *RouteManager) applySet(set *RouteSet) error {
+	routeType, err := ParseRouteType(set.Type)
+	if err != nil {
+		return fmt.Errorf("route set %s: %v", set.Name, err)
+	}
+	networks, err := LoadCIDRList(set.File)
+	if err != nil {
+		return err
+	}
+
+	m.router.ReplaceSet(set.Name, networks, routeType)
+	set.Count = len(networks)
+	return nil
+}
+
+// save writes the runtime route changes to the state file
+func (m *RouteManager) save() error {
+	state := routeState{Routes: m.routes}
+	for cidr := range m.removed {
+		state.Removed = append(state.Removed, cidr)
+	}
+	sort.Strings(state.Removed)
+	for _, set := range m.sets {
+		state.Sets = append(state.Sets, set)
+	}
+	sort.Slice(state.Sets, func(i, j int) bool {
+		return state.Sets[i].Name < state.Sets[j].Name
+	})
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode route state: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	if err := writeFileAtomic(m.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write route state: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces a file in one step, so a crash never leaves half of it behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// LoadCIDRList reads a file with one network per line
+// Blank lines and # comments are ignored, and single addresses are treated as
+// host networks.
+func LoadCIDRList(path string) ([]*net.IPNet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network list %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var networks []*net.IPNet
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(text); ip != nil {
+			networks = append(networks, hostIPNet(ip))
+			continue
+		}
+		_, network, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid network %q", path, line, text)
+		}
+		networks = append(networks, network)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read network list %s: %v", path, err)
+	}
+	return networks, nil
+}
@@ -1,13 +1,16 @@
 package tunnel
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/cipher"
 	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/dns"
 	"github.com/sirupsen/logrus"
 )
 
@@ -17,23 +20,68 @@ type Tunneler interface {
 	Stop() error
 }
 
+// How often per-client counters are reported
+const clientStatsInterval = time.Minute
+
 // ClientInfo holds information about a connected client
 type ClientInfo struct {
 	ID           string
-	Conn         *cipher.TLSConn
+	Conn         TransportConn
 	TunIP        net.IP
+	TunIPv6      net.IP
+	Username     string
+	Device       string
+	Identity     string
+	Groups       []string
+	Networks     []*net.IPNet
+	Delegated    *net.IPNet
+	MTU          int
 	LastActivity time.Time
 	BytesIn      uint64
 	BytesOut     uint64
+	Settings     *ClientSettings
+	Applied      *ClientSettings
+
+	leaseKey string
+	names    []string
+	frames   *FrameConn
+	queue    *SendQueue
+	done     chan struct{}
+}
+
+// QueueStats returns the number of packets waiting in the client's send queue
+// and how many were dropped because it was full
+func (c *ClientInfo) QueueStats() (int, uint64) {
+	if c.queue == nil {
+		return 0, 0
+	}
+	return c.queue.Len(), c.queue.Dropped()
 }
 
 // Server represents a Tuno VPN server
 type Server struct {
 	config       *config.ServerConfig
-	listener     net.Listener
+	transport    Transport
+	listener     TransportListener
 	tunDevice    *TUNDevice
 	clients      map[string]*ClientInfo
+	names        map[string]*ClientInfo
 	clientsMutex sync.RWMutex
+	clientRoutes *PrefixTable[*ClientInfo]
+	pool         *AddressPool
+	pool6        *AddressPool
+	prefixPool   *AddressPool
+	delegates    map[string]bool
+	leasePath    string
+	leaseMutex   sync.Mutex
+	sites        map[string][]*net.IPNet
+	groups       map[string][]string
+	routes       *KernelRoutes
+	icmp         *ICMPGenerator
+	mssClamper   *MSSClamper
+	nat64        *NAT64
+	queuePolicy  DropPolicy
+	dnsServer    *dns.Server
 	isRunning    bool
 	stopCh       chan struct{}
 	logger       *logrus.Logger
@@ -41,12 +89,115 @@ type Server struct {
 
 // NewServer creates a new Tuno VPN server
 func NewServer(cfg *config.ServerConfig, logger *logrus.Logger) (*Server, error) {
+	queuePolicy, err := ParseDropPolicy(cfg.ClientQueuePolicy)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := NewServerTransport(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Client addresses are leased from the tunnel network
+	tunPrefix, err := netip.ParsePrefix(cfg.TunIP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUN IP address: %v", err)
+	}
+	leaseTime := time.Duration(cfg.LeaseTime) * time.Second
+
+	// IPv6-only clients reach IPv4 destinations through NAT64
+	var nat64 *NAT64
+	reserved := []netip.Addr{tunPrefix.Addr()}
+	if cfg.NAT64.Enabled {
+		nat64, err = newServerNAT64(cfg.NAT64, tunPrefix)
+		if err != nil {
+			return nil, err
+		}
+		reserved = append(reserved, nat64.Address())
+	}
+	pool := NewAddressPool(tunPrefix, leaseTime, reserved...)
+
+	// IPv6 addresses come from a second pool
+	var pool6 *AddressPool
+	if cfg.EnableIPv6 {
+		tunPrefix6, err := netip.ParsePrefix(cfg.TunIPv6)
+		if err != nil || !tunPrefix6.Addr().Is6() {
+			return nil, fmt.Errorf("invalid TUN IPv6 address %q", cfg.TunIPv6)
+		}
+		pool6 = NewAddressPool(tunPrefix6, leaseTime, tunPrefix6.Addr())
+	}
+
+	// Site clients may be delegated a whole IPv6 prefix
+	var prefixPool *AddressPool
+	if cfg.PrefixDelegation.Pool != "" {
+		poolPrefix, err := netip.ParsePrefix(cfg.PrefixDelegation.Pool)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix delegation pool: %v", err)
+		}
+		if prefixPool, err = NewPrefixPool(poolPrefix, cfg.PrefixDelegation.PrefixLength, leaseTime); err != nil {
+			return nil, err
+		}
+	}
+
+	// Leases survive restarts, so clients keep their addresses and prefixes
+	leasePath := filepath.Join(cfg.StateDir, leaseStateFile)
+	if state, err := loadLeaseState(leasePath); err != nil {
+		logger.Warnf("Ignoring saved leases: %v", err)
+	} else {
+		pool.Restore(state.Addresses)
+		if pool6 != nil {
+			pool6.Restore(state.Addresses6)
+		}
+		if prefixPool != nil {
+			prefixPool.Restore(state.Prefixes)
+		}
+	}
+
+	// Networks each certificate common name may route
+	sites := make(map[string][]*net.IPNet)
+	delegates := make(map[string]bool)
+	for _, site := range cfg.Sites {
+		if site.DelegatePrefix {
+			delegates[site.Client] = true
+		}
+		for _, cidr := range site.Networks {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("site %s: invalid network %q: %v", site.Client, cidr, err)
+			}
+			sites[site.Client] = append(sites[site.Client], network)
+		}
+	}
+
+	// Groups each certificate common name belongs to
+	groups := make(map[string][]string)
+	for _, group := range cfg.ClientGroups {
+		for _, member := range group.Members {
+			groups[member] = append(groups[member], group.Name)
+		}
+	}
+
 	return &Server{
-		config:    cfg,
-		clients:   make(map[string]*ClientInfo),
-		stopCh:    make(chan struct{}),
-		logger:    logger,
-		isRunning: false,
+		config:       cfg,
+		transport:    transport,
+		clients:      make(map[string]*ClientInfo),
+		names:        make(map[string]*ClientInfo),
+		clientRoutes: NewPrefixTable[*ClientInfo](),
+		pool:         pool,
+		pool6:        pool6,
+		prefixPool:   prefixPool,
+		delegates:    delegates,
+		leasePath:    leasePath,
+		sites:        sites,
+		groups:       groups,
+		routes:       NewKernelRoutes(cfg.TunDevice, logger),
+		icmp:         NewICMPGenerator(cfg.ICMPRateLimit),
+		mssClamper:   NewMSSClamper(cfg.ClampMSS, cfg.MSS),
+		nat64:        nat64,
+		queuePolicy:  queuePolicy,
+		stopCh:       make(chan struct{}),
+		logger:       logger,
+		isRunning:    false,
 	}, nil
 }
 
@@ -69,15 +220,48 @@ func (s *Server) Start() error {
 		return fmt.Errorf("failed to start TUN device: %v", err)
 	}
 
-	// Create TCP listener
-	s.listener, err = net.Listen("tcp", s.config.ListenAddr)
+	// Forward traffic between clients and the networks beyond the server
+	if len(s.sites) > 0 || s.config.EnableIPv6 {
+		if err := enableForwarding(s.config.EnableIPv6); err != nil {
+			s.tunDevice.Stop()
+			return err
+		}
+	}
+
+	// Route the networks behind site clients and delegated prefixes through the TUN device
+	if len(s.sites) > 0 || s.prefixPool != nil {
+		var routes []Route
+		if s.prefixPool != nil {
+			pool := s.prefixPool.Prefix()
+			network := &net.IPNet{IP: pool.Addr().AsSlice(), Mask: net.CIDRMask(pool.Bits(), 128)}
+			routes = append(routes, Route{Network: network, Type: RouteTypeTUN})
+		}
+		flushStaleRoutes(s.config.TunDevice, nil, false, s.logger)
+		if err := s.routes.Install(routes); err != nil {
+			s.logger.Errorf("Failed to route delegated prefixes: %v", err)
+		}
+	}
+
+	// Answer DNS on the tunnel address
+	if s.config.DNS.Enabled {
+		if err := s.startDNS(); err != nil {
+			s.tunDevice.Stop()
+			return err
+		}
+	}
+
+	// Listen for clients on the configured transport
+	s.listener, err = s.transport.Listen(s.config.ListenAddr)
 	if err != nil {
+		if s.dnsServer != nil {
+			s.dnsServer.Stop()
+		}
 		s.tunDevice.Stop()
 		return fmt.Errorf("failed to listen on %s: %v", s.config.ListenAddr, err)
 	}
 
 	s.isRunning = true
-	s.logger.Infof("Tuno VPN server started on %s", s.config.ListenAddr)
+	s.logger.Infof("Tuno VPN server started on %s (%s)", s.config.ListenAddr, s.transport.Name())
 
 	// Start handling packets from TUN device
 	go s.handleTUNPackets()
@@ -85,6 +269,9 @@ func (s *Server) Start() error {
 	// Accept client connections
 	go s.acceptClients()
 
+	// Report per-client counters
+	go s.reportClientStats()
+
 	// Wait for stop signal
 	<-s.stopCh
 	return nil
@@ -115,6 +302,14 @@ func (s *Server) Stop() error {
 	}
 	s.clientsMutex.Unlock()
 
+	// Stop DNS server
+	if s.dnsServer != nil {
+		s.dnsServer.Stop()
+	}
+
+	// Remove site routes
+	s.routes.Flush()
+
 	// Stop TUN device
 	if s.tunDevice != nil {
 		s.tunDevice.Stop()
@@ -141,65 +336,119 @@ func (s *Server) acceptClients() {
 }
 
 // handleClient handles a client connection
-func (s *Server) handleClient(conn net.Conn) {
-	// Wrap connection with TLS
-	tlsConn, err := cipher.NewTLSServerConn(conn, s.config, s.logger)
-	if err != nil {
-		s.logger.Errorf("Failed to establish TLS connection: %v", err)
-		conn.Close()
-		return
-	}
-
+func (s *Server) handleClient(conn TransportConn) {
 	// Generate client ID based on the connection
-	clientID := fmt.Sprintf("%s-%d", tlsConn.RemoteAddr().String(), time.Now().UnixNano())
+	clientID := fmt.Sprintf("%s-%d", conn.RemoteAddr().String(), time.Now().UnixNano())
 	s.logger.Infof("New client connection: %s", clientID)
 
 	// TODO: Implement client authentication here (for future milestones)
 
-	// Assign client IP (TODO: implement proper IP assignment)
-	clientIP := net.ParseIP("10.0.0.2") // For now, hardcoded
+	// Clients presenting a certificate are identified by its common name
+	var identity string
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		identity = certs[0].Subject.CommonName
+	}
 
 	// Create client info
 	client := &ClientInfo{
 		ID:           clientID,
-		Conn:         tlsConn,
-		TunIP:        clientIP,
+		Conn:         conn,
+		Identity:     identity,
+		MTU:          s.tunDevice.MTU(),
 		LastActivity: time.Now(),
+		frames:       NewFrameConn(conn),
+		queue:        NewSendQueue(s.config.ClientQueueDepth, s.queuePolicy),
+		done:         make(chan struct{}),
 	}
 
-	// Add client to map
+	// Add client to map, its address is assigned once it says hello
 	s.clientsMutex.Lock()
 	s.clients[clientID] = client
 	s.clientsMutex.Unlock()
 
+	// Deliver queued packets to this client on its own goroutine
+	go s.handleClientQueue(client)
+
+	// Keep idle connections alive
+	if s.config.Push.Keepalive > 0 {
+		go s.sendKeepalives(client)
+	}
+
 	// Handle packets from this client
 	s.handleClientPackets(client)
 
 	// Client disconnected, clean up
+	close(client.done)
+	s.removeClientRoute(client)
+	s.removeSiteRoutes(client)
+	if client.leaseKey == client.ID {
+		// Leases for this connection only are of no use to anyone later
+		s.pool.Remove(client.leaseKey)
+		if client.TunIPv6 != nil {
+			s.pool6.Remove(client.leaseKey)
+		}
+		if client.Delegated != nil {
+			s.prefixPool.Remove(client.leaseKey)
+		}
+		s.saveLeases()
+	} else if client.leaseKey != "" {
+		s.pool.Release(client.leaseKey)
+		if client.TunIPv6 != nil {
+			s.pool6.Release(client.leaseKey)
+		}
+		if client.Delegated != nil {
+			s.prefixPool.Release(client.leaseKey)
+		}
+		s.saveLeases()
+	}
 	s.clientsMutex.Lock()
 	delete(s.clients, clientID)
+	s.unregisterNames(client)
 	s.clientsMutex.Unlock()
-	s.logger.Infof("Client disconnected: %s", clientID)
+	client.queue.Close()
+	stats := conn.Stats()
+	_, dropped := client.QueueStats()
+	s.logger.Infof("Client disconnected: %s (%d frames sent, %d received, %d dropped by the send queue)",
+		clientID, stats.FramesSent, stats.FramesReceived, dropped)
 }
 
 // handleClientPackets handles packets from a specific client
 func (s *Server) handleClientPackets(client *ClientInfo) {
-	buffer := make([]byte, MaxPacketSize)
+	buffer := make([]byte, MaxFrameSize)
+	timeout := s.keepaliveTimeout()
 
 	for s.isRunning {
-		// Read packet from client
-		n, err := client.Conn.Read(buffer)
+		// Drop clients that have gone silent
+		if timeout > 0 {
+			client.Conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		// Read frame from client
+		frameType, payload, err := client.frames.ReadFrame(buffer)
 		if err != nil {
 			s.logger.Debugf("Client %s read error: %v", client.ID, err)
 			break
 		}
 
 		// Update client activity time and bytes counter
+		s.clientsMutex.Lock()
 		client.LastActivity = time.Now()
-		client.BytesIn += uint64(n)
+		client.BytesIn += uint64(len(payload))
+		s.clientsMutex.Unlock()
+
+		// Handle non-data frames
+		switch frameType {
+		case FrameTypeData:
+		case FrameTypeControl:
+			s.handleControlMessage(client, payload)
+			continue
+		default:
+			s.logger.Debugf("Ignoring frame of type %d from client %s", frameType, client.ID)
+			continue
+		}
 
 		// Process packet
-		packet, err := ParsePacket(buffer[:n])
+		packet, err := ParsePacket(payload)
 		if err != nil {
 			s.logger.Debugf("Failed to parse packet from client %s: %v", client.ID, err)
 			continue
@@ -208,9 +457,47 @@ func (s *Server) handleClientPackets(client *ClientInfo) {
 		// Decrement TTL to prevent routing loops
 		if !packet.ModifyTTL() {
 			s.logger.Debugf("Dropping packet from client %s due to expired TTL", client.ID)
+			s.sendICMPError(packet, ICMPTimeExceeded, 0, client)
+			continue
+		}
+
+		// Switch packets for other clients directly to them
+		if target, _ := s.clientRoutes.LookupIP(packet.Destination); target != nil && target != client {
+			if !s.clientToClientAllowed(client, target) {
+				s.logger.Debugf("Dropping packet from client %s to client %s by policy", client.ID, target.ID)
+				s.sendICMPError(packet, ICMPAdminProhibited, 0, client)
+				continue
+			}
+			s.deliver(packet, target, client)
+			continue
+		}
+
+		// Translate packets for the NAT64 prefix into IPv4
+		if s.nat64 != nil && s.nat64.Outbound(packet) {
+			translated, err := s.nat64.TranslateOut(packet)
+			if err != nil {
+				s.logger.Debugf("Dropping NAT64 packet from client %s: %v", client.ID, err)
+				continue
+			}
+			if mtu := s.tunDevice.MTU(); len(translated) > mtu {
+				s.sendICMPError(packet, ICMPPacketTooBig, mtu+nat64HeaderGrowth, client)
+				continue
+			}
+			if packet, err = ParsePacket(translated); err != nil {
+				continue
+			}
+		}
+
+		// Packets that cannot be fragmented must fit the TUN MTU
+		if mtu := s.tunDevice.MTU(); len(packet.Data) > mtu && packet.DontFragment() {
+			s.logger.Debugf("Dropping %d byte packet from client %s exceeding MTU %d", len(packet.Data), client.ID, mtu)
+			s.sendICMPError(packet, ICMPPacketTooBig, mtu, client)
 			continue
 		}
 
+		// Keep TCP segments within the tunnel MTU
+		s.mssClamper.Clamp(packet, s.tunDevice.MTU())
+
 		// Write packet to TUN device
 		_, err = s.tunDevice.Write(packet.Data)
 		if err != nil {
@@ -220,6 +507,349 @@ func (s *Server) handleClientPackets(client *ClientInfo) {
 	}
 }
 
+// addClientRoute routes the client's tunnel addresses to it
+func (s *Server) addClientRoute(client *ClientInfo) {
+	for _, ip := range []net.IP{client.TunIP, client.TunIPv6} {
+		prefix, ok := hostPrefix(ip)
+		if !ok {
+			continue
+		}
+		if !s.clientRoutes.Insert(prefix, client) {
+			s.logger.Warnf("Tunnel address %s reassigned to client %s", ip, client.ID)
+		}
+	}
+}
+
+// removeClientRoute removes the client's tunnel address and delegated prefix
+// routes, unless another client has taken them over in the meantime
+func (s *Server) removeClientRoute(client *ClientInfo) {
+	var prefixes []netip.Prefix
+	for _, ip := range []net.IP{client.TunIP, client.TunIPv6} {
+		if prefix, ok := hostPrefix(ip); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if client.Delegated != nil {
+		if prefix, ok := prefixFromIPNet(client.Delegated); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	for _, prefix := range prefixes {
+		s.clientRoutes.DeleteFunc(prefix, func(current *ClientInfo) bool {
+			return current == client
+		})
+	}
+}
+
+// assignAddress leases the client a tunnel address and routes it to the client
+// Leases are kept under the certificate common name, so a client gets the same
+// address back when it reconnects. A client without a certificate, or one
+// whose certificate is already connected, gets an address for this connection only.
+func (s *Server) assignAddress(client *ClientInfo) error {
+	if client.leaseKey != "" {
+		return nil
+	}
+
+	key := client.Identity
+	if key == "" {
+		key = client.ID
+	}
+	addr, err := s.pool.Acquire(key)
+	if errors.Is(err, errLeaseInUse) {
+		s.logger.Warnf("Certificate %q of client %s is already connected, assigning a separate address", key, client.ID)
+		key = client.ID
+		addr, err = s.pool.Acquire(key)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Without an IPv6 address the client still gets IPv4
+	var ipv6 net.IP
+	if s.pool6 != nil {
+		if addr6, err := s.pool6.Acquire(key); err != nil {
+			s.logger.Warnf("Failed to assign an IPv6 address to client %s: %v", client.ID, err)
+		} else {
+			ipv6 = net.IP(addr6.AsSlice())
+		}
+	}
+
+	s.clientsMutex.Lock()
+	client.TunIP = net.IP(addr.AsSlice())
+	client.TunIPv6 = ipv6
+	client.leaseKey = key
+	s.clientsMutex.Unlock()
+	s.addClientRoute(client)
+
+	if ipv6 != nil {
+		s.logger.Infof("Assigned addresses %s and %s to client %s", addr, ipv6, client.ID)
+	} else {
+		s.logger.Infof("Assigned address %s to client %s", addr, client.ID)
+	}
+	s.saveLeases()
+	return nil
+}
+
+// delegatePrefix leases a site client an IPv6 prefix from the delegation pool and routes it to the client
+// Prefixes are delegated by certificate common name and kept with the client's
+// address lease, so a second connection with the same certificate gets none.
+func (s *Server) delegatePrefix(client *ClientInfo) {
+	if s.prefixPool == nil || client.Delegated != nil || client.Identity == "" || client.leaseKey != client.Identity {
+		return
+	}
+	if !s.delegates[client.Identity] {
+		return
+	}
+
+	addr, err := s.prefixPool.Acquire(client.leaseKey)
+	if err != nil {
+		s.logger.Warnf("Failed to delegate a prefix to client %s: %v", client.ID, err)
+		return
+	}
+	prefix := netip.PrefixFrom(addr, s.prefixPool.Bits())
+
+	s.clientsMutex.Lock()
+	client.Delegated = &net.IPNet{IP: addr.AsSlice(), Mask: net.CIDRMask(prefix.Bits(), 128)}
+	s.clientsMutex.Unlock()
+	if !s.clientRoutes.Insert(prefix, client) {
+		s.logger.Warnf("Delegated prefix %s reassigned to client %s", prefix, client.ID)
+	}
+
+	s.logger.Infof("Delegated prefix %s to client %s", prefix, client.ID)
+	s.saveLeases()
+}
+
+// saveLeases writes the address and prefix leases to the state file
+func (s *Server) saveLeases() {
+	s.leaseMutex.Lock()
+	defer s.leaseMutex.Unlock()
+
+	state := &leaseState{Addresses: s.pool.Leases()}
+	if s.pool6 != nil {
+		state.Addresses6 = s.pool6.Leases()
+	}
+	if s.prefixPool != nil {
+		state.Prefixes = s.prefixPool.Leases()
+	}
+	if err := saveLeaseState(s.leasePath, state); err != nil {
+		s.logger.Warnf("Failed to save leases: %v", err)
+	}
+}
+
+// pushSettings sends the client its address, routes, DNS, MTU and keepalive settings
+func (s *Server) pushSettings(client *ClientInfo) {
+	push := s.config.Push
+	addr, _ := netip.AddrFromSlice(client.TunIP)
+	settings := &ClientSettings{
+		Address:          netip.PrefixFrom(addr.Unmap(), s.pool.Prefix().Bits()).String(),
+		Routes:           push.Routes,
+		DNS:              push.DNS,
+		Domains:          push.Domains,
+		MTU:              push.MTU,
+		Keepalive:        push.Keepalive,
+		KeepaliveTimeout: push.KeepaliveTimeout,
+	}
+	if settings.MTU == 0 {
+		settings.MTU = s.tunDevice.MTU()
+	}
+	if client.Delegated != nil {
+		settings.DelegatedPrefix = client.Delegated.String()
+	}
+	if addr6, ok := netip.AddrFromSlice(client.TunIPv6); ok {
+		settings.Address6 = netip.PrefixFrom(addr6, s.pool6.Prefix().Bits()).String()
+
+		// IPv6 clients send traffic for the NAT64 prefix through the tunnel
+		if s.nat64 != nil {
+			settings.Routes = append(append([]string(nil), settings.Routes...), s.nat64.Prefix().String())
+		}
+	}
+
+	// Point clients at the built-in DNS server unless told otherwise
+	if s.config.DNS.Enabled {
+		if len(settings.DNS) == 0 {
+			if ip := s.tunDevice.Addr(false); ip != nil {
+				settings.DNS = []string{ip.String()}
+			}
+		}
+		if len(settings.Domains) == 0 && s.config.DNS.Domain != "" {
+			settings.Domains = []string{s.config.DNS.Domain}
+		}
+	}
+
+	s.clientsMutex.Lock()
+	client.Settings = settings
+	s.clientsMutex.Unlock()
+
+	if err := client.frames.WriteControl(&ControlMessage{Type: ControlTypeConfig, Settings: settings}); err != nil {
+		s.logger.Debugf("Failed to push settings to client %s: %v", client.ID, err)
+	}
+}
+
+// reportClientStats logs the clients whose send queues dropped packets or
+// whose DNS queries were blocked since the last report
+func (s *Server) reportClientStats() {
+	ticker := time.NewTicker(clientStatsInterval)
+	defer ticker.Stop()
+
+	reportedDrops := make(map[string]uint64)
+	reportedBlocks := make(map[string]uint64)
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopCh:
+			return
+		}
+
+		drops := make(map[string]uint64)
+		blocks := s.BlockedQueries()
+		for _, client := range s.GetClients() {
+			queued, dropped := client.QueueStats()
+			drops[client.ID] = dropped
+			if dropped > reportedDrops[client.ID] {
+				s.logger.Warnf("Send queue for client %s dropped %d packets (%d queued, policy %s)",
+					client.ID, dropped-reportedDrops[client.ID], queued, s.queuePolicy)
+			}
+			if blocked := blocks[client.ID]; blocked > reportedBlocks[client.ID] {
+				s.logger.Infof("Blocked %d DNS queries from client %s (%d in total)",
+					blocked-reportedBlocks[client.ID], client.ID, blocked)
+			}
+		}
+		reportedDrops, reportedBlocks = drops, blocks
+	}
+}
+
+// keepaliveTimeout returns how long a connection may stay silent (0 = forever)
+func (s *Server) keepaliveTimeout() time.Duration {
+	if s.config.Push.Keepalive <= 0 {
+		return 0
+	}
+	return time.Duration(s.config.Push.KeepaliveTimeout) * time.Second
+}
+
+// sendKeepalives sends a keepalive to the client at the pushed interval until it disconnects
+func (s *Server) sendKeepalives(client *ClientInfo) {
+	ticker := time.NewTicker(time.Duration(s.config.Push.Keepalive) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := client.frames.WriteControl(&ControlMessage{Type: ControlTypeKeepalive}); err != nil {
+				s.logger.Debugf("Failed to send keepalive to client %s: %v", client.ID, err)
+				return
+			}
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// authorisedNetworks returns the networks a client may route
+// Sites are matched by certificate common name only, since the names in a
+// client's hello are whatever it claims.
+func (s *Server) authorisedNetworks(client *ClientInfo) []*net.IPNet {
+	if client.Identity == "" {
+		return nil
+	}
+	return s.sites[client.Identity]
+}
+
+// addSiteRoutes routes the advertised networks behind a client to it
+// Only networks within one the client is authorised for are accepted, and
+// each is also routed to the TUN device in the kernel. A network another
+// connected client already routes stays with that client.
+func (s *Server) addSiteRoutes(client *ClientInfo, authorised []*net.IPNet, advertised []string) {
+	// A repeated hello replaces the previous advertisement
+	s.removeSiteRoutes(client)
+
+	var networks []*net.IPNet
+	for _, cidr := range advertised {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			s.logger.Warnf("Client %s advertised invalid network %q", client.ID, cidr)
+			continue
+		}
+		if !networkAuthorised(network, authorised) {
+			s.logger.Warnf("Client %s is not authorised to route %s", client.ID, network)
+			continue
+		}
+
+		prefix, ok := prefixFromIPNet(network)
+		if !ok {
+			continue
+		}
+		s.clientsMutex.Lock()
+		current, taken := s.clientRoutes.Get(prefix)
+		if taken && current != client {
+			s.clientsMutex.Unlock()
+			s.logger.Warnf("Client %s advertised %s, which is already routed to client %s", client.ID, network, current.ID)
+			continue
+		}
+		s.clientRoutes.Insert(prefix, client)
+		s.clientsMutex.Unlock()
+		s.routes.HandleChange(Route{Network: network, Type: RouteTypeTUN}, false)
+		networks = append(networks, network)
+		s.logger.Infof("Routing %s to client %s", network, client.ID)
+	}
+
+	s.clientsMutex.Lock()
+	client.Networks = networks
+	s.clientsMutex.Unlock()
+}
+
+// removeSiteRoutes removes the routes to the networks behind a client,
+// unless another client has taken a network over in the meantime
+func (s *Server) removeSiteRoutes(client *ClientInfo) {
+	s.clientsMutex.Lock()
+	networks := client.Networks
+	client.Networks = nil
+	s.clientsMutex.Unlock()
+
+	for _, network := range networks {
+		prefix, ok := prefixFromIPNet(network)
+		if !ok {
+			continue
+		}
+		removed := s.clientRoutes.DeleteFunc(prefix, func(current *ClientInfo) bool {
+			return current == client
+		})
+		if removed {
+			s.routes.HandleChange(Route{Network: network, Type: RouteTypeTUN}, true)
+		}
+	}
+}
+
+// networkAuthorised reports whether network lies within one of the authorised networks
+func networkAuthorised(network *net.IPNet, authorised []*net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	for _, allowed := range authorised {
+		allowedOnes, allowedBits := allowed.Mask.Size()
+		if bits == allowedBits && ones >= allowedOnes && allowed.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleClientQueue writes packets queued for a client to its connection
+// A failed write closes the connection, which ends the client's read loop.
+func (s *Server) handleClientQueue(client *ClientInfo) {
+	err := client.queue.Run(func(packet []byte) error {
+		if err := client.frames.WritePacket(packet); err != nil {
+			return err
+		}
+		s.clientsMutex.Lock()
+		client.BytesOut += uint64(len(packet))
+		s.clientsMutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		s.logger.Errorf("Failed to write packet to client %s: %v", client.ID, err)
+		client.Conn.Close()
+	}
+}
+
 // handleTUNPackets handles packets from the TUN device
 func (s *Server) handleTUNPackets() {
 	buffer := make([]byte, MaxPacketSize)
@@ -240,33 +870,314 @@ func (s *Server) handleTUNPackets() {
 			continue
 		}
 
-		// Find client for this packet
-		s.clientsMutex.RLock()
-		var targetClient *ClientInfo
-		for _, client := range s.clients {
-			if packet.Destination.Equal(client.TunIP) {
-				targetClient = client
-				break
-			}
+		// Replies to NAT64 mappings go back to IPv6 clients
+		if s.nat64 != nil && s.nat64.Inbound(packet) {
+			s.deliverNAT64(packet)
+			continue
 		}
-		s.clientsMutex.RUnlock()
+
+		// Find client for this packet
+		targetClient, _ := s.clientRoutes.LookupIP(packet.Destination)
 
 		// If we found a client, send the packet
 		if targetClient != nil {
-			// Update bytes counter
-			targetClient.BytesOut += uint64(len(packet.Data))
-
-			// Write packet to client connection
-			_, err = targetClient.Conn.Write(packet.Data)
-			if err != nil {
-				s.logger.Errorf("Failed to write packet to client %s: %v", targetClient.ID, err)
-				continue
-			}
+			s.deliver(packet, targetClient, nil)
 		} else {
 			// No client found for this packet, drop it
 			s.logger.Debugf("No client found for packet destined to %s", packet.Destination)
+			s.sendICMPError(packet, ICMPHostUnreachable, 0, nil)
+		}
+	}
+}
+
+// deliver queues a packet for a client
+// Packets come from the TUN device if from is nil, otherwise from another
+// client, which is where ICMP errors about them are sent.
+func (s *Server) deliver(packet *Packet, target *ClientInfo, from *ClientInfo) {
+	mtu := s.clientMTU(target)
+
+	// Packets that cannot be fragmented must fit the client's tunnel MTU
+	if len(packet.Data) > mtu && packet.DontFragment() {
+		s.logger.Debugf("Dropping %d byte packet for client %s exceeding MTU %d", len(packet.Data), target.ID, mtu)
+		s.sendICMPError(packet, ICMPPacketTooBig, mtu, from)
+		return
+	}
+
+	// IPv4 packets with DF set must not be fragmented by the tunnel
+	if limit := target.frames.MaxPayload(); limit > 0 && len(packet.Data) > limit &&
+		packet.Type == PacketTypeIPv4 && packet.DontFragment() {
+		s.sendICMPError(packet, ICMPPacketTooBig, limit, from)
+		return
+	}
+
+	// Keep TCP segments within the tunnel MTU
+	s.mssClamper.Clamp(packet, effectiveMTU(mtu, target.frames.MaxPayload()))
+
+	// Hand the packet to the client's writer
+	if !target.queue.Enqueue(packet.Data) {
+		s.logger.Debugf("Send queue full for client %s, dropped packet (%s)", target.ID, s.queuePolicy)
+	}
+}
+
+// clientMTU returns the tunnel MTU a client announced
+func (s *Server) clientMTU(client *ClientInfo) int {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	return client.MTU
+}
+
+// deliverNAT64 translates an IPv4 packet for a NAT64 mapping and queues it for the client
+func (s *Server) deliverNAT64(packet *Packet) {
+	translated, err := s.nat64.TranslateIn(packet)
+	if err != nil {
+		s.logger.Debugf("Dropping NAT64 packet from %s: %v", packet.Source, err)
+		return
+	}
+	v6, err := ParsePacket(translated)
+	if err != nil {
+		return
+	}
+	target, _ := s.clientRoutes.LookupIP(v6.Destination)
+	if target == nil {
+		s.logger.Debugf("No client found for NAT64 packet destined to %s", v6.Destination)
+		return
+	}
+
+	// The IPv4 sender must learn the MTU before the IPv6 header is added
+	if mtu := s.clientMTU(target); len(v6.Data) > mtu && packet.DontFragment() {
+		s.sendICMPError(packet, ICMPPacketTooBig, mtu-nat64HeaderGrowth, nil)
+		return
+	}
+	s.deliver(v6, target, nil)
+}
+
+// clientToClientAllowed reports whether the client_to_client policy lets one client reach another
+func (s *Server) clientToClientAllowed(from, to *ClientInfo) bool {
+	switch s.config.ClientToClient {
+	case "deny":
+		return false
+	case "group":
+		s.clientsMutex.RLock()
+		defer s.clientsMutex.RUnlock()
+		for _, a := range from.Groups {
+			for _, b := range to.Groups {
+				if a == b {
+					return true
+				}
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// handleControlMessage processes a control message received from a client
+func (s *Server) handleControlMessage(client *ClientInfo, payload []byte) {
+	msg, err := ParseControlMessage(payload)
+	if err != nil {
+		s.logger.Debugf("Client %s sent %v", client.ID, err)
+		return
+	}
+
+	switch msg.Type {
+	case ControlTypeMTU:
+		if msg.MTU < MinTunnelMTU || msg.MTU > MaxPacketSize {
+			s.logger.Debugf("Client %s announced invalid MTU %d", client.ID, msg.MTU)
+			return
+		}
+		if msg.MaxPayload != 0 && (msg.MaxPayload < MinTunnelMTU || msg.MaxPayload > msg.MTU) {
+			s.logger.Debugf("Client %s announced invalid payload limit %d", client.ID, msg.MaxPayload)
+			return
+		}
+		s.clientsMutex.Lock()
+		client.MTU = msg.MTU
+		s.clientsMutex.Unlock()
+		client.frames.SetMaxPayload(msg.MaxPayload)
+		s.logger.Infof("Client %s tunnel MTU is %d (payload limit %d)", client.ID, msg.MTU, msg.MaxPayload)
+	case ControlTypeHello:
+		// Groups follow the certificate, a client without one belongs to none
+		var groups []string
+		if client.Identity != "" {
+			groups = s.groups[client.Identity]
+		}
+
+		s.clientsMutex.Lock()
+		client.Username = dns.Label(msg.Username)
+		client.Device = dns.Label(msg.Device)
+		client.Groups = groups
+		s.registerNames(client)
+		s.clientsMutex.Unlock()
+		s.logger.Infof("Client %s registered as user %q on device %q", client.ID, client.Username, client.Device)
+
+		// Hand out an address and the settings the client needs to use it
+		if err := s.assignAddress(client); err != nil {
+			s.logger.Errorf("Failed to assign an address to client %s: %v", client.ID, err)
+			client.Conn.Close()
+			return
+		}
+		s.addSiteRoutes(client, s.authorisedNetworks(client), msg.Networks)
+		s.delegatePrefix(client)
+		s.pushSettings(client)
+	case ControlTypeApplied:
+		s.clientsMutex.Lock()
+		client.Applied = msg.Settings
+		s.clientsMutex.Unlock()
+		if msg.Error != "" {
+			s.logger.Warnf("Client %s could not apply all pushed settings: %s", client.ID, msg.Error)
+		} else {
+			s.logger.Debugf("Client %s applied the pushed settings", client.ID)
+		}
+	case ControlTypeKeepalive:
+	default:
+		s.logger.Debugf("Ignoring control message %q from client %s", msg.Type, client.ID)
+	}
+}
+
+// sendICMPError sends an ICMP error for packet back toward its sender
+// If client is nil the sender is reached through the TUN device, otherwise through the client connection.
+func (s *Server) sendICMPError(packet *Packet, errType ICMPErrorType, mtu int, client *ClientInfo) {
+	source := s.tunDevice.Addr(packet.Type == PacketTypeIPv6)
+	reply := s.icmp.Generate(packet, errType, source, mtu)
+	if reply == nil {
+		return
+	}
+
+	var err error
+	if client != nil {
+		err = client.frames.WritePacket(reply)
+	} else {
+		_, err = s.tunDevice.Write(reply)
+	}
+	if err != nil {
+		s.logger.Debugf("Failed to send ICMP %v to %s: %v", errType, packet.Source, err)
+	}
+}
+
+// startDNS starts the DNS server on the tunnel address
+func (s *Server) startDNS() error {
+	var err error
+	s.dnsServer, err = dns.NewServer(s.config.DNS, s, s.logger)
+	if err != nil {
+		return fmt.Errorf("failed to create DNS server: %v", err)
+	}
+
+	// Synthesise AAAA records for IPv4-only names behind NAT64
+	if s.config.DNS.DNS64 && s.nat64 != nil {
+		s.dnsServer.SetDNS64(s.nat64.Prefix())
+	}
+
+	addr := net.JoinHostPort(s.tunDevice.Addr(false).String(), "53")
+	if err := s.dnsServer.Start(addr); err != nil {
+		return fmt.Errorf("failed to start DNS server: %v", err)
+	}
+	return nil
+}
+
+// newServerNAT64 creates the NAT64 translator from the server configuration
+// Translated packets leave from the last address of the tunnel network unless another address is configured.
+// The tunnel network and the server's own IPv4 addresses are never translated.
+func newServerNAT64(cfg config.NAT64Config, tunPrefix netip.Prefix) (*NAT64, error) {
+	prefixText := cfg.Prefix
+	if prefixText == "" {
+		prefixText = DefaultNAT64Prefix
+	}
+	prefix, err := netip.ParsePrefix(prefixText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NAT64 prefix: %v", err)
+	}
+
+	addr := lastAddr(tunPrefix.Masked()).Prev()
+	if cfg.Address != "" {
+		if addr, err = netip.ParseAddr(cfg.Address); err != nil {
+			return nil, fmt.Errorf("invalid NAT64 address: %v", err)
+		}
+	}
+
+	// Clients must not reach each other or the server itself through NAT64
+	excluded := []netip.Prefix{tunPrefix.Masked()}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				if local, ok := hostPrefix(ipNet.IP); ok && local.Addr().Is4() {
+					excluded = append(excluded, local)
+				}
+			}
+		}
+	}
+
+	return NewNAT64(prefix, addr, time.Duration(cfg.Timeout)*time.Second, excluded...)
+}
+
+// registerNames registers the DNS names of a client with a certificate
+// The user name is the certificate common name; the device name comes from
+// the hello. Names already held by another client stay with that client.
+// The caller must hold clientsMutex.
+func (s *Server) registerNames(client *ClientInfo) {
+	s.unregisterNames(client)
+	if client.Identity == "" {
+		return
+	}
+
+	for _, name := range []string{dns.Label(client.Identity), client.Device} {
+		if name == "" {
+			continue
+		}
+		if holder, ok := s.names[name]; ok && holder != client {
+			s.logger.Warnf("Name %q of client %s is already registered to client %s", name, client.ID, holder.ID)
+			continue
+		}
+		s.names[name] = client
+		client.names = append(client.names, name)
+	}
+}
+
+// unregisterNames releases the DNS names registered to a client
+// The caller must hold clientsMutex.
+func (s *Server) unregisterNames(client *ClientInfo) {
+	for _, name := range client.names {
+		if s.names[name] == client {
+			delete(s.names, name)
+		}
+	}
+	client.names = nil
+}
+
+// LookupName returns the tunnel addresses of the client registered under a user or device name
+func (s *Server) LookupName(name string) []net.IP {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+
+	client, ok := s.names[name]
+	if !ok || client.TunIP == nil {
+		return nil
+	}
+	ips := []net.IP{client.TunIP}
+	if client.TunIPv6 != nil {
+		ips = append(ips, client.TunIPv6)
+	}
+	return ips
+}
+
+// BlockedQueries returns the number of DNS queries blocked per connected client ID
+func (s *Server) BlockedQueries() map[string]uint64 {
+	if s.dnsServer == nil {
+		return nil
+	}
+	hits := s.dnsServer.BlockHits()
+
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+
+	counts := make(map[string]uint64)
+	for id, client := range s.clients {
+		for _, ip := range []net.IP{client.TunIP, client.TunIPv6} {
+			if count, ok := hits[ip.String()]; ok && ip != nil {
+				counts[id] += count
+			}
 		}
 	}
+	return counts
 }
 
 // GetClientCount returns the number of connected clients
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Kernel settings changed by the client
+	srcValidMarkSysctl   = "/proc/sys/net/ipv4/conf/all/src_valid_mark"
+	ipv4ForwardingSysctl = "/proc/sys/net/ipv4/ip_forward"
+	ipv6ForwardingSysctl = "/proc/sys/net/ipv6/conf/all/forwarding"
+
+	// File under the state directory recording their original values
+	sysctlStateFile = "sysctl-state.json"
+)
+
+// setSysctl changes a kernel setting, recording its original value first
+// The original value is kept in the state directory, so restoreSysctl can
+// put it back after a crash as well as on a clean shutdown.
+func setSysctl(stateDir, path, value string) error {
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	current = bytes.TrimSpace(current)
+	if string(current) == value {
+		return nil
+	}
+
+	// A value recorded by an earlier change is the original one
+	state := loadSysctlState(stateDir)
+	if _, ok := state[path]; !ok {
+		state[path] = string(current)
+		if err := saveSysctlState(stateDir, state); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// restoreSysctl puts back a kernel setting changed by setSysctl
+// Settings that were not changed are left alone.
+func restoreSysctl(stateDir, path string) error {
+	state := loadSysctlState(stateDir)
+	original, ok := state[path]
+	if !ok {
+		return nil
+	}
+
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", path, err)
+	}
+
+	delete(state, path)
+	if len(state) == 0 {
+		os.Remove(filepath.Join(stateDir, sysctlStateFile))
+		return nil
+	}
+	return saveSysctlState(stateDir, state)
+}
+
+// loadSysctlState reads the original values of changed settings
+func loadSysctlState(stateDir string) map[string]string {
+	state := make(map[string]string)
+	if data, err := os.ReadFile(filepath.Join(stateDir, sysctlStateFile)); err == nil {
+		json.Unmarshal(data, &state)
+	}
+	return state
+}
+
+// saveSysctlState writes the original values of changed settings
+func saveSysctlState(stateDir string, state map[string]string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(stateDir, sysctlStateFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to save kernel settings: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Transport names used by the transport setting and server address URLs
+const (
+	// TransportTLS carries frames over a TLS stream on TCP
+	TransportTLS = "tls"
+	// TransportUDP carries data as encrypted UDP datagrams, keeping the TLS stream for control
+	TransportUDP = "udp"
+)
+
+// Transport connects clients to the server
+// Each transport carries typed tunnel frames; fragmentation, control
+// messages and MTU handling sit on top of it in FrameConn.
+type Transport interface {
+	// Name returns the name used in the transport setting
+	Name() string
+	// Dial connects to the server at addr (host:port)
+	Dial(addr string, timeout time.Duration) (TransportConn, error)
+	// Listen accepts client connections on addr (host:port)
+	Listen(addr string) (TransportListener, error)
+}
+
+// TransportListener accepts client connections
+// Connections are only returned once their handshake has completed, so a
+// slow client never holds up the others.
+type TransportListener interface {
+	Accept() (TransportConn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// TransportConn is an established connection between client and server
+type TransportConn interface {
+	// SendFrame sends a single frame, safe for concurrent use
+	SendFrame(frameType FrameType, payload []byte) error
+	// ReceiveFrame reads the next frame into buf and returns its type and payload
+	ReceiveFrame(buf []byte) (FrameType, []byte, error)
+	// SetReadDeadline bounds the wait in ReceiveFrame
+	SetReadDeadline(deadline time.Time) error
+	// PathMTU returns the largest frame payload the path carries in one packet, if known
+	PathMTU() (int, bool)
+	// ConnectionState returns the state of the TLS session securing the connection
+	ConnectionState() tls.ConnectionState
+	// RemoteAddr returns the address of the peer
+	RemoteAddr() net.Addr
+	// Stats returns the traffic counters of the connection
+	Stats() TransportStats
+	// Close closes the connection
+	Close() error
+}
+
+// TransportStats counts the traffic of a connection
+type TransportStats struct {
+	FramesSent     uint64
+	FramesReceived uint64
+	BytesSent      uint64
+	BytesReceived  uint64
+}
+
+// transportCounters keeps TransportStats for concurrent readers and writers
+type transportCounters struct {
+	framesSent     atomic.Uint64
+	framesReceived atomic.Uint64
+	bytesSent      atomic.Uint64
+	bytesReceived  atomic.Uint64
+}
+
+// sent counts a frame sent with n bytes on the wire
+func (c *transportCounters) sent(n int) {
+	c.framesSent.Add(1)
+	c.bytesSent.Add(uint64(n))
+}
+
+// received counts a frame received with n bytes on the wire
+func (c *transportCounters) received(n int) {
+	c.framesReceived.Add(1)
+	c.bytesReceived.Add(uint64(n))
+}
+
+// stats returns a snapshot of the counters
+func (c *transportCounters) stats() TransportStats {
+	return TransportStats{
+		FramesSent:     c.framesSent.Load(),
+		FramesReceived: c.framesReceived.Load(),
+		BytesSent:      c.bytesSent.Load(),
+		BytesReceived:  c.bytesReceived.Load(),
+	}
+}
+
+// NewClientTransport creates the transport selected in the client configuration
+func NewClientTransport(cfg *config.ClientConfig, logger *logrus.Logger) (Transport, error) {
+	switch cfg.Transport {
+	case "", TransportTLS:
+		return &tlsTransport{clientConfig: cfg, logger: logger}, nil
+	case TransportUDP:
+		return &udpTransport{tls: &tlsTransport{clientConfig: cfg, logger: logger}, logger: logger}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", cfg.Transport)
+	}
+}
+
+// NewServerTransport creates the transport selected in the server configuration
+func NewServerTransport(cfg *config.ServerConfig, logger *logrus.Logger) (Transport, error) {
+	switch cfg.Transport {
+	case "", TransportTLS:
+		return &tlsTransport{serverConfig: cfg, logger: logger}, nil
+	case TransportUDP:
+		return &udpTransport{tls: &tlsTransport{serverConfig: cfg, logger: logger}, logger: logger}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", cfg.Transport)
+	}
+}
@@ -0,0 +1,251 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/cipher"
+	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Handshakes waiting to be accepted before new ones are held back
+const tlsAcceptBacklog = 16
+
+// tlsTransport carries frames over TLS on TCP
+// Frames are written as a 1 byte type and a 2 byte length followed by the payload.
+type tlsTransport struct {
+	clientConfig *config.ClientConfig
+	serverConfig *config.ServerConfig
+	logger       *logrus.Logger
+}
+
+// Name returns the name used in the transport setting
+func (t *tlsTransport) Name() string {
+	return TransportTLS
+}
+
+// Dial connects to the server over TCP and performs the TLS handshake
+func (t *tlsTransport) Dial(addr string, timeout time.Duration) (TransportConn, error) {
+	return t.dialStream(addr, timeout)
+}
+
+// dialStream connects to the server and returns the TLS stream
+func (t *tlsTransport) dialStream(addr string, timeout time.Duration) (*streamConn, error) {
+	if t.clientConfig == nil {
+		return nil, errors.New("transport is not configured for dialling")
+	}
+
+	tcpConn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn, err := cipher.NewTLSClientConn(tcpConn, t.clientConfig, t.logger)
+	if err != nil {
+		tcpConn.Close()
+		return nil, fmt.Errorf("failed to establish TLS connection: %v", err)
+	}
+	return newStreamConn(tlsConn), nil
+}
+
+// Listen accepts TCP connections and performs the TLS handshake on each
+func (t *tlsTransport) Listen(addr string) (TransportListener, error) {
+	return t.listenStream(addr)
+}
+
+// listenStream accepts TLS streams on addr
+func (t *tlsTransport) listenStream(addr string) (*tlsListener, error) {
+	if t.serverConfig == nil {
+		return nil, errors.New("transport is not configured for listening")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &tlsListener{
+		listener: listener,
+		config:   t.serverConfig,
+		conns:    make(chan *streamConn, tlsAcceptBacklog),
+		closed:   make(chan struct{}),
+		logger:   t.logger,
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// tlsListener hands out connections whose TLS handshake has completed
+type tlsListener struct {
+	listener  net.Listener
+	config    *config.ServerConfig
+	conns     chan *streamConn
+	closed    chan struct{}
+	closeOnce sync.Once
+	logger    *logrus.Logger
+}
+
+// acceptLoop accepts TCP connections and handshakes each on its own goroutine
+func (l *tlsListener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			l.logger.Errorf("Failed to accept client connection: %v", err)
+			time.Sleep(100 * time.Millisecond) // Avoid tight loop on error
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake secures an accepted connection and queues it for Accept
+func (l *tlsListener) handshake(conn net.Conn) {
+	tlsConn, err := cipher.NewTLSServerConn(conn, l.config, l.logger)
+	if err != nil {
+		l.logger.Errorf("Failed to establish TLS connection: %v", err)
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- newStreamConn(tlsConn):
+	case <-l.closed:
+		tlsConn.Close()
+	}
+}
+
+// Accept returns the next connection with a completed handshake
+func (l *tlsListener) Accept() (TransportConn, error) {
+	return l.acceptStream()
+}
+
+// acceptStream returns the next TLS stream with a completed handshake
+func (l *tlsListener) acceptStream() (*streamConn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections
+func (l *tlsListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+// Addr returns the listening address
+func (l *tlsListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// streamConn carries length-prefixed frames over a TLS stream
+type streamConn struct {
+	conn       *cipher.TLSConn
+	reader     *bufio.Reader
+	writeBuf   []byte
+	writeMutex sync.Mutex
+	counters   transportCounters
+}
+
+// newStreamConn wraps an established TLS connection
+func newStreamConn(conn *cipher.TLSConn) *streamConn {
+	return &streamConn{
+		conn:   conn,
+		reader: bufio.NewReaderSize(conn, MaxFrameSize+frameHeaderLen),
+	}
+}
+
+// SendFrame writes a single frame
+// Header and payload go out in one write so frames from concurrent writers never interleave.
+func (s *streamConn) SendFrame(frameType FrameType, payload []byte) error {
+	if len(payload) > maxFramePayload {
+		return fmt.Errorf("frame payload too large: %d bytes", len(payload))
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	size := frameHeaderLen + len(payload)
+	if cap(s.writeBuf) < size {
+		s.writeBuf = make([]byte, size)
+	}
+	buf := s.writeBuf[:size]
+	buf[0] = byte(frameType)
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(payload)))
+	copy(buf[frameHeaderLen:], payload)
+
+	if _, err := s.conn.Write(buf); err != nil {
+		return err
+	}
+	s.counters.sent(size)
+	return nil
+}
+
+// ReceiveFrame reads a single frame into buf
+func (s *streamConn) ReceiveFrame(buf []byte) (FrameType, []byte, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[1:3]))
+	if length > len(buf) {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds buffer of %d bytes", length, len(buf))
+	}
+	if _, err := io.ReadFull(s.reader, buf[:length]); err != nil {
+		return 0, nil, err
+	}
+
+	s.counters.received(frameHeaderLen + length)
+	return FrameType(header[0]), buf[:length], nil
+}
+
+// SetReadDeadline bounds the wait in ReceiveFrame
+func (s *streamConn) SetReadDeadline(deadline time.Time) error {
+	return s.conn.SetReadDeadline(deadline)
+}
+
+// PathMTU returns the kernel's path MTU estimate for the TCP socket
+// A stream accepts frames of any size, so this is the only hint about the path.
+func (s *streamConn) PathMTU() (int, bool) {
+	return socketPathMTU(s.conn.NetConn())
+}
+
+// ConnectionState returns the TLS session state
+func (s *streamConn) ConnectionState() tls.ConnectionState {
+	return s.conn.State()
+}
+
+// RemoteAddr returns the address of the peer
+func (s *streamConn) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Stats returns the traffic counters of the connection
+func (s *streamConn) Stats() TransportStats {
+	return s.counters.stats()
+}
+
+// Close closes the TLS connection
+func (s *streamConn) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,666 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Frame types used inside the UDP transport, never passed on to FrameConn
+const (
+	// Sent on the TLS stream to give the client its datagram session ID
+	frameTypeSession FrameType = 0x80 + iota
+	// Datagram checking that the UDP path works
+	frameTypePing
+	// Datagram answering a ping
+	frameTypePong
+)
+
+const (
+	// Cleartext datagram header: session ID, key epoch and sequence number
+	datagramHeaderLen = 8 + 4 + 8
+	// GCM authentication tag
+	datagramTagLen = 16
+	// Largest datagram: header, frame type, largest frame payload and tag
+	maxDatagramSize = datagramHeaderLen + 1 + maxFramePayload + datagramTagLen
+
+	// Label for the data channel keys exported from the TLS session (RFC 5705)
+	datagramKeyLabel = "EXPORTER-tuno-datagram"
+	// AES-256 key length
+	datagramKeyLen = 32
+
+	// The sender moves to the keys of the next epoch after this many packets or this long
+	rekeyPackets  = 1 << 24
+	rekeyInterval = 10 * time.Minute
+	// Epochs the peer may have moved ahead while its datagrams were lost
+	maxEpochSkip = 8
+
+	// How often the client checks the UDP path while it works, and while it does not
+	pingInterval      = 10 * time.Second
+	pingRetryInterval = 2 * time.Second
+	// Without a datagram for this long, data goes over the TLS stream again
+	datagramTimeout = 30 * time.Second
+
+	// Received frames waiting for ReceiveFrame
+	datagramQueueLen = 256
+)
+
+// udpTransport sends IP packets as encrypted UDP datagrams
+// The TLS stream still carries the handshake and control frames, and data
+// whenever the UDP path does not work. Datagram keys are exported from the
+// TLS session, one per direction and key epoch.
+type udpTransport struct {
+	tls    *tlsTransport
+	logger *logrus.Logger
+}
+
+// Name returns the name used in the transport setting
+func (t *udpTransport) Name() string {
+	return TransportUDP
+}
+
+// Dial connects the TLS stream; the UDP path is set up once the server assigns a session
+func (t *udpTransport) Dial(addr string, timeout time.Duration) (TransportConn, error) {
+	stream, err := t.tls.dialStream(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := newDatagramConn(stream, true, t.logger)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	go conn.readStream()
+	return conn, nil
+}
+
+// Listen accepts TLS streams and receives the datagrams of all clients on the same port over UDP
+func (t *udpTransport) Listen(addr string) (TransportListener, error) {
+	streams, err := t.tls.listenStream(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bind the port the stream listener got, which differs from addr when it asked for port 0
+	tcpAddr := streams.Addr().(*net.TCPAddr)
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone})
+	if err != nil {
+		streams.Close()
+		return nil, err
+	}
+
+	l := &datagramListener{
+		streams:  streams,
+		socket:   socket,
+		sessions: make(map[uint64]*datagramConn),
+		logger:   t.logger,
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+// datagramListener hands out client connections and routes datagrams to them by session ID
+type datagramListener struct {
+	streams  *tlsListener
+	socket   *net.UDPConn
+	sessions map[uint64]*datagramConn
+	mutex    sync.RWMutex
+	logger   *logrus.Logger
+}
+
+// Accept returns the next client connection and tells the client its session ID
+func (l *datagramListener) Accept() (TransportConn, error) {
+	for {
+		stream, err := l.streams.acceptStream()
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := newDatagramConn(stream, false, l.logger)
+		if err != nil {
+			l.logger.Errorf("Failed to set up data channel: %v", err)
+			stream.Close()
+			continue
+		}
+		session := l.register(conn)
+		conn.udp.Store(l.socket)
+		conn.onClose = func() { l.unregister(session) }
+
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], session)
+		if err := stream.SendFrame(frameTypeSession, id[:]); err != nil {
+			l.logger.Debugf("Failed to send datagram session: %v", err)
+			conn.Close()
+			continue
+		}
+		go conn.readStream()
+		return conn, nil
+	}
+}
+
+// register assigns a connection an unused random session ID
+func (l *datagramListener) register(conn *datagramConn) uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for {
+		var id [8]byte
+		rand.Read(id[:])
+		session := binary.BigEndian.Uint64(id[:])
+		if _, ok := l.sessions[session]; session != 0 && !ok {
+			conn.session.Store(session)
+			l.sessions[session] = conn
+			return session
+		}
+	}
+}
+
+// unregister forgets a closed connection's session
+func (l *datagramListener) unregister(session uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.sessions, session)
+}
+
+// readLoop passes each datagram to the connection of its session
+func (l *datagramListener) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := l.socket.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			l.logger.Debugf("Datagram read error: %v", err)
+			continue
+		}
+		if n < datagramHeaderLen {
+			continue
+		}
+
+		l.mutex.RLock()
+		conn := l.sessions[binary.BigEndian.Uint64(buf[:8])]
+		l.mutex.RUnlock()
+		if conn != nil {
+			conn.handleDatagram(buf[:n], from)
+		}
+	}
+}
+
+// Close stops accepting connections and closes the UDP socket
+func (l *datagramListener) Close() error {
+	err := l.streams.Close()
+	l.socket.Close()
+	return err
+}
+
+// Addr returns the listening address
+func (l *datagramListener) Addr() net.Addr {
+	return l.streams.Addr()
+}
+
+// receivedFrame is a frame waiting for ReceiveFrame
+type receivedFrame struct {
+	frameType FrameType
+	payload   []byte
+}
+
+// datagramKeys decrypt the datagrams of one key epoch
+type datagramKeys struct {
+	epoch  uint32
+	aead   cipher.AEAD
+	replay ReplayWindow
+}
+
+// datagramConn carries data frames over UDP and everything else over the TLS stream
+type datagramConn struct {
+	stream  *streamConn
+	state   tls.ConnectionState
+	client  bool
+	session atomic.Uint64
+	udp     atomic.Pointer[net.UDPConn]
+	peer    atomic.Pointer[net.UDPAddr]
+	onClose func()
+	logger  *logrus.Logger
+
+	// Sending side, moving to a new epoch periodically
+	sendMutex sync.Mutex
+	sendAEAD  cipher.AEAD
+	sendEpoch uint32
+	sendSeq   uint64
+	sendSince time.Time
+	sendBuf   []byte
+
+	// Receiving side, keeping the previous epoch for datagrams still in flight
+	// and the keys of later epochs until a datagram authenticates with them
+	recvMutex    sync.Mutex
+	recvKeys     *datagramKeys
+	recvPrevious *datagramKeys
+	recvPending  map[uint32]*datagramKeys
+	lastReceived atomic.Int64
+
+	frames    chan receivedFrame
+	deadline  atomic.Int64
+	err       error
+	failed    chan struct{}
+	failOnce  sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+	counters  transportCounters
+}
+
+// newDatagramConn wraps an established TLS stream
+func newDatagramConn(stream *streamConn, client bool, logger *logrus.Logger) (*datagramConn, error) {
+	c := &datagramConn{
+		stream:      stream,
+		state:       stream.ConnectionState(),
+		client:      client,
+		logger:      logger,
+		recvPending: make(map[uint32]*datagramKeys),
+		frames:      make(chan receivedFrame, datagramQueueLen),
+		failed:      make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+
+	aead, err := c.exportAEAD(0, !client)
+	if err != nil {
+		return nil, err
+	}
+	c.recvKeys = &datagramKeys{aead: aead}
+	return c, nil
+}
+
+// exportAEAD derives the AES-GCM key of one direction in an epoch from the TLS session
+func (c *datagramConn) exportAEAD(epoch uint32, clientToServer bool) (cipher.AEAD, error) {
+	var context [4]byte
+	binary.BigEndian.PutUint32(context[:], epoch)
+	material, err := c.state.ExportKeyingMaterial(datagramKeyLabel, context[:], 2*datagramKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export datagram keys: %v", err)
+	}
+
+	key := material[datagramKeyLen:]
+	if clientToServer {
+		key = material[:datagramKeyLen]
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readStream queues frames from the TLS stream, picking out the session assignment
+func (c *datagramConn) readStream() {
+	buf := make([]byte, MaxFrameSize)
+	for {
+		frameType, payload, err := c.stream.ReceiveFrame(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		if frameType == frameTypeSession {
+			if c.client && len(payload) == 8 && c.udp.Load() == nil {
+				go c.startUDP(binary.BigEndian.Uint64(payload))
+			}
+			continue
+		}
+
+		frame := receivedFrame{frameType: frameType, payload: append([]byte(nil), payload...)}
+		select {
+		case c.frames <- frame:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// startUDP opens the client's UDP socket to the server and keeps checking the path
+func (c *datagramConn) startUDP(session uint64) {
+	remote, ok := c.stream.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	socket, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: remote.IP, Port: remote.Port, Zone: remote.Zone})
+	if err != nil {
+		c.logger.Warnf("Failed to open UDP data channel, sending data over TCP: %v", err)
+		return
+	}
+
+	c.session.Store(session)
+	c.udp.Store(socket)
+	select {
+	case <-c.closed:
+		socket.Close()
+		return
+	default:
+	}
+
+	go c.readUDP(socket)
+	c.pingLoop()
+}
+
+// readUDP receives the client's datagrams from the server
+func (c *datagramConn) readUDP(socket *net.UDPConn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := socket.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// ICMP errors for earlier datagrams surface here, the path check deals with them
+			continue
+		}
+		c.handleDatagram(buf[:n], nil)
+	}
+}
+
+// pingLoop checks the UDP path, switching data between UDP and the TLS stream as it comes and goes
+func (c *datagramConn) pingLoop() {
+	started := time.Now()
+	wasUp, warned := false, false
+	for {
+		up := c.udpUp()
+		switch {
+		case up && !wasUp:
+			c.logger.Info("UDP data channel established")
+		case !up && wasUp:
+			c.logger.Warn("UDP data channel lost, sending data over TCP")
+		case !up && !warned && time.Since(started) > datagramTimeout:
+			c.logger.Warn("No UDP response from the server, sending data over TCP")
+			warned = true
+		}
+		wasUp = up
+
+		if err := c.sendDatagram(frameTypePing, nil); err != nil {
+			c.logger.Debugf("Failed to send UDP ping: %v", err)
+		}
+
+		interval := pingRetryInterval
+		if up {
+			interval = pingInterval
+		}
+		select {
+		case <-time.After(interval):
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// udpUp reports whether a datagram arrived from the peer recently
+func (c *datagramConn) udpUp() bool {
+	last := c.lastReceived.Load()
+	return last != 0 && time.Since(time.Unix(0, last)) < datagramTimeout
+}
+
+// sendDatagram encrypts a frame into a single datagram
+func (c *datagramConn) sendDatagram(frameType FrameType, payload []byte) error {
+	socket := c.udp.Load()
+	if socket == nil {
+		return errors.New("UDP data channel is not open")
+	}
+
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	datagram, err := c.seal(frameType, payload)
+	if err != nil {
+		return err
+	}
+
+	if c.client {
+		_, err = socket.Write(datagram)
+	} else if peer := c.peer.Load(); peer != nil {
+		_, err = socket.WriteToUDP(datagram, peer)
+	} else {
+		err = errors.New("client UDP address is not known yet")
+	}
+	if err != nil {
+		return err
+	}
+	c.counters.sent(len(datagram))
+	return nil
+}
+
+// seal encrypts a frame into a datagram in the send buffer
+// The caller must hold sendMutex and finish with the datagram before releasing it.
+func (c *datagramConn) seal(frameType FrameType, payload []byte) ([]byte, error) {
+	// Move to the keys of the next epoch periodically. While nothing arrives
+	// over UDP only pings are sent, and rekeying for them would just leave
+	// the peer further behind.
+	if c.sendAEAD == nil || c.sendSeq >= rekeyPackets || time.Since(c.sendSince) >= rekeyInterval && c.udpUp() {
+		epoch := c.sendEpoch
+		if c.sendAEAD != nil {
+			epoch++
+		}
+		aead, err := c.exportAEAD(epoch, c.client)
+		if err != nil {
+			return nil, err
+		}
+		c.sendAEAD, c.sendEpoch, c.sendSeq, c.sendSince = aead, epoch, 0, time.Now()
+	}
+	c.sendSeq++
+
+	size := datagramHeaderLen + 1 + len(payload) + datagramTagLen
+	if cap(c.sendBuf) < size {
+		c.sendBuf = make([]byte, size)
+	}
+	buf := c.sendBuf[:datagramHeaderLen+1+len(payload)]
+	binary.BigEndian.PutUint64(buf[0:8], c.session.Load())
+	binary.BigEndian.PutUint32(buf[8:12], c.sendEpoch)
+	binary.BigEndian.PutUint64(buf[12:20], c.sendSeq)
+	buf[datagramHeaderLen] = byte(frameType)
+	copy(buf[datagramHeaderLen+1:], payload)
+
+	// The header is authenticated along with the encrypted frame
+	header := buf[:datagramHeaderLen]
+	return c.sendAEAD.Seal(header, datagramNonce(c.sendSeq), buf[datagramHeaderLen:], header), nil
+}
+
+// handleDatagram authenticates and decrypts a datagram and queues the frame it carries
+// On the server from is the sender, which becomes the client's address so
+// clients moving between networks keep their UDP path.
+func (c *datagramConn) handleDatagram(datagram []byte, from *net.UDPAddr) {
+	frame, ok := c.open(datagram)
+	if !ok {
+		return
+	}
+
+	c.lastReceived.Store(time.Now().UnixNano())
+	c.counters.received(len(datagram))
+	if from != nil {
+		c.peer.Store(from)
+	}
+
+	frameType, payload := FrameType(frame[0]), frame[1:]
+	switch frameType {
+	case frameTypePing:
+		if err := c.sendDatagram(frameTypePong, nil); err != nil {
+			c.logger.Debugf("Failed to answer UDP ping: %v", err)
+		}
+	case frameTypePong:
+	case FrameTypeData, FrameTypeFragment:
+		// Like any UDP packet, data is dropped when the reader falls behind
+		select {
+		case c.frames <- receivedFrame{frameType: frameType, payload: append([]byte(nil), payload...)}:
+		default:
+		}
+	}
+}
+
+// open authenticates and decrypts a datagram, returning the frame it carries
+// The frame is decrypted in place.
+func (c *datagramConn) open(datagram []byte) ([]byte, bool) {
+	if len(datagram) < datagramHeaderLen+1+datagramTagLen {
+		return nil, false
+	}
+	epoch := binary.BigEndian.Uint32(datagram[8:12])
+	seq := binary.BigEndian.Uint64(datagram[12:20])
+
+	c.recvMutex.Lock()
+	defer c.recvMutex.Unlock()
+
+	keys, next := c.recvKeys, false
+	switch {
+	case epoch == keys.epoch:
+	case c.recvPrevious != nil && epoch == c.recvPrevious.epoch:
+		keys = c.recvPrevious
+	case epoch > keys.epoch && epoch-keys.epoch <= maxEpochSkip:
+		// The peer rekeyed, perhaps more than once while its datagrams were
+		// lost. The keys of each epoch are derived once, so forged datagrams
+		// cannot make every packet pay for it, and only kept for good once a
+		// datagram authenticates with them.
+		pending, ok := c.recvPending[epoch]
+		if !ok {
+			aead, err := c.exportAEAD(epoch, !c.client)
+			if err != nil {
+				return nil, false
+			}
+			pending = &datagramKeys{epoch: epoch, aead: aead}
+			c.recvPending[epoch] = pending
+		}
+		keys, next = pending, true
+	default:
+		return nil, false
+	}
+	if !keys.replay.Check(seq) {
+		return nil, false
+	}
+	header := datagram[:datagramHeaderLen]
+	frame, err := keys.aead.Open(datagram[datagramHeaderLen:datagramHeaderLen], datagramNonce(seq), datagram[datagramHeaderLen:], header)
+	if err != nil {
+		return nil, false
+	}
+	keys.replay.Accept(seq)
+	if next {
+		c.recvPrevious, c.recvKeys = c.recvKeys, keys
+		for pendingEpoch := range c.recvPending {
+			if pendingEpoch <= epoch {
+				delete(c.recvPending, pendingEpoch)
+			}
+		}
+	}
+	return frame, true
+}
+
+// datagramNonce returns the GCM nonce for a sequence number
+// Every direction and epoch has its own key, so the sequence number alone keeps nonces unique.
+func datagramNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// SendFrame sends data frames as datagrams while the UDP path works, and everything else over the TLS stream
+func (c *datagramConn) SendFrame(frameType FrameType, payload []byte) error {
+	if (frameType == FrameTypeData || frameType == FrameTypeFragment) && c.udpUp() {
+		// Datagrams the path refuses, for instance because they are too large, take the stream instead
+		if err := c.sendDatagram(frameType, payload); err == nil {
+			return nil
+		}
+	}
+	return c.stream.SendFrame(frameType, payload)
+}
+
+// ReceiveFrame returns the next frame from either the TLS stream or UDP
+func (c *datagramConn) ReceiveFrame(buf []byte) (FrameType, []byte, error) {
+	var timeout <-chan time.Time
+	if deadline := c.deadline.Load(); deadline != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, deadline)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var frame receivedFrame
+	select {
+	case frame = <-c.frames:
+	case <-c.failed:
+		// Frames received before the stream failed still come first
+		select {
+		case frame = <-c.frames:
+		default:
+			return 0, nil, c.err
+		}
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+
+	if len(frame.payload) > len(buf) {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds buffer of %d bytes", len(frame.payload), len(buf))
+	}
+	return frame.frameType, buf[:copy(buf, frame.payload)], nil
+}
+
+// fail records the error that ended the TLS stream
+func (c *datagramConn) fail(err error) {
+	c.failOnce.Do(func() {
+		c.err = err
+		close(c.failed)
+	})
+}
+
+// SetReadDeadline bounds the wait in ReceiveFrame
+func (c *datagramConn) SetReadDeadline(deadline time.Time) error {
+	if deadline.IsZero() {
+		c.deadline.Store(0)
+	} else {
+		c.deadline.Store(deadline.UnixNano())
+	}
+	return nil
+}
+
+// PathMTU returns the path MTU estimate of the TLS stream
+// Datagrams carry less overhead than the stream, so they fit too.
+func (c *datagramConn) PathMTU() (int, bool) {
+	return c.stream.PathMTU()
+}
+
+// ConnectionState returns the TLS session state
+func (c *datagramConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+// RemoteAddr returns the address of the peer's TLS stream
+func (c *datagramConn) RemoteAddr() net.Addr {
+	return c.stream.RemoteAddr()
+}
+
+// Stats returns the traffic counters of the TLS stream and UDP together
+func (c *datagramConn) Stats() TransportStats {
+	stream, datagrams := c.stream.Stats(), c.counters.stats()
+	return TransportStats{
+		FramesSent:     stream.FramesSent + datagrams.FramesSent,
+		FramesReceived: stream.FramesReceived + datagrams.FramesReceived,
+		BytesSent:      stream.BytesSent + datagrams.BytesSent,
+		BytesReceived:  stream.BytesReceived + datagrams.BytesReceived,
+	}
+}
+
+// Close closes the TLS stream and the UDP path
+func (c *datagramConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if socket := c.udp.Load(); c.client && socket != nil {
+			socket.Close()
+		}
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return c.stream.Close()
+}
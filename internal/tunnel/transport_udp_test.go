@@ -0,0 +1,212 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// tlsStatePair performs a TLS handshake over a pipe and returns the client's and server's session state
+func tlsStatePair(t *testing.T) (tls.ConnectionState, tls.ConnectionState) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tuno-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	client := tls.Client(clientSide, &tls.Config{InsecureSkipVerify: true})
+	server := tls.Server(serverSide, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	done := make(chan error, 1)
+	go func() { done <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return client.ConnectionState(), server.ConnectionState()
+}
+
+// datagramPair returns the datagram ends of both sides of a TLS session, without sockets
+func datagramPair(t *testing.T) (*datagramConn, *datagramConn) {
+	t.Helper()
+	clientState, serverState := tlsStatePair(t)
+
+	newConn := func(state tls.ConnectionState, client bool) *datagramConn {
+		c := &datagramConn{state: state, client: client, recvPending: make(map[uint32]*datagramKeys)}
+		aead, err := c.exportAEAD(0, !client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.recvKeys = &datagramKeys{aead: aead}
+		return c
+	}
+	return newConn(clientState, true), newConn(serverState, false)
+}
+
+// sealed returns a copy of a datagram sealed by c
+func sealed(t *testing.T, c *datagramConn, payload string) []byte {
+	t.Helper()
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	datagram, err := c.seal(FrameTypeData, []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), datagram...)
+}
+
+// opened returns the payload of a datagram opened by c, or false if it was rejected
+func opened(c *datagramConn, datagram []byte) (string, bool) {
+	frame, ok := c.open(append([]byte(nil), datagram...))
+	if !ok {
+		return "", false
+	}
+	if FrameType(frame[0]) != FrameTypeData {
+		return "", false
+	}
+	return string(frame[1:]), true
+}
+
+// rekey makes the next datagram sealed by c use a new epoch
+func rekey(c *datagramConn) {
+	c.sendMutex.Lock()
+	c.sendSeq = rekeyPackets
+	c.sendMutex.Unlock()
+}
+
+func TestDatagramSealOpen(t *testing.T) {
+	client, server := datagramPair(t)
+
+	for _, dir := range []struct {
+		name     string
+		from, to *datagramConn
+	}{
+		{"client to server", client, server},
+		{"server to client", server, client},
+	} {
+		t.Run(dir.name, func(t *testing.T) {
+			datagram := sealed(t, dir.from, "hello")
+			if got, ok := opened(dir.to, datagram); !ok || got != "hello" {
+				t.Fatalf("open = %q, %v; want hello", got, ok)
+			}
+
+			// Each side only opens what the other side sealed
+			if _, ok := opened(dir.from, sealed(t, dir.from, "own")); ok {
+				t.Error("a side opened its own datagram")
+			}
+
+			if _, ok := opened(dir.to, datagram); ok {
+				t.Error("replayed datagram was opened")
+			}
+
+			tampered := sealed(t, dir.from, "tampered")
+			tampered[len(tampered)-1] ^= 1
+			if _, ok := opened(dir.to, tampered); ok {
+				t.Error("tampered datagram was opened")
+			}
+
+			// The header is authenticated too
+			moved := sealed(t, dir.from, "moved")
+			moved[0] ^= 1
+			if _, ok := opened(dir.to, moved); ok {
+				t.Error("datagram with a changed header was opened")
+			}
+		})
+	}
+}
+
+func TestDatagramRekey(t *testing.T) {
+	client, server := datagramPair(t)
+
+	inFlight := sealed(t, client, "epoch 0")
+	rekey(client)
+	if got, ok := opened(server, sealed(t, client, "epoch 1")); !ok || got != "epoch 1" {
+		t.Fatalf("open after rekey = %q, %v", got, ok)
+	}
+	if server.recvKeys.epoch != 1 {
+		t.Errorf("receiving epoch %d; want 1", server.recvKeys.epoch)
+	}
+
+	// Datagrams of the previous epoch still in flight are accepted
+	if got, ok := opened(server, inFlight); !ok || got != "epoch 0" {
+		t.Errorf("open of previous epoch = %q, %v", got, ok)
+	}
+}
+
+func TestDatagramEpochSkip(t *testing.T) {
+	client, server := datagramPair(t)
+	opened(server, sealed(t, client, "epoch 0"))
+
+	// The sender moved on several times while its datagrams were lost
+	for i := 0; i < maxEpochSkip; i++ {
+		rekey(client)
+		sealed(t, client, "lost")
+	}
+	if got, ok := opened(server, sealed(t, client, "recovered")); !ok || got != "recovered" {
+		t.Fatalf("open after %d lost epochs = %q, %v", maxEpochSkip, got, ok)
+	}
+	if server.recvKeys.epoch != maxEpochSkip || len(server.recvPending) != 0 {
+		t.Errorf("receiving epoch %d with %d pending; want %d with none", server.recvKeys.epoch, len(server.recvPending), maxEpochSkip)
+	}
+
+	// Epochs too far ahead are ignored
+	for i := 0; i <= maxEpochSkip; i++ {
+		rekey(client)
+		sealed(t, client, "lost")
+	}
+	if _, ok := opened(server, sealed(t, client, "too far")); ok {
+		t.Error("datagram beyond the epoch bound was opened")
+	}
+}
+
+func TestDatagramForgedEpochKeysAreDerivedOnce(t *testing.T) {
+	client, server := datagramPair(t)
+
+	rekey(client)
+	sealed(t, client, "epoch 0")
+	rekey(client)
+	forged := sealed(t, client, "epoch 1")
+	forged[len(forged)-1] ^= 1
+
+	if _, ok := opened(server, forged); ok {
+		t.Fatal("forged datagram was opened")
+	}
+	pending, ok := server.recvPending[1]
+	if !ok || server.recvKeys.epoch != 0 {
+		t.Fatalf("forged datagram changed the receiving epoch to %d, pending %v", server.recvKeys.epoch, ok)
+	}
+
+	// Another forged datagram of the same epoch reuses the derived keys
+	opened(server, forged)
+	if server.recvPending[1] != pending {
+		t.Error("keys of a pending epoch were derived again")
+	}
+
+	if got, ok := opened(server, sealed(t, client, "genuine")); !ok || got != "genuine" {
+		t.Errorf("open of a genuine datagram = %q, %v", got, ok)
+	}
+}
@@ -1,6 +1,8 @@
 package tunnel
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/Onyekachukwu-Nweke/tuno-vpn/internal/config"
 	"github.com/sirupsen/logrus"
@@ -10,26 +12,52 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unsafe"
 )
 
+const (
+	// Packets carrying this mark are routed through the TUN device
+	tunnelMark = 0x7475
+	// Packets carrying this mark bypass the TUN device
+	bypassMark = 0x7476
+	// Routing tables holding the routes for marked packets
+	tunnelRouteTable = 0x7475
+	bypassRouteTable = 0x7476
+	// Priority of the rules selecting those tables, ahead of the main table
+	tunnelRulePriority = 1000
+	// nftables table marking packets for policy routing
+	policyTable = "tuno_policy"
+
+	// Per-application routing modes
+	appModeInclude = "include"
+	appModeExclude = "exclude"
+	// Mount point of the cgroup v2 hierarchy
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
 // TUNDevice represents a virtual TUN network interface
 type TUNDevice struct {
 	name      string
 	fd        int
 	mtu       int
-	cidr      string
-	ipNet     *net.IPNet
+	addrs     []*net.IPNet
 	stack     *stack.Stack
 	logger    *logrus.Logger
 	isRunning bool
+	mutex     sync.RWMutex
 }
 
 // NewTUNDevice creates a new TUN device
 func NewTUNDevice(cfg interface{}, logger *logrus.Logger) (*TUNDevice, error) {
 	var tunDevice string
 	var tunIP string
+	var tunIPv6 string
 	var mtu int
 
 	// Extract configuration based on type
@@ -38,16 +66,22 @@ func NewTUNDevice(cfg interface{}, logger *logrus.Logger) (*TUNDevice, error) {
 		tunDevice = c.TunDevice
 		tunIP = c.TunIP
 		mtu = c.MTU
+		if c.EnableIPv6 {
+			tunIPv6 = c.TunIPv6
+		}
 	case *config.ClientConfig:
 		tunDevice = c.TunDevice
 		tunIP = c.TunIP
 		mtu = c.MTU
+		if c.EnableIPv6 {
+			tunIPv6 = c.TunIPv6
+		}
 	default:
 		return nil, fmt.Errorf("unsupported config type")
 	}
 
 	// Parse IP network
-	ip, ipNet, err := net.ParseCIDR(tunIP)
+	addr, err := parseAddress(tunIP)
 	if err != nil {
 		return nil, fmt.Errorf("invalid TUN IP address: %v", err)
 	}
@@ -59,7 +93,7 @@ func NewTUNDevice(cfg interface{}, logger *logrus.Logger) (*TUNDevice, error) {
 	}
 
 	// Configure the IP address
-	if err := configureTUN(tunDevice, ip, ipNet, mtu); err != nil {
+	if err := configureTUN(tunDevice, addr, mtu); err != nil {
 		unix.Close(fd)
 		return nil, fmt.Errorf("failed to configure TUN device: %v", err)
 	}
@@ -67,15 +101,24 @@ func NewTUNDevice(cfg interface{}, logger *logrus.Logger) (*TUNDevice, error) {
 	// Create a new network stack
 	s := createNetworkStack()
 
-	return &TUNDevice{
+	t := &TUNDevice{
 		name:   tunDevice,
 		fd:     fd,
 		mtu:    mtu,
-		cidr:   tunIP,
-		ipNet:  ipNet,
+		addrs:  []*net.IPNet{addr},
 		stack:  s,
 		logger: logger,
-	}, nil
+	}
+
+	// Add the IPv6 address alongside the IPv4 one
+	if tunIPv6 != "" {
+		if err := t.AddAddress(tunIPv6); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to configure TUN IPv6 address: %v", err)
+		}
+	}
+
+	return t, nil
 }
 
 func createTUN(name string, mtu int) (int, error) {
@@ -108,7 +151,7 @@ func createTUN(name string, mtu int) (int, error) {
 }
 
 // configureTUN configures the TUN device with IP address and MTU
-func configureTUN(name string, ip net.IP, ipNet *net.IPNet, mtu int) error {
+func configureTUN(name string, addr *net.IPNet, mtu int) error {
 	// Get the link for the device
 	link, err := netlink.LinkByName(name)
 	if err != nil {
@@ -120,16 +163,8 @@ func configureTUN(name string, ip net.IP, ipNet *net.IPNet, mtu int) error {
 		return fmt.Errorf("failed to set MTU: %v", err)
 	}
 
-	// Create the IP address to add to the interface
-	addr := &netlink.Addr{
-		IPNet: &net.IPNet{
-			IP:   ip,
-			Mask: ipNet.Mask,
-		},
-	}
-
 	// Add the address to the interface
-	if err := netlink.AddrAdd(link, addr); err != nil {
+	if err := netlink.AddrAdd(link, tunAddr(addr)); err != nil {
 		// Ignore if the address already exists
 		if !strings.Contains(err.Error(), "file exists") {
 			return fmt.Errorf("failed to add IP address: %v", err)
@@ -144,6 +179,264 @@ func configureTUN(name string, ip net.IP, ipNet *net.IPNet, mtu int) error {
 	return nil
 }
 
+// configurePolicyRouting routes packets marked by the given nftables statements
+// The statements run in an output route chain, so the kernel re-routes packets
+// they mark. Packets marked for the tunnel use a table routing everything
+// through the TUN device; packets marked to bypass it use a copy of the main
+// table without the TUN routes. Both are masqueraded, since their source was
+// chosen before they were re-routed, and replies get the connection's mark
+// back so reverse path filtering accepts them.
+func configurePolicyRouting(name string, statements []string, stateDir string, logger *logrus.Logger) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", name, err)
+	}
+
+	// Default routes for packets marked for the tunnel
+	for _, cidr := range []string{"0.0.0.0/0", "::/0"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       network,
+			Table:     tunnelRouteTable,
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  routeProtocol,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			// The device may not carry IPv6
+			if network.IP.To4() != nil {
+				return fmt.Errorf("failed to add route to table %d: %v", tunnelRouteTable, err)
+			}
+		}
+	}
+
+	// Routes for packets bypassing the tunnel, as they were before it came up
+	if err := copyBypassRoutes(link.Attrs().Index, logger); err != nil {
+		return err
+	}
+
+	// Look up marked packets in those tables
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		for mark, table := range map[int]int{tunnelMark: tunnelRouteTable, bypassMark: bypassRouteTable} {
+			rule := netlink.NewRule()
+			rule.Family = family
+			rule.Mark = uint32(mark)
+			rule.Table = table
+			rule.Priority = tunnelRulePriority
+			if err := netlink.RuleAdd(rule); err != nil && !strings.Contains(err.Error(), "file exists") {
+				return fmt.Errorf("failed to add policy rule: %v", err)
+			}
+		}
+	}
+
+	// Replies arrive on the TUN device from addresses the main table routes elsewhere
+	rpFilter := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/rp_filter", name)
+	if err := os.WriteFile(rpFilter, []byte("2"), 0644); err != nil {
+		return fmt.Errorf("failed to relax reverse path filter: %v", err)
+	}
+	// Let reverse path filtering take the restored mark into account
+	if err := setSysctl(stateDir, srcValidMarkSysctl, "1"); err != nil {
+		return fmt.Errorf("failed to enable src_valid_mark: %v", err)
+	}
+
+	marks := fmt.Sprintf("{ %#x, %#x }", tunnelMark, bypassMark)
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "table inet %s\n", policyTable)
+	fmt.Fprintf(&script, "delete table inet %s\n", policyTable)
+	fmt.Fprintf(&script, "table inet %s {\n", policyTable)
+	fmt.Fprintf(&script, "\tchain classify {\n")
+	for _, statement := range statements {
+		fmt.Fprintf(&script, "\t\t%s\n", statement)
+	}
+	fmt.Fprintf(&script, "\t}\n")
+	fmt.Fprintf(&script, "\tchain output {\n")
+	fmt.Fprintf(&script, "\t\ttype route hook output priority mangle;\n")
+	fmt.Fprintf(&script, "\t\tjump classify\n")
+	fmt.Fprintf(&script, "\t\tmeta mark %s ct mark set meta mark\n", marks)
+	fmt.Fprintf(&script, "\t}\n")
+	fmt.Fprintf(&script, "\tchain prerouting {\n")
+	fmt.Fprintf(&script, "\t\ttype filter hook prerouting priority mangle;\n")
+	fmt.Fprintf(&script, "\t\tct mark %s meta mark set ct mark\n", marks)
+	fmt.Fprintf(&script, "\t}\n")
+	fmt.Fprintf(&script, "\tchain postrouting {\n")
+	fmt.Fprintf(&script, "\t\ttype nat hook postrouting priority srcnat;\n")
+	fmt.Fprintf(&script, "\t\toifname %q meta mark %#x masquerade\n", name, tunnelMark)
+	fmt.Fprintf(&script, "\t\toifname != %q meta mark %#x masquerade\n", name, bypassMark)
+	fmt.Fprintf(&script, "\t}\n")
+	fmt.Fprintf(&script, "}\n")
+
+	if err := runNFT(script.String()); err != nil {
+		return fmt.Errorf("failed to install policy routing rules: %v", err)
+	}
+	return nil
+}
+
+// copyBypassRoutes copies the main table routes not using the TUN device into the bypass table
+// Routes that fail to copy are logged and skipped, leaving their destinations
+// unreachable for bypassing traffic rather than failing the whole setup.
+func copyBypassRoutes(tunIndex int, logger *logrus.Logger) error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("failed to list routes to bypass the tunnel: %v", err)
+		}
+		for _, route := range routes {
+			if route.LinkIndex == tunIndex {
+				continue
+			}
+			route.Table = bypassRouteTable
+			route.Protocol = routeProtocol
+			if err := netlink.RouteReplace(&route); err != nil {
+				logger.Warnf("Failed to copy route %s to the bypass table: %v", route.Dst, err)
+			}
+		}
+	}
+	return nil
+}
+
+// teardownPolicyRouting removes everything configurePolicyRouting installed,
+// including leftovers from a client that did not shut down cleanly
+func teardownPolicyRouting(stateDir string, logger *logrus.Logger) {
+	deleteNFTTable(policyTable)
+	if err := restoreSysctl(stateDir, srcValidMarkSysctl); err != nil {
+		logger.Warnf("Failed to restore src_valid_mark: %v", err)
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		for _, table := range []int{tunnelRouteTable, bypassRouteTable} {
+			rules, err := netlink.RuleListFiltered(family, &netlink.Rule{Table: table}, netlink.RT_FILTER_TABLE)
+			if err == nil {
+				for i := range rules {
+					netlink.RuleDel(&rules[i])
+				}
+			}
+
+			routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+			if err == nil {
+				for i := range routes {
+					netlink.RouteDel(&routes[i])
+				}
+			}
+		}
+	}
+}
+
+// ruleStatements returns the nftables statements enforcing protocol and port rules
+// Each matching rule ends evaluation, so rules keep their priority order.
+func ruleStatements(rules []Rule) []string {
+	statements := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		var match []string
+
+		if rule.Network != nil {
+			ones, _ := rule.Network.Mask.Size()
+			switch {
+			case rule.Network.IP.To4() != nil && ones == 0:
+				match = append(match, "meta nfproto ipv4")
+			case rule.Network.IP.To4() != nil:
+				match = append(match, "ip daddr "+rule.Network.String())
+			case ones == 0:
+				match = append(match, "meta nfproto ipv6")
+			default:
+				match = append(match, "ip6 daddr "+rule.Network.String())
+			}
+		}
+
+		switch rule.Protocol {
+		case 0:
+			if len(rule.Ports) > 0 {
+				match = append(match, "meta l4proto { tcp, udp }")
+			}
+		case protocolICMPv4:
+			match = append(match, "meta l4proto { icmp, ipv6-icmp }")
+		default:
+			match = append(match, "meta l4proto "+protocolName(rule.Protocol))
+		}
+
+		if len(rule.Ports) > 0 {
+			ports := make([]string, len(rule.Ports))
+			for i, p := range rule.Ports {
+				ports[i] = p.String()
+			}
+			match = append(match, fmt.Sprintf("th dport { %s }", strings.Join(ports, ", ")))
+		}
+
+		switch rule.Type {
+		case RouteTypeTUN:
+			match = append(match, fmt.Sprintf("meta mark set %#x return", tunnelMark))
+		case RouteTypeInternet:
+			match = append(match, fmt.Sprintf("meta mark set %#x return", bypassMark))
+		case RouteTypeDrop:
+			match = append(match, "drop")
+		}
+		statements = append(statements, strings.Join(match, " "))
+	}
+	return statements
+}
+
+// exemptStatements returns the nftables statements keeping local traffic and
+// the tunnel's own connections to the server out of policy routing
+func exemptStatements(servers []net.IP) []string {
+	statements := []string{"fib daddr type local return"}
+	for _, ip := range servers {
+		if ip.To4() != nil {
+			statements = append(statements, fmt.Sprintf("ip daddr %s return", ip))
+		} else {
+			statements = append(statements, fmt.Sprintf("ip6 daddr %s return", ip))
+		}
+	}
+	return statements
+}
+
+// appRoutingStatements returns the nftables statements marking packets for per-application routing
+// In include mode only processes in the cgroup use the tunnel; in exclude mode
+// everything except them does, apart from optionally LAN traffic. Excluded
+// processes are marked to bypass the tunnel, since the main table may still
+// route their traffic through it.
+func appRoutingStatements(mode, cgroup string, allowLAN bool) []string {
+	level := len(strings.Split(strings.Trim(cgroup, "/"), "/"))
+	match := fmt.Sprintf("socket cgroupv2 level %d %q", level, strings.Trim(cgroup, "/"))
+	mark := fmt.Sprintf("meta mark set %#x", tunnelMark)
+
+	if mode == appModeInclude {
+		return []string{match + " " + mark}
+	}
+
+	statements := []string{fmt.Sprintf("%s meta mark set %#x return", match, bypassMark)}
+	if allowLAN {
+		statements = append(statements,
+			fmt.Sprintf("ip daddr { %s } return", strings.Join(lanNetworks4, ", ")),
+			fmt.Sprintf("ip6 daddr { %s } return", strings.Join(lanNetworks6, ", ")))
+	}
+	return append(statements, mark)
+}
+
+// createAppCgroup creates the cgroup v2 group for per-application routing
+func createAppCgroup(cgroup string) error {
+	if err := os.MkdirAll(filepath.Join(cgroupRoot, cgroup), 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup %s: %v", cgroup, err)
+	}
+	return nil
+}
+
+// removeAppCgroup removes the group once no process is left in it
+func removeAppCgroup(cgroup string) {
+	os.Remove(filepath.Join(cgroupRoot, cgroup))
+}
+
+// JoinAppCgroup moves a process into the per-application routing cgroup
+func JoinAppCgroup(cgroup string, pid int) error {
+	procs := filepath.Join(cgroupRoot, cgroup, "cgroup.procs")
+	if err := os.WriteFile(procs, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("cgroup %s does not exist, is the client running with app_mode set?", cgroup)
+		}
+		return fmt.Errorf("failed to join cgroup %s: %v", cgroup, err)
+	}
+	return nil
+}
+
 // createNetworkStack creates a new gVisor network stack
 func createNetworkStack() *stack.Stack {
 	s := stack.New(stack.Options{
@@ -156,7 +449,7 @@ func createNetworkStack() *stack.Stack {
 // Start starts reading from the TUN device
 func (t *TUNDevice) Start() error {
 	t.isRunning = true
-	t.logger.Infof("TUN device %s started with IP %s", t.name, t.cidr)
+	t.logger.Infof("TUN device %s started with IP %s", t.name, t.Addresses()[0].String())
 	return nil
 }
 
@@ -177,7 +470,256 @@ func (t *TUNDevice) Read(buf []byte) (int, error) {
 	return unix.Read(t.fd, buf)
 }
 
+// ReadTimeout reads a packet from the TUN device, waiting at most timeout for one
+// Returns os.ErrDeadlineExceeded if no packet arrived in time.
+func (t *TUNDevice) ReadTimeout(buf []byte, timeout time.Duration) (int, error) {
+	fds := []unix.PollFd{{Fd: int32(t.fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, int(timeout/time.Millisecond))
+	if err == unix.EINTR || err == nil && n == 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err != nil {
+		return 0, err
+	}
+	if fds[0].Revents&unix.POLLNVAL != 0 {
+		return 0, unix.EBADF
+	}
+	return unix.Read(t.fd, buf)
+}
+
 // Write writes a packet to the TUN device
 func (t *TUNDevice) Write(buf []byte) (int, error) {
 	return unix.Write(t.fd, buf)
 }
+
+// Addr returns the device's own address of the requested family, or nil if it has none
+func (t *TUNDevice) Addr(ipv6 bool) net.IP {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, addr := range t.addrs {
+		if (addr.IP.To4() == nil) == ipv6 {
+			return addr.IP
+		}
+	}
+	return nil
+}
+
+// MTU returns the MTU configured on the device
+func (t *TUNDevice) MTU() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.mtu
+}
+
+// SetMTU changes the MTU of the live device
+func (t *TUNDevice) SetMTU(mtu int) error {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", t.name, err)
+	}
+
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU: %v", err)
+	}
+
+	t.mutex.Lock()
+	t.mtu = mtu
+	t.mutex.Unlock()
+
+	t.logger.Infof("TUN device %s MTU set to %d", t.name, mtu)
+	return nil
+}
+
+// Addresses returns the addresses assigned to the device
+// The IP of each network is the device's own address, not the network address.
+func (t *TUNDevice) Addresses() []net.IPNet {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	addrs := make([]net.IPNet, 0, len(t.addrs))
+	for _, addr := range t.addrs {
+		addrs = append(addrs, *addr)
+	}
+	return addrs
+}
+
+// AddAddress adds an address to the live device, keeping the addresses it already has
+func (t *TUNDevice) AddAddress(cidr string) error {
+	addr, err := parseAddress(cidr)
+	if err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", t.name, err)
+	}
+	if err := netlink.AddrReplace(link, tunAddr(addr)); err != nil {
+		return fmt.Errorf("failed to add IP address: %v", err)
+	}
+
+	t.mutex.Lock()
+	t.addrs = append(removeAddress(t.addrs, addr), addr)
+	t.mutex.Unlock()
+
+	t.logger.Infof("TUN device %s address %s added", t.name, addr)
+	return nil
+}
+
+// SetAddress makes cidr the only address of its family on the live device,
+// for instance when the server assigns a different one on reconnect
+// Addresses of the other family are kept. The device stays up throughout, so
+// connections using addresses that do not change are not disturbed.
+func (t *TUNDevice) SetAddress(cidr string) error {
+	addr, err := parseAddress(cidr)
+	if err != nil {
+		return err
+	}
+	ipv6 := addr.IP.To4() == nil
+
+	t.mutex.RLock()
+	var current []*net.IPNet
+	for _, a := range t.addrs {
+		if (a.IP.To4() == nil) == ipv6 {
+			current = append(current, a)
+		}
+	}
+	t.mutex.RUnlock()
+	if len(current) == 1 && sameAddress(current[0], addr) {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", t.name, err)
+	}
+
+	// Add the new address before removing the old ones, so the device is never left without one
+	if err := netlink.AddrReplace(link, tunAddr(addr)); err != nil {
+		return fmt.Errorf("failed to add IP address: %v", err)
+	}
+
+	// Remove every other address of the family, including ones added outside the client
+	family := netlink.FAMILY_V4
+	if ipv6 {
+		family = netlink.FAMILY_V6
+	}
+	existing, err := netlink.AddrList(link, family)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses: %v", err)
+	}
+	for _, old := range existing {
+		// The kernel manages the IPv6 link-local address
+		if sameAddress(old.IPNet, addr) || old.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if err := netlink.AddrDel(link, &old); err != nil {
+			t.logger.Warnf("Failed to remove stale address %s: %v", old.IPNet, err)
+			continue
+		}
+		t.logger.Debugf("Removed stale address %s from %s", old.IPNet, t.name)
+	}
+
+	t.mutex.Lock()
+	addrs := []*net.IPNet{addr}
+	for _, a := range t.addrs {
+		if (a.IP.To4() == nil) != ipv6 {
+			addrs = append(addrs, a)
+		}
+	}
+	t.addrs = addrs
+	t.mutex.Unlock()
+
+	t.logger.Infof("TUN device %s address set to %s", t.name, addr)
+	return nil
+}
+
+// RemoveAddress removes an address from the live device
+func (t *TUNDevice) RemoveAddress(cidr string) error {
+	addr, err := parseAddress(cidr)
+	if err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", t.name, err)
+	}
+	if err := netlink.AddrDel(link, tunAddr(addr)); err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+		return fmt.Errorf("failed to remove IP address: %v", err)
+	}
+
+	t.mutex.Lock()
+	t.addrs = removeAddress(t.addrs, addr)
+	t.mutex.Unlock()
+
+	t.logger.Infof("TUN device %s address %s removed", t.name, addr)
+	return nil
+}
+
+// SetLinkUp brings the live device up or down
+// The kernel removes routes through the device while it is down, so they
+// have to be installed again after bringing it back up.
+func (t *TUNDevice) SetLinkUp(up bool) error {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link for %s: %v", t.name, err)
+	}
+
+	if up {
+		err = netlink.LinkSetUp(link)
+	} else {
+		err = netlink.LinkSetDown(link)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set link state: %v", err)
+	}
+
+	state := "down"
+	if up {
+		state = "up"
+	}
+	t.logger.Infof("TUN device %s is %s", t.name, state)
+	return nil
+}
+
+// parseAddress parses an address with prefix length, keeping the host address
+func parseAddress(cidr string) (*net.IPNet, error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %v", err)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: network.Mask}, nil
+}
+
+// tunAddr returns the netlink address for a device address
+// IPv6 addresses skip duplicate address detection, which would otherwise keep
+// them unusable for a moment after every change.
+func tunAddr(addr *net.IPNet) *netlink.Addr {
+	nlAddr := &netlink.Addr{IPNet: addr}
+	if addr.IP.To4() == nil {
+		nlAddr.Flags = unix.IFA_F_NODAD
+	}
+	return nlAddr
+}
+
+// sameAddress reports whether two device addresses are equal, prefix length included
+func sameAddress(a, b *net.IPNet) bool {
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	return a.IP.Equal(b.IP) && aOnes == bOnes
+}
+
+// removeAddress returns addrs without addr
+func removeAddress(addrs []*net.IPNet, addr *net.IPNet) []*net.IPNet {
+	kept := make([]*net.IPNet, 0, len(addrs))
+	for _, a := range addrs {
+		if !sameAddress(a, addr) {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
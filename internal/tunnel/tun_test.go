@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAppRoutingStatements(t *testing.T) {
+	match := `socket cgroupv2 level 2 "tuno/apps"`
+
+	tests := []struct {
+		name     string
+		mode     string
+		allowLAN bool
+		want     []string
+	}{
+		{"include", appModeInclude, false, []string{
+			match + " meta mark set 0x7475",
+		}},
+		{"include ignores LAN", appModeInclude, true, []string{
+			match + " meta mark set 0x7475",
+		}},
+		{"exclude", appModeExclude, false, []string{
+			match + " meta mark set 0x7476 return",
+			"meta mark set 0x7475",
+		}},
+		{"exclude with LAN", appModeExclude, true, []string{
+			match + " meta mark set 0x7476 return",
+			"ip daddr { 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16, 169.254.0.0/16 } return",
+			"ip6 daddr { fe80::/10, fc00::/7 } return",
+			"meta mark set 0x7475",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := appRoutingStatements(tt.mode, "/tuno/apps/", tt.allowLAN)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("appRoutingStatements() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}